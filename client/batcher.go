@@ -0,0 +1,334 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultMaxBuffered   = 10000
+	defaultConcurrency   = 4
+)
+
+// ErrBufferFull is returned by Batcher.Add when too many records are waiting
+// to be sent
+var ErrBufferFull = errors.New("logbook: buffer is full")
+
+// ErrBatcherClosed is returned by Batcher.Add after the batcher was closed
+var ErrBatcherClosed = errors.New("logbook: batcher is closed")
+
+// FailedRecord is a record rejected by the server
+type FailedRecord struct {
+	Application string
+	Record      Record
+	Err         error
+}
+
+// FlushError is returned by Batcher.Flush when some records weren't sent
+type FlushError struct {
+	// Requeued is the number of records put back to the buffer after
+	// temporary errors, they are sent with the next flush
+	Requeued int
+	// Rejected are records rejected by the server. They are listed only when
+	// ErrorHandler isn't set.
+	Rejected []FailedRecord
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("logbook: %d records requeued, %d records rejected", e.Requeued, len(e.Rejected))
+}
+
+type batchRecord struct {
+	application string
+	record      Record
+}
+
+// Batcher buffers log records and sends them in the background. Buffered
+// records are flushed every FlushInterval or as soon as BatchSize records are
+// collected. Records of a flush are grouped by application and sent with
+// PutBatch, up to 1000 records per request and Concurrency requests at a
+// time.
+//
+// Records of failed requests are sent again with the next flush. As with
+// Client retries, records of a request that failed after the server had saved
+// them may be duplicated.
+type Batcher struct {
+	client *Client
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxBuffered   int
+	Concurrency   int
+	// ErrorHandler is called with errors of records rejected by the server
+	ErrorHandler func(application string, record Record, err error)
+
+	lock   sync.Mutex
+	buffer []batchRecord
+	// rejected are records rejected during background flushes, they are
+	// reported by the next Flush call
+	rejected []FailedRecord
+	closed   bool
+	started  sync.Once
+
+	flushLock sync.Mutex
+	flushes   chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewBatcher creates a batcher that sends records with the client
+func NewBatcher(client *Client) *Batcher {
+	return &Batcher{
+		client:        client,
+		BatchSize:     defaultBatchSize,
+		FlushInterval: defaultFlushInterval,
+		MaxBuffered:   defaultMaxBuffered,
+		Concurrency:   defaultConcurrency,
+		flushes:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// Add buffers the log record. It never blocks.
+func (b *Batcher) Add(application string, record Record) error {
+	b.started.Do(func() { go b.loop() })
+
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return ErrBatcherClosed
+	}
+
+	if len(b.buffer)+len(b.rejected) >= b.MaxBuffered {
+		return ErrBufferFull
+	}
+
+	b.buffer = append(b.buffer, batchRecord{application, record})
+
+	if len(b.buffer) >= b.BatchSize {
+		select {
+		case b.flushes <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Flush sends all buffered records. Records that failed with temporary
+// errors are put back to the buffer, records rejected by the server are
+// passed to ErrorHandler. Flush returns *FlushError when some records weren't
+// sent and weren't passed to ErrorHandler, including records rejected during
+// background flushes.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.lock.Lock()
+	rejected := b.rejected
+	b.rejected = nil
+	b.lock.Unlock()
+
+	err := b.flush(ctx)
+	if len(rejected) == 0 {
+		return err
+	}
+
+	switch flushErr := err.(type) {
+	case nil:
+		return &FlushError{Rejected: rejected}
+	case *FlushError:
+		flushErr.Rejected = append(rejected, flushErr.Rejected...)
+		return flushErr
+	default:
+		b.lock.Lock()
+		b.rejected = append(rejected, b.rejected...)
+		b.lock.Unlock()
+		return err
+	}
+}
+
+func (b *Batcher) flush(ctx context.Context) error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	b.lock.Lock()
+	batch := b.buffer
+	b.buffer = nil
+	b.lock.Unlock()
+
+	var (
+		requeued []batchRecord
+		flushErr FlushError
+	)
+
+	for i, err := range b.send(ctx, batch) {
+		r := batch[i]
+
+		switch {
+		case err == nil:
+		case ctx.Err() != nil || retryable(err):
+			requeued = append(requeued, r)
+		case b.ErrorHandler != nil:
+			b.ErrorHandler(r.application, r.record, err)
+		default:
+			flushErr.Rejected = append(flushErr.Rejected, FailedRecord{r.application, r.record, err})
+		}
+	}
+
+	if len(requeued) > 0 {
+		b.requeue(requeued)
+		flushErr.Requeued = len(requeued)
+	}
+
+	if err := ctx.Err(); err != nil {
+		b.keepRejected(flushErr.Rejected)
+		return err
+	}
+
+	if flushErr.Requeued > 0 || len(flushErr.Rejected) > 0 {
+		return &flushErr
+	}
+
+	return nil
+}
+
+// send puts the records with batch requests sent concurrently and returns
+// errors of the records
+func (b *Batcher) send(ctx context.Context, batch []batchRecord) []error {
+	errs := make([]error, len(batch))
+
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+
+	for _, indexes := range splitBatch(batch) {
+		if err := ctx.Err(); err != nil {
+			for _, i := range indexes {
+				errs[i] = err
+			}
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(indexes []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			records := make([]Record, len(indexes))
+			for j, i := range indexes {
+				records[j] = batch[i].record
+			}
+
+			err := b.client.PutBatch(ctx, batch[indexes[0]].application, records)
+
+			batchErr, _ := err.(*BatchError)
+
+			for j, i := range indexes {
+				if batchErr != nil {
+					errs[i] = batchErr.Errors[j]
+				} else {
+					errs[i] = err
+				}
+			}
+		}(indexes)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// splitBatch groups indexes of the records by application into requests of
+// up to maxBatchSize records keeping the order of the records
+func splitBatch(batch []batchRecord) (requests [][]int) {
+	current := make(map[string]int)
+
+	for i, r := range batch {
+		n, ok := current[r.application]
+		if !ok || len(requests[n]) == maxBatchSize {
+			n = len(requests)
+			current[r.application] = n
+			requests = append(requests, nil)
+		}
+
+		requests[n] = append(requests[n], i)
+	}
+
+	return
+}
+
+// Close stops background flushing and sends buffered records. Records that
+// couldn't be sent are reported with *FlushError.
+func (b *Batcher) Close(ctx context.Context) error {
+	b.lock.Lock()
+	alreadyClosed := b.closed
+	b.closed = true
+	b.lock.Unlock()
+
+	if !alreadyClosed {
+		b.started.Do(func() { close(b.stopped) })
+		close(b.done)
+		<-b.stopped
+	}
+
+	return b.Flush(ctx)
+}
+
+// requeue puts unsent records back to the head of the buffer
+func (b *Batcher) requeue(batch []batchRecord) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.buffer = append(batch[:len(batch):len(batch)], b.buffer...)
+}
+
+// keepRejected keeps rejected records until the next Flush call reports them
+func (b *Batcher) keepRejected(rejected []FailedRecord) {
+	if len(rejected) == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rejected = append(b.rejected, rejected...)
+}
+
+func (b *Batcher) loop() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.flushes:
+		}
+
+		if flushErr, ok := b.flush(context.Background()).(*FlushError); ok {
+			b.keepRejected(flushErr.Rejected)
+		}
+	}
+}
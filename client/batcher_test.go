@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batcher", func() {
+	var (
+		server  *fakeServer
+		batcher *Batcher
+	)
+
+	BeforeEach(func() {
+		server = newFakeServer()
+
+		client := New(server.URL, "user", "password")
+		client.MaxRetries = 0
+
+		batcher = NewBatcher(client)
+		batcher.FlushInterval = time.Hour
+	})
+
+	AfterEach(func() {
+		batcher.Close(context.Background())
+		server.Close()
+	})
+
+	It("should send records when the batch is full", func() {
+		batcher.BatchSize = 2
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp", Record{Message: "Message 2", Level: 1})).To(Succeed())
+
+		Eventually(server.requestsCount).Should(Equal(1))
+
+		records := server.batch(0)
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Message).To(Equal("Message 1"))
+		Expect(records[1].Message).To(Equal("Message 2"))
+	})
+
+	It("should send records every FlushInterval", func() {
+		batcher.FlushInterval = 10 * time.Millisecond
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+
+		Eventually(server.requestsCount).Should(Equal(1))
+	})
+
+	It("should set created_at of buffered records", func() {
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(server.batch(0)[0].CreatedAt).NotTo(BeEmpty())
+	})
+
+	It("should reject records when the buffer is full", func() {
+		batcher.MaxBuffered = 1
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp", Record{Message: "Message 2", Level: 1})).To(Equal(ErrBufferFull))
+	})
+
+	It("should report records that couldn't be sent", func() {
+		var (
+			lock   sync.Mutex
+			failed []string
+		)
+
+		batcher.ErrorHandler = func(application string, record Record, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			failed = append(failed, record.Message)
+		}
+
+		server.body = `{"saved":1,"errors":[{"index":0,"error":"Something went wrong"}]}`
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp", Record{Message: "Message 2", Level: 1})).To(Succeed())
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(failed).To(Equal([]string{"Message 1"}))
+		Expect(server.requestsCount()).To(Equal(1))
+	})
+
+	It("should report all records of a rejected request", func() {
+		var failed []string
+
+		batcher.ErrorHandler = func(application string, record Record, err error) {
+			failed = append(failed, record.Message)
+		}
+
+		server.statuses = []int{422}
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp", Record{Message: "Message 2", Level: 1})).To(Succeed())
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(failed).To(Equal([]string{"Message 1", "Message 2"}))
+	})
+
+	It("should send a request per application", func() {
+		Expect(batcher.Add("testapp1", Record{Message: "Message 1", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp2", Record{Message: "Message 2", Level: 1})).To(Succeed())
+		Expect(batcher.Add("testapp1", Record{Message: "Message 3", Level: 1})).To(Succeed())
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(server.requestsCount()).To(Equal(2))
+
+		messages := make(map[string][]string)
+		for i := 0; i < 2; i++ {
+			for _, record := range server.batch(i) {
+				path := server.requests[i].URL.Path
+				messages[path] = append(messages[path], record.Message)
+			}
+		}
+
+		Expect(messages).To(Equal(map[string][]string{
+			"/testapp1/batch": {"Message 1", "Message 3"},
+			"/testapp2/batch": {"Message 2"},
+		}))
+	})
+
+	It("should split big batches", func() {
+		batcher.BatchSize = 2 * maxBatchSize
+
+		for i := 0; i < maxBatchSize+1; i++ {
+			Expect(batcher.Add("testapp", Record{Message: "Message", Level: 1})).To(Succeed())
+		}
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(server.requestsCount()).To(Equal(2))
+		Expect([]int{len(server.batch(0)), len(server.batch(1))}).To(ConsistOf(maxBatchSize, 1))
+	})
+
+	It("should send requests concurrently", func() {
+		batcher.Concurrency = 3
+		server.delay = 50 * time.Millisecond
+
+		for i := 0; i < 6; i++ {
+			Expect(batcher.Add(fmt.Sprintf("testapp%d", i), Record{Message: "Message", Level: 1})).To(Succeed())
+		}
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(server.requestsCount()).To(Equal(6))
+		Expect(server.maxConcurrentRequests()).To(Equal(3))
+	})
+
+	It("should requeue records failed with temporary errors", func() {
+		server.statuses = []int{503}
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+
+		err := batcher.Flush(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&FlushError{}))
+		Expect(err.(*FlushError).Requeued).To(Equal(1))
+
+		Expect(batcher.Flush(context.Background())).To(Succeed())
+
+		Expect(server.requestsCount()).To(Equal(2))
+		Expect(server.batch(1)[0].Message).To(Equal("Message 1"))
+	})
+
+	It("should return rejected records when there is no ErrorHandler", func() {
+		server.statuses = []int{422}
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+
+		err := batcher.Flush(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&FlushError{}))
+
+		rejected := err.(*FlushError).Rejected
+		Expect(rejected).To(HaveLen(1))
+		Expect(rejected[0].Application).To(Equal("testapp"))
+		Expect(rejected[0].Record.Message).To(Equal("Message 1"))
+		Expect(rejected[0].Err).To(HaveOccurred())
+	})
+
+	It("should keep records rejected in background until the next Flush", func() {
+		batcher.BatchSize = 1
+		server.statuses = []int{422}
+
+		Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+
+		Eventually(func() (rejected []string) {
+			if flushErr, ok := batcher.Flush(context.Background()).(*FlushError); ok {
+				for _, failed := range flushErr.Rejected {
+					rejected = append(rejected, failed.Record.Message)
+				}
+			}
+			return
+		}).Should(Equal([]string{"Message 1"}))
+	})
+
+	Describe("Close", func() {
+		It("should send buffered records", func() {
+			Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Succeed())
+			Expect(batcher.Close(context.Background())).To(Succeed())
+
+			Expect(server.requestsCount()).To(Equal(1))
+		})
+
+		It("should reject new records", func() {
+			Expect(batcher.Close(context.Background())).To(Succeed())
+			Expect(batcher.Add("testapp", Record{Message: "Message 1", Level: 1})).To(Equal(ErrBatcherClosed))
+		})
+	})
+})
@@ -0,0 +1,311 @@
+// Package client is a Go client for the Logbook HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000-07:00"
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryDelay = 100 * time.Millisecond
+
+	// maximum number of records the server accepts in a batch request
+	maxBatchSize = 1000
+)
+
+// Record is a log record
+type Record struct {
+	Message   string    `json:"message"`
+	Level     int       `json:"level"`
+	Tags      []string  `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	SpanID    string    `json:"span_id,omitempty"`
+}
+
+// Query describes log records to get. StartTime and EndTime are required
+// unless TraceID is set.
+type Query struct {
+	Level     int
+	Tags      []string
+	StartTime time.Time
+	EndTime   time.Time
+	Page      int
+	TraceID   string
+}
+
+// Stats is a storage statistics of an application by name. Names depend on
+// the storage driver of the server: bolt reports bolt.BucketStats fields,
+// memory and leveldb report RecordN and TraceN, leveldb also reports Size.
+type Stats map[string]int64
+
+// jsonRecord is a record of a batch request
+type jsonRecord struct {
+	Message   string   `json:"message"`
+	Level     int      `json:"level"`
+	Tags      []string `json:"tags,omitempty"`
+	CreatedAt string   `json:"created_at,omitempty"`
+	TraceID   string   `json:"trace_id,omitempty"`
+	SpanID    string   `json:"span_id,omitempty"`
+}
+
+type batchResponse struct {
+	Saved  int `json:"saved"`
+	Errors []struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+// Error is an error response of the server
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("logbook: %d %s", e.StatusCode, e.Message)
+}
+
+// BatchError is returned by PutBatch when some records of the batch are
+// rejected by the server. The rest of them are saved.
+type BatchError struct {
+	// Errors are errors of rejected records by their index in the batch
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("logbook: %d records of the batch rejected", len(e.Errors))
+}
+
+// temporary reports whether the request may succeed when retried
+func (e *Error) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Client sends requests to a Logbook server. Failed requests are retried
+// MaxRetries times with exponential backoff starting from RetryDelay.
+//
+// Saving records isn't idempotent. If a request fails after the server has
+// saved the records, e.g. with a timeout or a dropped connection, retrying it
+// saves them again, so retried records may be duplicated.
+type Client struct {
+	URL        string
+	User       string
+	Password   string
+	HTTPClient *http.Client
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+// New creates a client of the server at the given URL
+func New(serverURL, user, password string) *Client {
+	return &Client{
+		URL:        strings.TrimRight(serverURL, "/"),
+		User:       user,
+		Password:   password,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: defaultMaxRetries,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// Put saves the log record and returns it as it was saved
+func (c *Client) Put(ctx context.Context, application string, record Record) (saved Record, err error) {
+	params := url.Values{}
+	params.Set("message", record.Message)
+	params.Set("level", strconv.Itoa(record.Level))
+
+	if len(record.Tags) > 0 {
+		params.Set("tags", strings.Join(record.Tags, ","))
+	}
+	if !record.CreatedAt.IsZero() {
+		params.Set("created_at", record.CreatedAt.Format(timeFormat))
+	}
+	if record.TraceID != "" {
+		params.Set("trace_id", record.TraceID)
+	}
+	if record.SpanID != "" {
+		params.Set("span_id", record.SpanID)
+	}
+
+	err = c.do(ctx, "POST", "/"+url.PathEscape(application)+"/put", params, nil, &saved)
+	return
+}
+
+// PutBatch saves up to 1000 log records of the application with a single
+// request. Records rejected by the server are reported with *BatchError.
+func (c *Client) PutBatch(ctx context.Context, application string, records []Record) error {
+	if len(records) > maxBatchSize {
+		return fmt.Errorf("logbook: batch should contain up to %d records", maxBatchSize)
+	}
+
+	batch := make([]jsonRecord, len(records))
+
+	for i, record := range records {
+		batch[i] = jsonRecord{
+			Message: record.Message,
+			Level:   record.Level,
+			Tags:    record.Tags,
+			TraceID: record.TraceID,
+			SpanID:  record.SpanID,
+		}
+
+		if !record.CreatedAt.IsZero() {
+			batch[i].CreatedAt = record.CreatedAt.Format(timeFormat)
+		}
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	var res batchResponse
+
+	if err = c.do(ctx, "POST", "/"+url.PathEscape(application)+"/batch", nil, body, &res); err != nil {
+		return err
+	}
+
+	if len(res.Errors) == 0 {
+		return nil
+	}
+
+	batchErr := &BatchError{Errors: make(map[int]error, len(res.Errors))}
+	for _, recordErr := range res.Errors {
+		batchErr.Errors[recordErr.Index] = &Error{http.StatusUnprocessableEntity, recordErr.Error}
+	}
+
+	return batchErr
+}
+
+// Get loads log records of the application
+func (c *Client) Get(ctx context.Context, application string, query Query) (records []Record, err error) {
+	params := url.Values{}
+	params.Set("level", strconv.Itoa(query.Level))
+
+	if len(query.Tags) > 0 {
+		params.Set("tags", strings.Join(query.Tags, ","))
+	}
+	if !query.StartTime.IsZero() {
+		params.Set("start_time", query.StartTime.Format(timeFormat))
+	}
+	if !query.EndTime.IsZero() {
+		params.Set("end_time", query.EndTime.Format(timeFormat))
+	}
+	if query.Page > 0 {
+		params.Set("page", strconv.Itoa(query.Page))
+	}
+	if query.TraceID != "" {
+		params.Set("trace_id", query.TraceID)
+	}
+
+	err = c.do(ctx, "GET", "/"+url.PathEscape(application)+"/get", params, nil, &records)
+	return
+}
+
+// Stats loads storage statistics of the application
+func (c *Client) Stats(ctx context.Context, application string) (stats Stats, err error) {
+	err = c.do(ctx, "GET", "/"+url.PathEscape(application)+"/stats", nil, nil, &stats)
+	return
+}
+
+// do sends the request and decodes the response to result. POST params are
+// sent as a form unless jsonBody is set.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, jsonBody []byte, result interface{}) (err error) {
+	delay := c.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err = c.doOnce(ctx, method, path, params, jsonBody, result)
+		if err == nil || attempt >= c.MaxRetries || !retryable(err) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, params url.Values, jsonBody []byte, result interface{}) error {
+	var body io.Reader
+
+	reqURL := c.URL + path
+
+	switch {
+	case jsonBody != nil:
+		body = bytes.NewReader(jsonBody)
+	case method == "POST":
+		body = strings.NewReader(params.Encode())
+	}
+
+	if method != "POST" && len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(c.User, c.Password)
+
+	switch {
+	case jsonBody != nil:
+		req.Header.Set("Content-Type", "application/json")
+	case method == "POST":
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		errRes := struct {
+			Error string `json:"error"`
+		}{}
+
+		if json.NewDecoder(res.Body).Decode(&errRes) != nil || errRes.Error == "" {
+			errRes.Error = http.StatusText(res.StatusCode)
+		}
+
+		return &Error{res.StatusCode, errRes.Error}
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// retryable reports whether the request failed due to a network error or a
+// temporary server error
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr *url.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var resErr *Error
+	return errors.As(err, &resErr) && resErr.temporary()
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeServer records requests and responds with the configured status
+type fakeServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*http.Request
+	forms    []url.Values
+	bodies   [][]byte
+	statuses []int
+	body     string
+	delay    time.Duration
+
+	inFlight    int
+	maxInFlight int
+}
+
+func newFakeServer() *fakeServer {
+	s := &fakeServer{body: `{}`}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.lock.Lock()
+		s.requests = append(s.requests, r)
+		s.forms = append(s.forms, r.Form)
+		s.bodies = append(s.bodies, body)
+
+		status := 200
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		resBody := s.body
+		s.inFlight++
+		if s.inFlight > s.maxInFlight {
+			s.maxInFlight = s.inFlight
+		}
+		s.lock.Unlock()
+
+		time.Sleep(s.delay)
+
+		s.lock.Lock()
+		s.inFlight--
+		s.lock.Unlock()
+
+		w.WriteHeader(status)
+		if status == 200 {
+			w.Write([]byte(resBody))
+		} else {
+			w.Write([]byte(`{"error":"Something went wrong"}`))
+		}
+	}))
+
+	return s
+}
+
+func (s *fakeServer) requestsCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+func (s *fakeServer) maxConcurrentRequests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.maxInFlight
+}
+
+func (s *fakeServer) form(i int) url.Values {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.forms[i]
+}
+
+// batch decodes records of the batch request
+func (s *fakeServer) batch(i int) (records []jsonRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	Expect(json.Unmarshal(s.bodies[i], &records)).To(Succeed())
+	return
+}
+
+var _ = Describe("Client", func() {
+	var (
+		server *fakeServer
+		client *Client
+		ctx    context.Context
+	)
+
+	BeforeEach(func() {
+		server = newFakeServer()
+		client = New(server.URL+"/", "user", "password")
+		client.RetryDelay = time.Millisecond
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("Put", func() {
+		It("should send the record", func() {
+			server.body = `{"message":"Lorem ipsum","level":3,"tags":["tag1","tag2"],"created_at":"2015-10-16T08:10:11.123+03:00"}`
+
+			saved, err := client.Put(ctx, "testapp", Record{
+				Message:   "Lorem ipsum",
+				Level:     3,
+				Tags:      []string{"tag1", "tag2"},
+				CreatedAt: time.Date(2015, 10, 16, 8, 10, 11, 123000000, time.FixedZone("", 3*3600)),
+				TraceID:   "trace1",
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(saved.Message).To(Equal("Lorem ipsum"))
+			Expect(saved.Tags).To(Equal([]string{"tag1", "tag2"}))
+
+			req := server.requests[0]
+			Expect(req.Method).To(Equal("POST"))
+			Expect(req.URL.Path).To(Equal("/testapp/put"))
+
+			user, password, _ := req.BasicAuth()
+			Expect(user).To(Equal("user"))
+			Expect(password).To(Equal("password"))
+
+			form := server.form(0)
+			Expect(form.Get("message")).To(Equal("Lorem ipsum"))
+			Expect(form.Get("level")).To(Equal("3"))
+			Expect(form.Get("tags")).To(Equal("tag1,tag2"))
+			Expect(form.Get("created_at")).To(Equal("2015-10-16T08:10:11.123+03:00"))
+			Expect(form.Get("trace_id")).To(Equal("trace1"))
+			Expect(form).NotTo(HaveKey("span_id"))
+		})
+
+		It("should retry temporary errors", func() {
+			server.statuses = []int{503, 500}
+
+			_, err := client.Put(ctx, "testapp", Record{Message: "Lorem ipsum", Level: 1})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.requestsCount()).To(Equal(3))
+		})
+
+		It("should give up after MaxRetries", func() {
+			server.statuses = []int{503, 503, 503, 503, 503}
+			client.MaxRetries = 2
+
+			_, err := client.Put(ctx, "testapp", Record{Message: "Lorem ipsum", Level: 1})
+
+			Expect(err).To(Equal(&Error{503, "Something went wrong"}))
+			Expect(server.requestsCount()).To(Equal(3))
+		})
+
+		It("should not retry client errors", func() {
+			server.statuses = []int{422}
+
+			_, err := client.Put(ctx, "testapp", Record{Message: "Lorem ipsum", Level: 10})
+
+			Expect(err).To(Equal(&Error{422, "Something went wrong"}))
+			Expect(server.requestsCount()).To(Equal(1))
+		})
+	})
+
+	Describe("PutBatch", func() {
+		It("should send the records with a single request", func() {
+			err := client.PutBatch(ctx, "testapp", []Record{
+				{
+					Message:   "Lorem ipsum",
+					Level:     3,
+					Tags:      []string{"tag1", "tag2"},
+					CreatedAt: time.Date(2015, 10, 16, 8, 10, 11, 123000000, time.FixedZone("", 3*3600)),
+					TraceID:   "trace1",
+				},
+				{Message: "Dolor sit amet", Level: 0},
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.requestsCount()).To(Equal(1))
+
+			req := server.requests[0]
+			Expect(req.Method).To(Equal("POST"))
+			Expect(req.URL.Path).To(Equal("/testapp/batch"))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			Expect(server.batch(0)).To(Equal([]jsonRecord{
+				{
+					Message:   "Lorem ipsum",
+					Level:     3,
+					Tags:      []string{"tag1", "tag2"},
+					CreatedAt: "2015-10-16T08:10:11.123+03:00",
+					TraceID:   "trace1",
+				},
+				{Message: "Dolor sit amet", Level: 0},
+			}))
+		})
+
+		It("should report rejected records", func() {
+			server.body = `{"saved":1,"errors":[{"index":1,"error":"Message should be defined"}]}`
+
+			err := client.PutBatch(ctx, "testapp", []Record{
+				{Message: "Lorem ipsum", Level: 1},
+				{Level: 1},
+			})
+
+			Expect(err).To(Equal(&BatchError{map[int]error{
+				1: &Error{422, "Message should be defined"},
+			}}))
+		})
+
+		It("should not send batches bigger than the server accepts", func() {
+			err := client.PutBatch(ctx, "testapp", make([]Record, maxBatchSize+1))
+
+			Expect(err).To(HaveOccurred())
+			Expect(server.requestsCount()).To(BeZero())
+		})
+	})
+
+	Describe("Get", func() {
+		It("should load records", func() {
+			server.body = `[{"message":"Message one","level":2,"tags":["tag1"],"created_at":"2015-10-16T08:10:11.123+03:00"}]`
+
+			records, err := client.Get(ctx, "testapp", Query{
+				Level:     2,
+				Tags:      []string{"tag1"},
+				StartTime: time.Date(2015, 10, 16, 0, 0, 0, 0, time.UTC),
+				EndTime:   time.Date(2015, 10, 17, 0, 0, 0, 0, time.UTC),
+				Page:      2,
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Message).To(Equal("Message one"))
+			Expect(records[0].Level).To(Equal(2))
+
+			req := server.requests[0]
+			Expect(req.Method).To(Equal("GET"))
+			Expect(req.URL.Path).To(Equal("/testapp/get"))
+
+			query := req.URL.Query()
+			Expect(query.Get("level")).To(Equal("2"))
+			Expect(query.Get("tags")).To(Equal("tag1"))
+			Expect(query.Get("start_time")).To(Equal("2015-10-16T00:00:00.000+00:00"))
+			Expect(query.Get("end_time")).To(Equal("2015-10-17T00:00:00.000+00:00"))
+			Expect(query.Get("page")).To(Equal("2"))
+		})
+	})
+
+	Describe("Stats", func() {
+		It("should load stats", func() {
+			server.body = `{"KeyN":10,"Depth":2}`
+
+			stats, err := client.Stats(ctx, "testapp")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats).To(Equal(Stats{"KeyN": 10, "Depth": 2}))
+			Expect(server.requests[0].URL.Path).To(Equal("/testapp/stats"))
+		})
+	})
+})
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// HandlerOptions are options of Handler
+type HandlerOptions struct {
+	// Level is the minimum level of records to send. Default: slog.LevelInfo.
+	Level slog.Leveler
+}
+
+// Handler is a slog.Handler that sends records to Logbook through a Batcher.
+// Attributes become "key=value" tags, "trace_id" and "span_id" attributes
+// are sent as record trace context.
+type Handler struct {
+	batcher     *Batcher
+	application string
+	level       slog.Leveler
+	tags        []string
+	traceID     string
+	spanID      string
+	group       string
+}
+
+// NewHandler creates a handler that sends records of the application
+func NewHandler(batcher *Batcher, application string, opts *HandlerOptions) *Handler {
+	h := &Handler{
+		batcher:     batcher,
+		application: application,
+		level:       slog.LevelInfo,
+	}
+
+	if opts != nil && opts.Level != nil {
+		h.level = opts.Level
+	}
+
+	return h
+}
+
+// Enabled reports whether the handler sends records of the level
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle sends the record
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	record := Record{
+		Message:   r.Message,
+		Level:     slogLevel(r.Level),
+		Tags:      slices.Clone(h.tags),
+		CreatedAt: r.Time,
+		TraceID:   h.traceID,
+		SpanID:    h.spanID,
+	}
+
+	r.Attrs(func(attr slog.Attr) bool {
+		h.addAttr(&record, h.group, attr)
+		return true
+	})
+
+	return h.batcher.Add(h.application, record)
+}
+
+// WithAttrs returns a handler that adds the attributes to every record
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	record := Record{Tags: slices.Clone(h.tags), TraceID: h.traceID, SpanID: h.spanID}
+
+	for _, attr := range attrs {
+		h2.addAttr(&record, h.group, attr)
+	}
+
+	h2.tags, h2.traceID, h2.spanID = record.Tags, record.TraceID, record.SpanID
+
+	return &h2
+}
+
+// WithGroup returns a handler that prefixes keys of next attributes with the
+// group name
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.group = h.group + name + "."
+
+	return &h2
+}
+
+func (h *Handler) addAttr(record *Record, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			group += attr.Key + "."
+		}
+
+		for _, groupAttr := range attr.Value.Group() {
+			h.addAttr(record, group, groupAttr)
+		}
+
+		return
+	}
+
+	value := attr.Value.String()
+
+	switch {
+	case group == "" && attr.Key == "trace_id":
+		record.TraceID = value
+	case group == "" && attr.Key == "span_id":
+		record.SpanID = value
+	default:
+		// commas separate tags
+		tag := strings.ReplaceAll(group+attr.Key+"="+value, ",", " ")
+		record.Tags = append(record.Tags, tag)
+	}
+}
+
+// slogLevel maps slog level onto log record level
+func slogLevel(level slog.Level) int {
+	switch {
+	case level > slog.LevelError:
+		return 5
+	case level >= slog.LevelError:
+		return 4
+	case level >= slog.LevelWarn:
+		return 3
+	case level > slog.LevelInfo:
+		return 2
+	case level >= slog.LevelInfo:
+		return 1
+	}
+
+	return 0
+}
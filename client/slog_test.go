@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		server  *fakeServer
+		batcher *Batcher
+		logger  *slog.Logger
+	)
+
+	BeforeEach(func() {
+		server = newFakeServer()
+
+		batcher = NewBatcher(New(server.URL, "user", "password"))
+		batcher.FlushInterval = time.Hour
+
+		logger = slog.New(NewHandler(batcher, "testapp", nil))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	flush := func() {
+		Expect(batcher.Close(context.Background())).To(Succeed())
+	}
+
+	It("should send log records", func() {
+		logger.Warn("Lorem ipsum", "user", "john", "attempt", 3)
+		flush()
+
+		Expect(server.requests[0].URL.Path).To(Equal("/testapp/batch"))
+
+		record := server.batch(0)[0]
+		Expect(record.Message).To(Equal("Lorem ipsum"))
+		Expect(record.Level).To(Equal(3))
+		Expect(record.Tags).To(Equal([]string{"user=john", "attempt=3"}))
+	})
+
+	It("should skip records below the level", func() {
+		logger.Debug("Lorem ipsum")
+		flush()
+
+		Expect(server.requestsCount()).To(Equal(0))
+	})
+
+	It("should send attributes and groups of the logger", func() {
+		logger.With("service", "api").WithGroup("req").Info("Lorem ipsum", "id", "1,2", slog.Group("user", "id", 5))
+		flush()
+
+		Expect(server.batch(0)[0].Tags).To(Equal([]string{"service=api", "req.id=1 2", "req.user.id=5"}))
+	})
+
+	It("should send trace context", func() {
+		logger.With("trace_id", "trace1").Info("Lorem ipsum", "span_id", "span1")
+		flush()
+
+		record := server.batch(0)[0]
+		Expect(record.TraceID).To(Equal("trace1"))
+		Expect(record.SpanID).To(Equal("span1"))
+		Expect(record.Tags).To(BeEmpty())
+	})
+
+	Describe("slogLevel", func() {
+		It("should map slog levels onto log record levels", func() {
+			Expect(slogLevel(slog.LevelDebug)).To(Equal(0))
+			Expect(slogLevel(slog.LevelInfo)).To(Equal(1))
+			Expect(slogLevel(slog.LevelInfo + 2)).To(Equal(2))
+			Expect(slogLevel(slog.LevelWarn)).To(Equal(3))
+			Expect(slogLevel(slog.LevelError)).To(Equal(4))
+			Expect(slogLevel(slog.LevelError + 4)).To(Equal(5))
+		})
+	})
+})
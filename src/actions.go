@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -13,6 +16,8 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+var traceIDRegexp = regexp.MustCompile("\\A[0-9A-Za-z_-]{1,64}\\z")
+
 func extractTags(tags string) []string {
 	if len(tags) > 0 {
 		return strings.Split(tags, ",")
@@ -35,6 +40,18 @@ func checkCommonParams(lvl string, tags []string) error {
 	return nil
 }
 
+func checkTraceParams(traceID string, spanID string) error {
+	if len(traceID) > 0 && !traceIDRegexp.MatchString(traceID) {
+		return errors.New("Trace ID should contain up to 64 letters, digits, dashes or underscores")
+	}
+
+	if len(spanID) > 0 && !traceIDRegexp.MatchString(spanID) {
+		return errors.New("Span ID should contain up to 64 letters, digits, dashes or underscores")
+	}
+
+	return nil
+}
+
 // Action: Create log ==========================================================
 
 func checkCreateLogParams(msg string, lvl string, tags []string, createdAt string) error {
@@ -59,15 +76,24 @@ func createLogHandler(c *gin.Context) {
 	levelStr := c.PostForm("level")
 	tags := uniqStrings(extractTags(c.PostForm("tags")))
 	createdAtStr := c.PostForm("created_at")
+	traceID := c.PostForm("trace_id")
+	spanID := c.PostForm("span_id")
 
 	if err := checkCreateLogParams(message, levelStr, tags, createdAtStr); err != nil {
 		c.JSON(422, ErrorResponse{err.Error()})
 		return
 	}
 
+	if err := checkTraceParams(traceID, spanID); err != nil {
+		c.JSON(422, ErrorResponse{err.Error()})
+		return
+	}
+
 	logRecord := LogRecord{
 		Message: message,
 		Tags:    tags,
+		TraceID: traceID,
+		SpanID:  spanID,
 	}
 
 	logRecord.Level, _ = strconv.Atoi(levelStr)
@@ -76,6 +102,11 @@ func createLogHandler(c *gin.Context) {
 		logRecord.CreatedAt, _ = parseTime(createdAtStr)
 	}
 
+	if err := checkShardCreatedAt(logRecord.CreatedAt); err != nil {
+		c.JSON(422, ErrorResponse{err.Error()})
+		return
+	}
+
 	panicOnErr(saveLogRecord(application, &logRecord))
 
 	c.JSON(200, logRecord)
@@ -83,6 +114,68 @@ func createLogHandler(c *gin.Context) {
 
 // end of Action: Create log
 
+// Action: Create logs batch ===================================================
+
+const (
+	maxBatchSize     = 1000
+	maxBatchBodySize = 16 * 1024 * 1024
+)
+
+type batchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// BatchResponse tells how many records of the batch are saved and why the
+// rest of them are rejected
+type BatchResponse struct {
+	Saved  int          `json:"saved"`
+	Errors []batchError `json:"errors"`
+}
+
+func createLogsBatchHandler(c *gin.Context) {
+	application := c.Param("application")
+
+	var rawRecords []jsonRecord
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBodySize)
+
+	if err := json.NewDecoder(body).Decode(&rawRecords); err != nil {
+		c.JSON(422, ErrorResponse{"Body should be a JSON array of log records"})
+		return
+	}
+
+	if len(rawRecords) > maxBatchSize {
+		c.JSON(422, ErrorResponse{"Batch should contain up to " + strconv.Itoa(maxBatchSize) + " records"})
+		return
+	}
+
+	response := BatchResponse{Errors: []batchError{}}
+	records := make([]ApplicationLogRecord, 0, len(rawRecords))
+
+	for i, raw := range rawRecords {
+		raw.Application = application
+
+		record, err := raw.logRecord()
+		if err != nil {
+			response.Errors = append(response.Errors, batchError{i, err.Error()})
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	if len(records) > 0 {
+		panicOnErr(saveLogRecords(records))
+	}
+
+	response.Saved = len(records)
+
+	c.JSON(200, response)
+}
+
+// end of Action: Create logs batch
+
 // Action: Get logs ============================================================
 
 func checkGetLogParams(lvl string, tags []string, startTime string, endTime string, page string) error {
@@ -105,6 +198,22 @@ func checkGetLogParams(lvl string, tags []string, startTime string, endTime stri
 	return nil
 }
 
+func checkGetTraceLogParams(lvl string, tags []string, traceID string, page string) error {
+	if err := checkCommonParams(lvl, tags); err != nil {
+		return err
+	}
+
+	if err := checkTraceParams(traceID, ""); err != nil {
+		return err
+	}
+
+	if correct, _ := regexp.MatchString("\\A\\d+\\z", page); !correct {
+		return errors.New("Page should be greater or equal to 1")
+	}
+
+	return nil
+}
+
 func getLogsHandler(c *gin.Context) {
 	var err error
 
@@ -114,11 +223,17 @@ func getLogsHandler(c *gin.Context) {
 	endTimeStr := c.Query("end_time")
 	tags := uniqStrings(extractTags(c.Query("tags")))
 	pageStr := c.Query("page")
+	traceID := c.Query("trace_id")
 
 	if pageStr == "" {
 		pageStr = "1"
 	}
 
+	if len(traceID) > 0 {
+		getTraceLogs(c, application, levelStr, tags, traceID, pageStr)
+		return
+	}
+
 	err = checkGetLogParams(levelStr, tags, startTimeStr, endTimeStr, pageStr)
 	if err != nil {
 		c.JSON(422, ErrorResponse{err.Error()})
@@ -138,8 +253,90 @@ func getLogsHandler(c *gin.Context) {
 	c.JSON(200, logRecords)
 }
 
+// getTraceLogs responds with log records of the trace. Level is optional
+// here, time range isn't needed since records are found by trace index.
+func getTraceLogs(c *gin.Context, application, levelStr string, tags []string, traceID, pageStr string) {
+	if levelStr == "" {
+		levelStr = "0"
+	}
+
+	if err := checkGetTraceLogParams(levelStr, tags, traceID, pageStr); err != nil {
+		c.JSON(422, ErrorResponse{err.Error()})
+		return
+	}
+
+	level, _ := strconv.Atoi(levelStr)
+	page, _ := strconv.Atoi(pageStr)
+
+	logRecords, err := loadTraceLogRecords(application, traceID, level, tags, page)
+	panicOnErr(err)
+
+	c.JSON(200, logRecords)
+}
+
 // end of Action: Get logs
 
+// Action: Search logs =========================================================
+
+func checkSearchLogParams(applications []string, lvl string, tags []string, startTime string, endTime string, page string) error {
+	if len(applications) == 0 {
+		return errors.New("Applications should be defined")
+	}
+
+	if err := checkApplicationPatterns(applications); err != nil {
+		return err
+	}
+
+	return checkGetLogParams(lvl, tags, startTime, endTime, page)
+}
+
+func checkApplicationPatterns(applications []string) error {
+	for _, application := range applications {
+		if application == "" {
+			return errors.New("Applications contain an empty string")
+		}
+
+		if _, err := path.Match(application, ""); err != nil {
+			return errors.New("Applications contain an invalid pattern")
+		}
+	}
+
+	return nil
+}
+
+func searchLogsHandler(c *gin.Context) {
+	applications := uniqStrings(extractTags(c.Query("applications")))
+	levelStr := c.Query("level")
+	startTimeStr := c.Query("start_time")
+	endTimeStr := c.Query("end_time")
+	tags := uniqStrings(extractTags(c.Query("tags")))
+	pageStr := c.Query("page")
+
+	if pageStr == "" {
+		pageStr = "1"
+	}
+
+	err := checkSearchLogParams(applications, levelStr, tags, startTimeStr, endTimeStr, pageStr)
+	if err != nil {
+		c.JSON(422, ErrorResponse{err.Error()})
+		return
+	}
+
+	level, _ := strconv.Atoi(levelStr)
+	page, _ := strconv.Atoi(pageStr)
+	startTime, _ := parseDateTime(startTimeStr, false)
+	endTime, _ := parseDateTime(endTimeStr, true)
+
+	logRecords, err := searchLogRecords(
+		applications, level, tags, startTime, endTime, page,
+	)
+	panicOnErr(err)
+
+	c.JSON(200, logRecords)
+}
+
+// end of Action: Search logs
+
 // Action: App stats ===========================================================
 
 func appStatsHandler(c *gin.Context) {
@@ -149,3 +346,40 @@ func appStatsHandler(c *gin.Context) {
 }
 
 // end of Action: App stats
+
+// Action: Delete logs =========================================================
+
+func deleteLogsHandler(c *gin.Context) {
+	beforeStr := c.Query("before")
+
+	if !checkDateTimeFormat(beforeStr) {
+		c.JSON(422, ErrorResponse{"Before has invalid format"})
+		return
+	}
+
+	before, _ := parseDateTime(beforeStr, false)
+
+	deleted, err := deleteLogRecords(c.Param("application"), before)
+	panicOnErr(err)
+
+	c.JSON(200, gin.H{"deleted": deleted})
+}
+
+// end of Action: Delete logs
+
+// Action: Health ==============================================================
+
+func healthHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+func readinessHandler(c *gin.Context) {
+	if err := checkDBWritable(); err != nil {
+		c.JSON(503, ErrorResponse{err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+// end of Action: Health
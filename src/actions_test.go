@@ -188,6 +188,78 @@ var _ = Describe("Actions", func() {
 			})
 			AssertUnprocessable()
 		})
+
+		Context("with trace_id and span_id", func() {
+			BeforeEach(func() {
+				query = "message=Lorem%20ipsum&level=1&trace_id=4bf92f3577b34da6a3ce929d0e0e4736&span_id=00f067aa0ba902b7"
+			})
+
+			AssertSuccess()
+
+			It("should respond with trace_id and span_id", func() {
+				parsedRes := LogRecord{}
+				Expect(
+					json.Unmarshal(response.Body.Bytes(), &parsedRes),
+				).To(Succeed())
+
+				Expect(parsedRes.TraceID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+				Expect(parsedRes.SpanID).To(Equal("00f067aa0ba902b7"))
+			})
+		})
+
+		Context("with invalid trace_id", func() {
+			BeforeEach(func() {
+				query = "message=Lorem%20ipsum&level=1&trace_id=4bf92f35%2077b3"
+			})
+			AssertUnprocessable()
+		})
+	})
+
+	Describe("/:application/batch", func() {
+		BeforeEach(func() {
+			query = `[
+				{"message":"Lorem ipsum","level":1,"tags":["tag1","tag2"],"created_at":"2015-10-16T08:10:11.123"},
+				{"message":"","level":1},
+				{"message":"Dolor sit amet","level":2,"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"}
+			]`
+		})
+
+		JustBeforeEach(func() {
+			Expect(
+				sendRequest("POST", "/apptest/batch", query),
+			).To(Succeed())
+		})
+
+		AssertSuccess()
+
+		It("should save valid records and report invalid ones", func() {
+			parsedRes := BatchResponse{}
+			Expect(
+				json.Unmarshal(response.Body.Bytes(), &parsedRes),
+			).To(Succeed())
+
+			Expect(parsedRes.Saved).To(Equal(2))
+			Expect(parsedRes.Errors).To(Equal([]batchError{{1, "Message should be defined"}}))
+
+			logRecords, err := loadTraceLogRecords("apptest", "4bf92f3577b34da6a3ce929d0e0e4736", 0, []string{}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(HaveLen(1))
+			Expect(logRecords[0].Message).To(Equal("Dolor sit amet"))
+		})
+
+		Context("with invalid JSON", func() {
+			BeforeEach(func() {
+				query = `{"message":"Lorem ipsum","level":1}`
+			})
+			AssertUnprocessable()
+		})
+
+		Context("with too many records", func() {
+			BeforeEach(func() {
+				query = "[" + strings.Repeat(`{"message":"Lorem ipsum","level":1},`, maxBatchSize) + `{"message":"Lorem ipsum","level":1}]`
+			})
+			AssertUnprocessable()
+		})
 	})
 
 	Describe("/:application/get", func() {
@@ -319,5 +391,155 @@ var _ = Describe("Actions", func() {
 			})
 			AssertUnprocessable()
 		})
+
+		Context("with trace_id", func() {
+			BeforeEach(func() {
+				logRecord := LogRecord{Message: "Traced message", Level: 1, TraceID: "trace1"}
+				Expect(saveLogRecord("testapp1", &logRecord)).To(Succeed())
+
+				query = "trace_id=trace1"
+			})
+
+			AssertSuccess()
+
+			It("should respond with log records of the trace", func() {
+				parsedRes := LogRecords{}
+				Expect(
+					json.Unmarshal(response.Body.Bytes(), &parsedRes),
+				).To(Succeed())
+
+				Expect(parsedRes).To(HaveLen(1))
+				Expect(parsedRes[0].Message).To(Equal("Traced message"))
+				Expect(parsedRes[0].TraceID).To(Equal("trace1"))
+			})
+		})
+
+		Context("with invalid trace_id", func() {
+			BeforeEach(func() {
+				query = "trace_id=trace%201"
+			})
+			AssertUnprocessable()
+		})
+	})
+
+	Describe("/search", func() {
+		BeforeEach(func() {
+			for i, application := range []string{"testapp1", "testapp2", "otherapp"} {
+				logRecord := LogRecord{Message: fmt.Sprintf("Message %v", i), Level: 1}
+				Expect(saveLogRecord(application, &logRecord)).To(Succeed())
+				time.Sleep(time.Millisecond)
+			}
+
+			query = fmt.Sprintf(
+				"applications=testapp*,otherapp&level=1&start_time=%v&end_time=%v",
+				time.Now().Format("2006-01-02"),
+				time.Now().Format("2006-01-02"),
+			)
+		})
+
+		JustBeforeEach(func() {
+			Expect(
+				sendRequest("GET", "/search?"+query),
+			).To(Succeed())
+		})
+
+		AssertSuccess()
+
+		It("should respond with found log records and their applications", func() {
+			parsedRes := SearchLogRecords{}
+			Expect(
+				json.Unmarshal(response.Body.Bytes(), &parsedRes),
+			).To(Succeed())
+
+			Expect(parsedRes).To(HaveLen(3))
+
+			Expect(parsedRes[0].Application).To(Equal("testapp1"))
+			Expect(parsedRes[0].Message).To(Equal("Message 0"))
+			Expect(parsedRes[1].Application).To(Equal("testapp2"))
+			Expect(parsedRes[2].Application).To(Equal("otherapp"))
+		})
+
+		Context("without applications", func() {
+			BeforeEach(func() {
+				query = "level=1&start_time=2006-01-02&end_time=2006-01-02"
+			})
+			AssertUnprocessable()
+		})
+
+		Context("with invalid application pattern", func() {
+			BeforeEach(func() {
+				query = "applications=test[app&level=1&start_time=2006-01-02&end_time=2006-01-02"
+			})
+			AssertUnprocessable()
+		})
+
+		Context("with invalid start_time", func() {
+			BeforeEach(func() {
+				query = "applications=testapp1&level=1&start_time=2006-01-022&end_time=2006-01-02"
+			})
+			AssertUnprocessable()
+		})
+	})
+
+	Describe("DELETE /:application", func() {
+		BeforeEach(func() {
+			for i, createdAt := range []time.Time{
+				time.Date(2015, 10, 14, 10, 0, 0, 0, time.Local),
+				time.Date(2015, 10, 16, 10, 0, 0, 0, time.Local),
+			} {
+				logRecord := LogRecord{Message: fmt.Sprintf("Message %v", i), Level: 1, CreatedAt: createdAt}
+				Expect(saveLogRecord("testapp1", &logRecord)).To(Succeed())
+			}
+
+			query = "before=2015-10-15"
+		})
+
+		JustBeforeEach(func() {
+			Expect(
+				sendRequest("DELETE", "/testapp1?"+query),
+			).To(Succeed())
+		})
+
+		AssertSuccess()
+
+		It("should respond with number of deleted log records", func() {
+			Expect(response.Body.String()).To(MatchJSON(`{"deleted": 1}`))
+		})
+
+		Context("with invalid before", func() {
+			BeforeEach(func() {
+				query = "before=2015-10-155"
+			})
+			AssertUnprocessable()
+		})
+	})
+
+	Describe("health checks", func() {
+		sendUnauthorizedRequest := func(path string) {
+			req, err := http.NewRequest("GET", "http://logbook.test"+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			response = httptest.NewRecorder()
+			router.ServeHTTP(response, req)
+		}
+
+		Describe("/healthz", func() {
+			It("should respond with 200 without auth", func() {
+				sendUnauthorizedRequest("/healthz")
+				Expect(response.Code).To(Equal(200))
+			})
+		})
+
+		Describe("/readyz", func() {
+			It("should respond with 200 without auth", func() {
+				sendUnauthorizedRequest("/readyz")
+				Expect(response.Code).To(Equal(200))
+			})
+		})
+
+		It("should still require auth for other routes", func() {
+			sendUnauthorizedRequest("/apptest/get")
+			Expect(response.Code).To(Equal(401))
+		})
 	})
 })
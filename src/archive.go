@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Archived records are kept in zstd-compressed NDJSON files, a file per
+// application, day and archiving run:
+//
+//	<dir>/<application>/<day>.ndjson.zst
+//	<dir>/<application>/<day>.<n>.ndjson.zst
+//
+// Files are never changed after they are written. Records of a file are in
+// chronological order.
+const (
+	archiveExt       = ".ndjson.zst"
+	archiveDayFormat = "2006-01-02"
+)
+
+var (
+	// archiveLock prevents archiving runs from overlapping
+	archiveLock sync.Mutex
+
+	archiveStop    chan struct{}
+	archiveRunning sync.WaitGroup
+)
+
+// archiveDay returns the name of the day of the time, records are grouped
+// into files by it
+func archiveDay(t time.Time) string {
+	return t.UTC().Format(archiveDayFormat)
+}
+
+func archiveAppDir(dir, application string) string {
+	return filepath.Join(absPathToFile(dir), escapeShardDirName(application))
+}
+
+// archiveLogRecords moves records created before the time from DBs of every
+// application to the archive dir and returns their number
+func archiveLogRecords(dir string, before time.Time) (archived int, err error) {
+	archiveLock.Lock()
+	defer archiveLock.Unlock()
+
+	writesLock.RLock()
+	defer writesLock.RUnlock()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return 0, errDBNotOpen
+	}
+
+	applications, err := matchApplications([]string{"*"})
+	if err != nil {
+		return
+	}
+
+	for _, application := range applications {
+		for _, source := range appDBs(application, time.Time{}, before) {
+			n, err := archiveSourceLogRecords(source, dir, application, before)
+			archived += n
+
+			if err != nil {
+				return archived, err
+			}
+		}
+	}
+
+	return
+}
+
+func archiveSourceLogRecords(source dbSource, dir, application string, before time.Time) (int, error) {
+	boltDB, err := source.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer source.release()
+
+	return archiveDBLogRecords(boltDB, dir, application, before)
+}
+
+// archiveDBLogRecords archives records of the application of the DB day by
+// day. Records of a day are removed from DB only after their file is written.
+// Records that can't be decoded are kept in DB.
+func archiveDBLogRecords(boltDB *bolt.DB, dir, application string, before time.Time) (archived int, err error) {
+	var days []string
+	dayKeys := make(map[string][][]byte)
+
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		appBucket := tx.Bucket([]byte(application))
+		if appBucket == nil {
+			return nil
+		}
+
+		return forEachRecordBucket(appBucket, nil, nil, func(key []byte, _ *bolt.Bucket) error {
+			createdAt, err := recordKeyTime(key)
+			if err == nil && createdAt.Before(before) {
+				day := archiveDay(createdAt)
+				if _, ok := dayKeys[day]; !ok {
+					days = append(days, day)
+				}
+				dayKeys[day] = append(dayKeys[day], append([]byte(nil), key...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Strings(days)
+
+	for _, day := range days {
+		var (
+			keys       [][]byte
+			logRecords LogRecords
+		)
+
+		err = boltDB.View(func(tx *bolt.Tx) error {
+			appBucket := tx.Bucket([]byte(application))
+
+			for _, key := range dayKeys[day] {
+				var logRecord LogRecord
+
+				data, err := recordValue(appBucket.Bucket(key))
+				if err != nil || data == nil || bson.Unmarshal(data, &logRecord) != nil {
+					continue
+				}
+
+				keys = append(keys, key)
+				logRecords = append(logRecords, logRecord)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		if len(keys) == 0 {
+			continue
+		}
+
+		if err = writeArchiveFile(archiveAppDir(dir, application), day, logRecords); err != nil {
+			return
+		}
+
+		err = boltDB.Update(func(tx *bolt.Tx) error {
+			return deleteRecordKeys(tx.Bucket([]byte(application)), keys)
+		})
+		if err != nil {
+			return
+		}
+
+		archived += len(keys)
+	}
+
+	return
+}
+
+// writeArchiveFile writes records of the day to a new read-only file in the
+// dir
+func writeArchiveFile(dir, day string, logRecords LogRecords) (err error) {
+	sort.SliceStable(logRecords, func(i, j int) bool {
+		return logRecords[i].CreatedAt.Before(logRecords[j].CreatedAt)
+	})
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	path := filepath.Join(dir, day+archiveExt)
+	for n := 1; fileExists(path); n++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s.%d%s", day, n, archiveExt))
+	}
+
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0400)
+	if err != nil {
+		return
+	}
+
+	err = writeArchive(f, logRecords)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return
+}
+
+func writeArchive(w io.Writer, logRecords LogRecords) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(zw)
+
+	for i := range logRecords {
+		if err = encoder.Encode(&logRecords[i]); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// archiveFiles returns paths of archive files of the application with
+// records of days within the time range
+func archiveFiles(dir, application string, startTime, endTime time.Time) (paths []string, err error) {
+	found, err := filepath.Glob(filepath.Join(archiveAppDir(dir, application), "*"+archiveExt))
+	if err != nil {
+		return
+	}
+
+	startDay, endDay := archiveDay(startTime), archiveDay(endTime)
+
+	for _, path := range found {
+		day := strings.SplitN(filepath.Base(path), ".", 2)[0]
+
+		if day >= startDay && day <= endDay {
+			paths = append(paths, path)
+		}
+	}
+
+	return
+}
+
+// loadArchivedLogRecords reads archive files and returns records of the
+// application that match the time range, level and tags in chronological
+// order. It returns nothing when archiving is disabled.
+func loadArchivedLogRecords(application string, lvl int, tags []string, startTime time.Time, endTime time.Time) (found LogRecords, err error) {
+	dir := currentConfig().Archive.Dir
+	if dir == "" {
+		return
+	}
+
+	paths, err := archiveFiles(dir, application, startTime, endTime)
+	if err != nil {
+		return
+	}
+
+	inRange := inTimeRange(startTime, endTime)
+
+	for _, path := range paths {
+		err = readArchiveFile(path, func(logRecord *LogRecord) {
+			if inRange(logRecord) && matchLogRecord(logRecord, lvl, tags) {
+				found = append(found, *logRecord)
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	sortLogRecords(found)
+
+	return
+}
+
+// searchArchivedLogRecords works like loadArchivedLogRecords but returns
+// records of every archived application that matches any of the patterns
+func searchArchivedLogRecords(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time) (found SearchLogRecords, err error) {
+	dir := currentConfig().Archive.Dir
+	if dir == "" {
+		return
+	}
+
+	applications, err := archivedApplications(dir, patterns)
+	if err != nil {
+		return
+	}
+
+	for _, application := range applications {
+		logRecords, err := loadArchivedLogRecords(application, lvl, tags, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, logRecord := range logRecords {
+			found = append(found, SearchLogRecord{application, logRecord})
+		}
+	}
+
+	sortSearchLogRecords(found)
+
+	return
+}
+
+// archivedApplications returns names of applications of the archive dir that
+// match any of the patterns
+func archivedApplications(dir string, patterns []string) (applications []string, err error) {
+	entries, err := ioutil.ReadDir(absPathToFile(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		application, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		matched, err := matchApplication(patterns, application)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			applications = append(applications, application)
+		}
+	}
+
+	return
+}
+
+// readArchiveFile calls fn for every record of the archive file
+func readArchiveFile(path string, fn func(*LogRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	decoder := json.NewDecoder(zr)
+
+	for {
+		var logRecord LogRecord
+
+		switch err := decoder.Decode(&logRecord); err {
+		case nil:
+			fn(&logRecord)
+		case io.EOF:
+			return nil
+		default:
+			return fmt.Errorf("Can't read archive file %s: %v", path, err)
+		}
+	}
+}
+
+// sortLogRecords sorts records in chronological order keeping the order of
+// records created at the same time
+func sortLogRecords(logRecords LogRecords) {
+	sort.SliceStable(logRecords, func(i, j int) bool {
+		return recordTime(logRecords[i].CreatedAt).Before(recordTime(logRecords[j].CreatedAt))
+	})
+}
+
+func sortSearchLogRecords(logRecords SearchLogRecords) {
+	sort.SliceStable(logRecords, func(i, j int) bool {
+		return recordTime(logRecords[i].CreatedAt).Before(recordTime(logRecords[j].CreatedAt))
+	})
+}
+
+// mergeSearchLogRecords works like mergeLogRecords for search results
+func mergeSearchLogRecords(a, b SearchLogRecords) SearchLogRecords {
+	merged := make(SearchLogRecords, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		if recordTime(b[0].CreatedAt).Before(recordTime(a[0].CreatedAt)) {
+			merged, b = append(merged, b[0]), b[1:]
+		} else {
+			merged, a = append(merged, a[0]), a[1:]
+		}
+	}
+
+	return append(append(merged, a...), b...)
+}
+
+// mergeLogRecords merges sorted lists of records in chronological order.
+// Records of a precede records of b created at the same time.
+func mergeLogRecords(a, b LogRecords) LogRecords {
+	merged := make(LogRecords, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		if recordTime(b[0].CreatedAt).Before(recordTime(a[0].CreatedAt)) {
+			merged, b = append(merged, b[0]), b[1:]
+		} else {
+			merged, a = append(merged, a[0]), a[1:]
+		}
+	}
+
+	return append(append(merged, a...), b...)
+}
+
+func runScheduledArchiving(dir string, after int) {
+	archived, err := archiveLogRecords(dir, time.Now().AddDate(0, 0, -after))
+	if err != nil {
+		log.Printf("Archiving failed: %v", err)
+		return
+	}
+
+	if archived > 0 {
+		log.Printf("Archived %d records to %s", archived, dir)
+	}
+}
+
+func startArchiving() {
+	conf := currentConfig().Archive
+	if conf.Dir == "" {
+		return
+	}
+
+	dir := absPathToFile(conf.Dir)
+	checkErr(os.MkdirAll(dir, 0700), "Can't create archive dir")
+
+	log.Printf("Archiving records older than %d days to %s every %d minutes\n", conf.After, dir, conf.Interval)
+
+	archiveStop = make(chan struct{})
+	archiveRunning.Add(1)
+
+	go func() {
+		defer archiveRunning.Done()
+
+		ticker := time.NewTicker(time.Duration(conf.Interval) * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-archiveStop:
+				return
+			case <-ticker.C:
+				runScheduledArchiving(dir, conf.After)
+			}
+		}
+	}()
+}
+
+// stopArchiving waits for the archiving in progress to be finished
+func stopArchiving() {
+	if archiveStop != nil {
+		close(archiveStop)
+		archiveRunning.Wait()
+	}
+}
+
+// Action: Archive =============================================================
+
+func archiveHandler(c *gin.Context) {
+	conf := currentConfig().Archive
+
+	if conf.Dir == "" {
+		c.JSON(422, ErrorResponse{"Archiving is disabled"})
+		return
+	}
+
+	before := time.Now().AddDate(0, 0, -conf.After)
+
+	if beforeStr := c.Query("before"); len(beforeStr) > 0 {
+		if !checkDateTimeFormat(beforeStr) {
+			c.JSON(422, ErrorResponse{"Before has invalid format"})
+			return
+		}
+
+		before, _ = parseDateTime(beforeStr, false)
+	}
+
+	archived, err := archiveLogRecords(conf.Dir, before)
+	panicOnErr(err)
+
+	c.JSON(200, gin.H{"archived": archived})
+}
+
+// end of Action: Archive
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Archive", func() {
+	var dir string
+
+	start := time.Date(2015, 10, 16, 22, 0, 0, 0, time.UTC)
+
+	saveRecord := func(message string, level int, createdAt time.Time) {
+		saveTestLogRecord("testapp", message, level, createdAt)
+	}
+
+	loadMessages := func(lvl int, startTime, endTime time.Time, page int) []string {
+		logRecords, err := loadLogRecords("testapp", lvl, []string{}, startTime, endTime, page)
+		Expect(err).NotTo(HaveOccurred())
+
+		return logRecordMessages(logRecords)
+	}
+
+	archiveFileNames := func() (names []string) {
+		paths, err := filepath.Glob(filepath.Join(dir, "testapp", "*"))
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, path := range paths {
+			names = append(names, filepath.Base(path))
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-archive")
+		Expect(err).NotTo(HaveOccurred())
+
+		config.Archive.Dir = dir
+		config.Archive.After = 30
+
+		for i := 0; i < 4; i++ {
+			saveRecord(fmt.Sprintf("Message %d", i+1), i%2+1, start.Add(time.Duration(i)*time.Hour))
+		}
+	})
+
+	AfterEach(func() {
+		config.Archive.Dir = ""
+		config.Archive.After = 0
+		os.RemoveAll(dir)
+	})
+
+	Describe("archiveLogRecords", func() {
+		It("should move records created before the time to files by days", func() {
+			archived, err := archiveLogRecords(dir, start.Add(150*time.Minute))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(archived).To(Equal(3))
+			Expect(archiveFileNames()).To(Equal([]string{"2015-10-16.ndjson.zst", "2015-10-17.ndjson.zst"}))
+
+			info, err := os.Stat(filepath.Join(dir, "testapp", "2015-10-16.ndjson.zst"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0400)))
+
+			count, err := countLogRecords("testapp")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+
+			traceRecords, err := loadTraceLogRecords("testapp", "trace1", 0, []string{}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(traceRecords).To(HaveLen(1))
+		})
+
+		It("should write new files for records of already archived days", func() {
+			_, err := archiveLogRecords(dir, start.Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			saveRecord("Late message", 1, start.Add(time.Minute))
+
+			archived, err := archiveLogRecords(dir, start.Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(archived).To(Equal(1))
+
+			Expect(archiveFileNames()).To(Equal([]string{"2015-10-16.1.ndjson.zst", "2015-10-16.ndjson.zst"}))
+			Expect(loadMessages(0, start, start.Add(time.Hour), 1)).To(Equal([]string{"Message 1", "Late message", "Message 2"}))
+		})
+	})
+
+	Describe("loading", func() {
+		BeforeEach(func() {
+			_, err := archiveLogRecords(dir, start.Add(150*time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+
+			// saved after archiving
+			saveRecord("Message 0", 2, start.Add(-time.Hour))
+		})
+
+		It("should merge archived records with records of DB", func() {
+			Expect(loadMessages(0, start.Add(-2*time.Hour), start.Add(5*time.Hour), 1)).To(Equal([]string{
+				"Message 0", "Message 1", "Message 2", "Message 3", "Message 4",
+			}))
+		})
+
+		It("should filter archived records by time range and level", func() {
+			Expect(loadMessages(2, start.Add(30*time.Minute), start.Add(5*time.Hour), 1)).To(Equal([]string{
+				"Message 2", "Message 4",
+			}))
+		})
+
+		It("should paginate merged records", func() {
+			config.Pagination.PerPage = 2
+			defer func() { config.Pagination.PerPage = 100 }()
+
+			Expect(loadMessages(0, start.Add(-2*time.Hour), start.Add(5*time.Hour), 2)).To(Equal([]string{
+				"Message 2", "Message 3",
+			}))
+			Expect(loadMessages(0, start.Add(-2*time.Hour), start.Add(5*time.Hour), 3)).To(Equal([]string{
+				"Message 4",
+			}))
+		})
+
+		It("should merge records of DB saved in different months in time order", func() {
+			saveRecord("Message November", 1, time.Date(2015, 11, 18, 0, 0, 0, 0, time.UTC))
+			saveRecord("Message October", 1, time.Date(2015, 10, 20, 0, 0, 0, 0, time.UTC))
+
+			Expect(loadMessages(0, start.Add(-2*time.Hour), start.AddDate(0, 1, 4), 1)).To(Equal([]string{
+				"Message 0", "Message 1", "Message 2", "Message 3", "Message 4", "Message October", "Message November",
+			}))
+		})
+
+		It("should merge archived records with records of DB when searching", func() {
+			saveTestLogRecord("otherapp", "Other message", 1, start.Add(30*time.Minute))
+
+			_, err := archiveLogRecords(dir, start.Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			logRecords, err := searchLogRecords([]string{"*"}, 0, []string{}, start.Add(-2*time.Hour), start.Add(5*time.Hour), 1)
+			Expect(err).NotTo(HaveOccurred())
+
+			var found []string
+			for _, logRecord := range logRecords {
+				found = append(found, logRecord.Application+": "+logRecord.Message)
+			}
+
+			Expect(found).To(Equal([]string{
+				"testapp: Message 0",
+				"testapp: Message 1",
+				"otherapp: Other message",
+				"testapp: Message 2",
+				"testapp: Message 3",
+				"testapp: Message 4",
+			}))
+		})
+
+		It("should filter and paginate archived records when searching", func() {
+			config.Pagination.PerPage = 2
+			defer func() { config.Pagination.PerPage = 100 }()
+
+			logRecords, err := searchLogRecords([]string{"test*"}, 2, []string{}, start.Add(-2*time.Hour), start.Add(5*time.Hour), 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(HaveLen(1))
+			Expect(logRecords[0].Message).To(Equal("Message 4"))
+
+			logRecords, err = searchLogRecords([]string{"other*"}, 0, []string{}, start.Add(-2*time.Hour), start.Add(5*time.Hour), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(BeEmpty())
+		})
+
+		It("should load records of traces only from DB", func() {
+			logRecords, err := loadTraceLogRecords("testapp", "trace1", 0, []string{}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 0", "Message 4"}))
+		})
+
+		It("should ignore archive when archiving is disabled", func() {
+			config.Archive.Dir = ""
+
+			Expect(loadMessages(0, start.Add(-2*time.Hour), start.Add(5*time.Hour), 1)).To(Equal([]string{
+				"Message 0", "Message 4",
+			}))
+		})
+	})
+
+	Describe("/archive", func() {
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			router = setupRouter()
+		})
+
+		It("should archive records older than archive.after days by default", func() {
+			Expect(sendRequest("POST", "/archive", "")).To(Succeed())
+
+			Expect(response.Code).To(Equal(200))
+
+			var parsedRes map[string]int
+			Expect(json.Unmarshal(response.Body.Bytes(), &parsedRes)).To(Succeed())
+			Expect(parsedRes["archived"]).To(Equal(4))
+		})
+
+		It("should archive records created before the time", func() {
+			Expect(sendRequest("POST", "/archive?before=2015-10-16T23:00:00%2B00:00", "")).To(Succeed())
+
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body.String()).To(Equal(`{"archived":1}`))
+		})
+
+		It("should respond with error when before is invalid", func() {
+			Expect(sendRequest("POST", "/archive?before=yesterday", "")).To(Succeed())
+
+			Expect(response.Code).To(Equal(422))
+		})
+	})
+})
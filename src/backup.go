@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	backupPrefix     = "logbook-"
+	backupExt        = ".db"
+	shardedBackupExt = ".tar"
+	backupTimeFormat = "20060102-150405"
+)
+
+var (
+	backupStop    chan struct{}
+	backupRunning sync.WaitGroup
+)
+
+// shardedBackup reports whether backup should include shards. Such backup is
+// a tar archive of the main DB and shards.
+func shardedBackup() bool {
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	return len(shards) > 0
+}
+
+func backupExtension(sharded bool) string {
+	if sharded {
+		return shardedBackupExt
+	}
+	return backupExt
+}
+
+// writeBackup writes a consistent snapshot of DB
+func writeBackup(w io.Writer, sharded bool) (err error) {
+	if sharded {
+		return writeShardedBackup(w)
+	}
+
+	return viewDB(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// writeShardedBackup writes a tar archive with snapshots of the main DB as
+// logbook.db and of every shard as shards/<application>/<period>.db.
+// Snapshots of different files aren't taken at the same moment.
+func writeShardedBackup(w io.Writer) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	names := []string{"logbook.db"}
+	sources := []dbSource{{}}
+
+	shardsLock.Lock()
+	for _, s := range shards {
+		names = append(names, "shards/"+escapeShardDirName(s.application)+"/"+filepath.Base(s.path))
+		sources = append(sources, dbSource{s, s.start, s.end()})
+	}
+	shardsLock.Unlock()
+
+	tw := tar.NewWriter(w)
+
+	for i, source := range sources {
+		_, err := viewDBSource(source, func(tx *bolt.Tx, _ dbSource) (bool, error) {
+			err := tw.WriteHeader(&tar.Header{
+				Name:    names[i],
+				Mode:    0600,
+				Size:    tx.Size(),
+				ModTime: time.Now(),
+			})
+			if err != nil {
+				return false, err
+			}
+
+			_, err = tx.WriteTo(tw)
+			return false, err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// backupToFile writes a snapshot of DB to a timestamped file in the dir
+func backupToFile(dir string, now time.Time) (path string, err error) {
+	sharded := shardedBackup()
+
+	path = filepath.Join(dir, backupPrefix+now.Format(backupTimeFormat)+backupExtension(sharded))
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+
+	err = writeBackup(f, sharded)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return
+}
+
+// pruneBackups removes all but the last keep backups in the dir
+func pruneBackups(dir string, keep int) error {
+	var paths []string
+
+	for _, ext := range []string{backupExt, shardedBackupExt} {
+		found, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"+ext))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, found...)
+	}
+
+	// timestamps in names keep backups in chronological order
+	sort.Strings(paths)
+
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
+
+func runScheduledBackup(dir string, keep int) {
+	path, err := backupToFile(dir, time.Now())
+	if err == nil {
+		log.Printf("Backup saved to %s", path)
+		err = pruneBackups(dir, keep)
+	}
+
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+	}
+}
+
+func startBackups() {
+	conf := currentConfig().Backup
+	if conf.Dir == "" {
+		return
+	}
+
+	dir := absPathToFile(conf.Dir)
+	checkErr(os.MkdirAll(dir, 0700), "Can't create backup dir")
+
+	log.Printf("Saving backups to %s every %d minutes\n", dir, conf.Interval)
+
+	backupStop = make(chan struct{})
+	backupRunning.Add(1)
+
+	go func() {
+		defer backupRunning.Done()
+
+		ticker := time.NewTicker(time.Duration(conf.Interval) * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-backupStop:
+				return
+			case <-ticker.C:
+				runScheduledBackup(dir, conf.Keep)
+			}
+		}
+	}()
+}
+
+// stopBackups waits for the backup in progress to be finished
+func stopBackups() {
+	if backupStop != nil {
+		close(backupStop)
+		backupRunning.Wait()
+	}
+}
+
+// Action: Backup ==============================================================
+
+func backupHandler(c *gin.Context) {
+	sharded := shardedBackup()
+	filename := backupPrefix + time.Now().Format(backupTimeFormat) + backupExtension(sharded)
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var err error
+
+	if sharded {
+		c.Header("Content-Type", "application/x-tar")
+		c.Status(200)
+
+		err = writeShardedBackup(c.Writer)
+	} else {
+		err = viewDB(func(tx *bolt.Tx) error {
+			c.Header("Content-Type", "application/octet-stream")
+			c.Header("Content-Length", strconv.FormatInt(tx.Size(), 10))
+			c.Status(200)
+
+			_, err := tx.WriteTo(c.Writer)
+			return err
+		})
+	}
+
+	if err == nil {
+		return
+	}
+
+	if !c.Writer.Written() {
+		panicOnErr(err)
+	}
+
+	// the response is already started, so break the connection to let the
+	// client see the transfer failed
+	log.Printf("Backup streaming failed: %v", err)
+	abortResponse(c)
+}
+
+// end of Action: Backup
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backup", func() {
+	var dir string
+
+	expectBackupContainsRecord := func(path string) {
+		backupDB, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+		Expect(err).NotTo(HaveOccurred())
+		defer backupDB.Close()
+
+		Expect(backupDB.View(func(tx *bolt.Tx) error {
+			Expect(tx.Bucket([]byte("testapp1"))).NotTo(BeNil())
+			return nil
+		})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		logRecord := LogRecord{Message: "Message", Level: 1}
+		Expect(saveLogRecord("testapp1", &logRecord)).To(Succeed())
+
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-backup")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("/backup", func() {
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			router = setupRouter()
+
+			Expect(sendRequest("GET", "/backup")).To(Succeed())
+		})
+
+		It("should respond with a database snapshot", func() {
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Header().Get("Content-Type")).To(Equal("application/octet-stream"))
+			Expect(response.Header().Get("Content-Disposition")).To(MatchRegexp(`attachment; filename="logbook-\d{8}-\d{6}\.db"`))
+
+			path := filepath.Join(dir, "snapshot.db")
+			Expect(ioutil.WriteFile(path, response.Body.Bytes(), 0600)).To(Succeed())
+
+			expectBackupContainsRecord(path)
+		})
+	})
+
+	Describe("abortResponse", func() {
+		It("should break the connection of a started response", func() {
+			router := gin.New()
+			router.Use(abortResponses(), gin.Recovery())
+			router.GET("/stream", func(c *gin.Context) {
+				c.Status(200)
+				c.Writer.Write([]byte("partial"))
+				c.Writer.Flush()
+
+				abortResponse(c)
+			})
+
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			res, err := http.Get(server.URL + "/stream")
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+
+			Expect(res.StatusCode).To(Equal(200))
+
+			_, err = ioutil.ReadAll(res.Body)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("backupToFile", func() {
+		It("should write a timestamped snapshot", func() {
+			path, err := backupToFile(dir, time.Date(2015, 10, 16, 8, 10, 11, 0, time.Local))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.Join(dir, "logbook-20151016-081011.db")))
+
+			expectBackupContainsRecord(path)
+
+			_, err = os.Stat(path + ".tmp")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("pruneBackups", func() {
+		It("should keep only the last backups", func() {
+			names := []string{
+				"logbook-20151016-081011.db",
+				"logbook-20151014-081011.db",
+				"logbook-20151015-081011.db",
+				"other.db",
+			}
+			for _, name := range names {
+				Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0600)).To(Succeed())
+			}
+
+			Expect(pruneBackups(dir, 2)).To(Succeed())
+
+			left, err := filepath.Glob(filepath.Join(dir, "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(left).To(ConsistOf(
+				filepath.Join(dir, "logbook-20151015-081011.db"),
+				filepath.Join(dir, "logbook-20151016-081011.db"),
+				filepath.Join(dir, "other.db"),
+			))
+		})
+	})
+})
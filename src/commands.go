@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DarthSim/logbook/client"
+	"github.com/boltdb/bolt"
+)
+
+// Command: check-config =======================================================
+
+func checkConfigCommand(args []string) {
+	prepareConfig(args)
+
+	fmt.Printf("Config %s is valid\n", configPath)
+	os.Exit(0)
+}
+
+// end of Command: check-config
+
+// Command: query ==============================================================
+
+const (
+	defaultQueryURL      = "http://127.0.0.1:11610"
+	defaultQuerySince    = time.Hour
+	defaultQueryInterval = 2 * time.Second
+)
+
+var queryLevelNames = [...]string{"DEBUG", "INFO", "NOTICE", "WARN", "ERROR", "FATAL"}
+
+// ANSI colors of levels in pretty output
+var queryLevelColors = [...]string{"\x1b[90m", "\x1b[36m", "\x1b[34m", "\x1b[33m", "\x1b[31m", "\x1b[1;31m"}
+
+type queryOptions struct {
+	url         string
+	user        string
+	password    string
+	application string
+	query       client.Query
+	format      string
+	color       bool
+	follow      bool
+	interval    time.Duration
+}
+
+func queryCommand(args []string) {
+	opts, err := parseQueryOptions(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = runQuery(ctx, opts, os.Stdout); err != nil && ctx.Err() == nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func parseQueryOptions(args []string) (opts queryOptions, err error) {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+
+	url := flags.String("url", envOr(configEnvPrefix+"URL", defaultQueryURL), "Logbook server URL")
+	user := flags.String("user", os.Getenv(configEnvPrefix+"AUTH_USER"), "Username")
+	password := flags.String("password", os.Getenv(configEnvPrefix+"AUTH_PASSWORD"), "Password")
+	application := flags.String("app", "", "Application name")
+	level := flags.Int("level", 0, "Minimum level of log records")
+	tags := flags.String("tags", "", "Required tags separated by comma")
+	start := flags.String("start", "", "Start time (YYYY-MM-DD or YYYY-MM-DDThh:mm:ss[.sss][±hh:mm])")
+	end := flags.String("end", "", "End time (YYYY-MM-DD or YYYY-MM-DDThh:mm:ss[.sss][±hh:mm])")
+	since := flags.Duration("since", defaultQuerySince, "Show records newer than the duration if start time is not set")
+	traceID := flags.String("trace-id", "", "Show records of the trace")
+	format := flags.String("format", "pretty", "Output format: pretty, json or csv")
+	noColor := flags.Bool("no-color", false, "Disable colors in pretty output")
+	follow := flags.Bool("follow", false, "Wait for new records")
+	interval := flags.Duration("interval", defaultQueryInterval, "Polling interval in follow mode")
+
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+
+	opts = queryOptions{
+		url:         *url,
+		user:        *user,
+		password:    *password,
+		application: *application,
+		format:      *format,
+		color:       !*noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout),
+		follow:      *follow,
+		interval:    *interval,
+	}
+
+	opts.query = client.Query{Level: *level, TraceID: *traceID}
+
+	if len(*tags) > 0 {
+		opts.query.Tags = extractTags(*tags)
+	}
+
+	switch {
+	case len(opts.application) == 0:
+		err = errors.New("Application should be defined")
+	case opts.query.Level < 0 || opts.query.Level > 5:
+		err = errors.New("Level should be between 0 and 5")
+	case opts.format != "pretty" && opts.format != "json" && opts.format != "csv":
+		err = fmt.Errorf("Unknown format: %s", opts.format)
+	case opts.interval <= 0:
+		err = errors.New("Interval should be positive")
+	case opts.follow && len(opts.query.TraceID) > 0:
+		err = errors.New("Follow mode doesn't support trace queries")
+	}
+
+	if err != nil || len(opts.query.TraceID) > 0 {
+		return
+	}
+
+	if len(*start) > 0 {
+		if opts.query.StartTime, err = parseDateTime(*start, false); err != nil {
+			err = errors.New("Invalid start time format")
+			return
+		}
+	} else {
+		opts.query.StartTime = time.Now().Add(-*since)
+	}
+
+	if len(*end) > 0 {
+		if opts.query.EndTime, err = parseDateTime(*end, true); err != nil {
+			err = errors.New("Invalid end time format")
+			return
+		}
+	}
+
+	return
+}
+
+// runQuery prints records of all pages. In follow mode it then polls the
+// server for records newer than the last printed one until ctx is done.
+func runQuery(ctx context.Context, opts queryOptions, out io.Writer) error {
+	c := client.New(opts.url, opts.user, opts.password)
+	printer := newRecordPrinter(opts.format, opts.color, out)
+
+	query := opts.query
+	fixedEnd := !query.EndTime.IsZero()
+
+	// The last printed time and the number of records printed with it. The
+	// server includes records created exactly at the start time, so they
+	// are skipped on the next poll.
+	var (
+		lastTime   time.Time
+		seenAtLast int
+	)
+
+	for {
+		if !fixedEnd && len(query.TraceID) == 0 {
+			// records may come with a bit skewed clock
+			query.EndTime = time.Now().Add(time.Minute)
+		}
+
+		skipTime, toSkip, skipped := lastTime, seenAtLast, 0
+
+		for query.Page = 1; ; query.Page++ {
+			records, err := c.Get(ctx, opts.application, query)
+			if err != nil {
+				return err
+			}
+
+			if len(records) == 0 {
+				break
+			}
+
+			for _, record := range records {
+				if skipped < toSkip && record.CreatedAt.Equal(skipTime) {
+					skipped++
+					continue
+				}
+
+				if err = printer.print(record); err != nil {
+					return err
+				}
+
+				if record.CreatedAt.Equal(lastTime) {
+					seenAtLast++
+				} else {
+					lastTime, seenAtLast = record.CreatedAt, 1
+				}
+			}
+		}
+
+		if err := printer.flush(); err != nil {
+			return err
+		}
+
+		if !opts.follow {
+			return nil
+		}
+
+		if !lastTime.IsZero() {
+			query.StartTime = lastTime
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+type recordPrinter struct {
+	format    string
+	color     bool
+	out       io.Writer
+	csv       *csv.Writer
+	csvHeader bool
+}
+
+func newRecordPrinter(format string, color bool, out io.Writer) *recordPrinter {
+	p := &recordPrinter{format: format, color: color, out: out}
+
+	if format == "csv" {
+		p.csv = csv.NewWriter(out)
+	}
+
+	return p
+}
+
+func (p *recordPrinter) print(record client.Record) error {
+	switch p.format {
+	case "json":
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(p.out, "%s\n", data)
+		return err
+	case "csv":
+		if !p.csvHeader {
+			p.csvHeader = true
+			if err := p.csv.Write([]string{"created_at", "level", "message", "tags", "trace_id", "span_id"}); err != nil {
+				return err
+			}
+		}
+
+		return p.csv.Write([]string{
+			record.CreatedAt.Format(time.RFC3339Nano),
+			strconv.Itoa(record.Level),
+			record.Message,
+			strings.Join(record.Tags, ","),
+			record.TraceID,
+			record.SpanID,
+		})
+	}
+
+	level := fmt.Sprintf("%-6s", queryLevelName(record.Level))
+	if p.color && record.Level >= 0 && record.Level < len(queryLevelColors) {
+		level = queryLevelColors[record.Level] + level + "\x1b[0m"
+	}
+
+	line := record.CreatedAt.Local().Format("2006-01-02 15:04:05.000") + " " + level + " " + record.Message
+
+	if len(record.Tags) > 0 {
+		line += " [" + strings.Join(record.Tags, ", ") + "]"
+	}
+
+	if len(record.TraceID) > 0 {
+		line += " trace=" + record.TraceID
+	}
+
+	_, err := fmt.Fprintln(p.out, line)
+	return err
+}
+
+func (p *recordPrinter) flush() error {
+	if p.csv == nil {
+		return nil
+	}
+
+	p.csv.Flush()
+	return p.csv.Error()
+}
+
+func queryLevelName(level int) string {
+	if level >= 0 && level < len(queryLevelNames) {
+		return queryLevelNames[level]
+	}
+
+	return strconv.Itoa(level)
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+
+	return fallback
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// end of Command: query
+
+// Command: db =================================================================
+
+type dbOptions struct {
+	paths       []string
+	application string
+	startTime   time.Time
+	endTime     time.Time
+}
+
+func dbCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: logbook db apps|count|dump|verify [flags]")
+		os.Exit(1)
+	}
+
+	subcommand, args := args[0], args[1:]
+
+	opts, err := parseDBOptions(subcommand, args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ok, err := runDBCommand(subcommand, opts, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func parseDBOptions(subcommand string, args []string) (opts dbOptions, err error) {
+	flags := flag.NewFlagSet("db "+subcommand, flag.ContinueOnError)
+
+	configfile := flags.String("config", "", "Path to the config file (database and shards paths are taken from it)")
+	path := flags.String("path", "", "Path to the database file")
+	application := flags.String("app", "", "Application name")
+	start := flags.String("start", "", "Start time (YYYY-MM-DD or YYYY-MM-DDThh:mm:ss[.sss][±hh:mm])")
+	end := flags.String("end", "", "End time (YYYY-MM-DD or YYYY-MM-DDThh:mm:ss[.sss][±hh:mm])")
+
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+
+	opts = dbOptions{application: *application}
+
+	switch subcommand {
+	case "apps", "count", "verify":
+	case "dump":
+		if len(opts.application) == 0 {
+			err = errors.New("Application should be defined")
+			return
+		}
+	default:
+		err = fmt.Errorf("Unknown db command: %s", subcommand)
+		return
+	}
+
+	if len(*start) > 0 {
+		if opts.startTime, err = parseDateTime(*start, false); err != nil {
+			err = errors.New("Invalid start time format")
+			return
+		}
+	}
+
+	if len(*end) > 0 {
+		if opts.endTime, err = parseDateTime(*end, true); err != nil {
+			err = errors.New("Invalid end time format")
+			return
+		}
+	}
+
+	opts.paths, err = commandDBPaths(*path, *configfile)
+
+	return
+}
+
+// runDBCommand runs the db subcommand on every DB file of the options. It
+// returns false when verification finds problems.
+func runDBCommand(subcommand string, opts dbOptions, out io.Writer) (ok bool, err error) {
+	result := dbResult{counts: make(map[string]int)}
+
+	for _, path := range opts.paths {
+		if err = openDBReadOnly(path); err != nil {
+			return false, fmt.Errorf("Can't open %s: %v", path, err)
+		}
+
+		err = result.collect(subcommand, opts, out)
+		db.Close()
+
+		if err != nil {
+			return false, fmt.Errorf("Can't inspect %s: %v", path, err)
+		}
+	}
+
+	return result.print(subcommand, out), nil
+}
+
+// dbResult accumulates results of the db subcommand over DB files. Dumped
+// records and found problems are written right away.
+type dbResult struct {
+	applications []string
+	counts       map[string]int
+	checked      int
+	problems     int
+}
+
+// collect runs the db subcommand on the open DB
+func (r *dbResult) collect(subcommand string, opts dbOptions, out io.Writer) (err error) {
+	var applications []string
+
+	if len(opts.application) > 0 {
+		applications = []string{opts.application}
+	} else {
+		err = viewDB(func(tx *bolt.Tx) (err error) {
+			applications, err = listApplications(tx, []string{"*"})
+			return
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	switch subcommand {
+	case "apps":
+		r.applications = append(r.applications, applications...)
+	case "count":
+		for _, application := range applications {
+			count, err := countLogRecords(application)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := r.counts[application]; !ok {
+				r.applications = append(r.applications, application)
+			}
+			r.counts[application] += count
+		}
+	case "dump":
+		// the time range is looked up by record keys
+		err = viewDB(func(tx *bolt.Tx) error {
+			if recordKeysOutdated(tx) {
+				return errOutdatedRecordKeys
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		return dumpLogRecords(opts.application, opts.startTime, opts.endTime, func(logRecord LogRecord) error {
+			data, err := json.Marshal(logRecord)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(out, "%s\n", data)
+			return err
+		})
+	case "verify":
+		checked, err := verifyLogRecords(applications, func(problem RecordProblem) {
+			r.problems++
+			fmt.Fprintln(out, problem)
+		})
+		if err != nil {
+			return err
+		}
+
+		r.checked += checked
+	}
+
+	return
+}
+
+// print writes the accumulated results. It returns false when verification
+// found problems.
+func (r *dbResult) print(subcommand string, out io.Writer) bool {
+	applications := uniqStrings(r.applications)
+	sort.Strings(applications)
+
+	switch subcommand {
+	case "apps":
+		for _, application := range applications {
+			fmt.Fprintln(out, application)
+		}
+	case "count":
+		for _, application := range applications {
+			fmt.Fprintf(out, "%s\t%d\n", application, r.counts[application])
+		}
+	case "verify":
+		fmt.Fprintf(out, "Checked %d records, found %d problems\n", r.checked, r.problems)
+
+		return r.problems == 0
+	}
+
+	return true
+}
+
+// commandDBPaths returns the path if it's set or takes paths of DB and shard
+// files from config. The path from command line is relative to the working
+// directory.
+func commandDBPaths(path, configfile string) ([]string, error) {
+	if len(path) > 0 {
+		path, err := filepath.Abs(path)
+		return []string{path}, err
+	}
+
+	loadCommandConfig(configfile)
+
+	return configDBPaths()
+}
+
+// configDBPaths returns paths of DB and shard files from config
+func configDBPaths() (paths []string, err error) {
+	paths = []string{absPathToFile(config.Database.Path)}
+
+	if len(config.Database.Shards.Dir) == 0 {
+		return
+	}
+
+	shardPaths, err := filepath.Glob(filepath.Join(absPathToFile(config.Database.Shards.Dir), "*", "*"+shardExt))
+
+	return append(paths, shardPaths...), err
+}
+
+// loadCommandConfig loads config for the commands that take paths from it.
+// Only the database section is validated, the rest doesn't matter for them.
+func loadCommandConfig(configfile string) {
+	setConfigPath(configfile)
+
+	var err error
+
+	if config, err = buildStorageConfig(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// end of Command: db
+
+// Command: compact ============================================================
+
+func compactCommand(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+
+	configfile := flags.String("config", "", "Path to the config file (database and shards paths are taken from it)")
+	path := flags.String("path", "", "Path to the database file")
+
+	flags.Parse(args)
+
+	// shards are compacted only when the paths are taken from config
+	paths, err := commandDBPaths(*path, *configfile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, path := range paths {
+		sizeBefore, sizeAfter, err := compactDBFile(path)
+		if err != nil {
+			fmt.Printf("Can't compact %s: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Compacted %s: %d -> %d bytes\n", path, sizeBefore, sizeAfter)
+	}
+
+	os.Exit(0)
+}
+
+// end of Command: compact
+
+// Command: migrate ============================================================
+
+const migrateBatchSize = 1000
+
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+
+	configfile := flags.String("config", "", "Path to the config file (database, shards and LevelDB paths are taken from it)")
+	from := flags.String("from", "", "Path to the Bolt database file")
+	to := flags.String("to", "", "Path to the LevelDB directory")
+	keys := flags.Bool("keys", false, "Rewrite legacy record keys of Bolt files in place instead of migrating to LevelDB")
+
+	flags.Parse(args)
+
+	if *keys {
+		migrateKeysCommand(*from, *configfile)
+	}
+
+	if len(*from) > 0 && len(*to) == 0 {
+		loadCommandConfig(*configfile)
+	}
+
+	// shards are migrated only when the paths are taken from config
+	paths, err := commandDBPaths(*from, *configfile)
+	if err == nil {
+		*to, err = commandLevelDBPath(*to)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dst := newLevelDBStorage(*to)
+	if err := dst.Open(); err != nil {
+		fmt.Printf("Can't open %s: %v\n", *to, err)
+		os.Exit(1)
+	}
+
+	err = runMigration(paths, dst, os.Stdout)
+	dst.Close()
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// migrateKeysCommand rewrites legacy record keys of the Bolt file and shards
+func migrateKeysCommand(from, configfile string) {
+	// shards are migrated only when the paths are taken from config
+	paths, err := commandDBPaths(from, configfile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, path := range paths {
+		migrated, err := migrateRecordKeysFile(path)
+		if err != nil {
+			fmt.Printf("Can't migrate keys of %s: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Migrated keys of %s: %d records\n", path, migrated)
+	}
+
+	os.Exit(0)
+}
+
+// commandLevelDBPath returns the path if it's set or takes LevelDB path from
+// config. The path from command line is relative to the working directory.
+func commandLevelDBPath(path string) (string, error) {
+	if len(path) > 0 {
+		return filepath.Abs(path)
+	}
+
+	if len(config.Database.LevelDB.Path) == 0 {
+		return "", ConfigError{"database.leveldb.path", "should be defined"}
+	}
+
+	return absPathToFile(config.Database.LevelDB.Path), nil
+}
+
+// runMigration copies records of the Bolt files to the empty LevelDB storage
+func runMigration(paths []string, dst *levelDBStorage, out io.Writer) error {
+	empty, err := dst.empty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errLevelDBNotEmpty
+	}
+
+	for _, path := range paths {
+		migrated, skipped, err := migrateBoltFile(path, dst, migrateBatchSize)
+		if err != nil {
+			return fmt.Errorf("Can't migrate %s: %v", path, err)
+		}
+
+		fmt.Fprintf(out, "Migrated %s: %d records, %d skipped\n", path, migrated, skipped)
+	}
+
+	return nil
+}
+
+// end of Command: migrate
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DarthSim/logbook/client"
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("Commands", func() {
+	Describe("query", func() {
+		var (
+			server *httptest.Server
+			opts   queryOptions
+			out    *syncBuffer
+		)
+
+		saveRecord := func(application, message string, level int, tags ...string) {
+			logRecord := LogRecord{Message: message, Level: level, Tags: tags}
+			Expect(saveLogRecord(application, &logRecord)).To(Succeed())
+			time.Sleep(time.Millisecond)
+		}
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			server = httptest.NewServer(setupRouter())
+
+			var err error
+			opts, err = parseQueryOptions([]string{
+				"--url", server.URL,
+				"--user", config.Auth.User,
+				"--password", config.Auth.Password,
+				"--app", "testapp1",
+				"--format", "json",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			out = &syncBuffer{}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		Describe("parseQueryOptions", func() {
+			It("should parse flags", func() {
+				opts, err := parseQueryOptions([]string{
+					"--app", "testapp1", "--level", "3", "--tags", "tag1,tag2",
+					"--start", "2015-10-16", "--end", "2015-10-16T10:00:00", "--format", "csv",
+				})
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.url).To(Equal(defaultQueryURL))
+				Expect(opts.application).To(Equal("testapp1"))
+				Expect(opts.format).To(Equal("csv"))
+				Expect(opts.query.Level).To(Equal(3))
+				Expect(opts.query.Tags).To(Equal([]string{"tag1", "tag2"}))
+				Expect(opts.query.StartTime).To(Equal(time.Date(2015, 10, 16, 0, 0, 0, 0, time.Local)))
+				Expect(opts.query.EndTime).To(Equal(time.Date(2015, 10, 16, 10, 0, 0, 0, time.Local)))
+			})
+
+			It("should start from --since when start time is not set", func() {
+				opts, err := parseQueryOptions([]string{"--app", "testapp1", "--since", "10m"})
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.query.StartTime).To(BeTemporally("~", time.Now().Add(-10*time.Minute), time.Second))
+				Expect(opts.query.EndTime.IsZero()).To(BeTrue())
+			})
+
+			It("should fail with invalid flags", func() {
+				for _, args := range [][]string{
+					{"--level", "1"},
+					{"--app", "testapp1", "--level", "6"},
+					{"--app", "testapp1", "--format", "xml"},
+					{"--app", "testapp1", "--start", "2015-10-166"},
+					{"--app", "testapp1", "--trace-id", "trace1", "--follow"},
+				} {
+					_, err := parseQueryOptions(args)
+					Expect(err).To(HaveOccurred(), "args: %v", args)
+				}
+			})
+		})
+
+		Describe("runQuery", func() {
+			It("should print found records", func() {
+				saveRecord("testapp1", "Message one", 1)
+				saveRecord("testapp1", "Message two", 3, "tag1")
+				saveRecord("testapp2", "Message three", 3)
+
+				Expect(runQuery(context.Background(), opts, out)).To(Succeed())
+
+				lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+				Expect(lines).To(HaveLen(2))
+				Expect(lines[0]).To(ContainSubstring(`"message":"Message one"`))
+				Expect(lines[1]).To(ContainSubstring(`"message":"Message two"`))
+			})
+
+			It("should print all pages", func() {
+				config.Pagination.PerPage = 2
+				defer func() { config.Pagination.PerPage = 100 }()
+
+				for i := 0; i < 5; i++ {
+					saveRecord("testapp1", "Message", 1)
+				}
+
+				Expect(runQuery(context.Background(), opts, out)).To(Succeed())
+
+				Expect(strings.Count(out.String(), "\n")).To(Equal(5))
+			})
+
+			It("should print new records in follow mode", func() {
+				saveRecord("testapp1", "Message one", 1)
+
+				opts.follow = true
+				opts.interval = 10 * time.Millisecond
+
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan error)
+				go func() { done <- runQuery(ctx, opts, out) }()
+
+				Eventually(out.String).Should(ContainSubstring("Message one"))
+
+				saveRecord("testapp1", "Message two", 1)
+
+				Eventually(out.String).Should(ContainSubstring("Message two"))
+				Consistently(func() int {
+					return strings.Count(out.String(), "\n")
+				}, 100*time.Millisecond).Should(Equal(2))
+
+				cancel()
+				Eventually(done).Should(Receive(Equal(context.Canceled)))
+			})
+		})
+
+		Describe("recordPrinter", func() {
+			record := client.Record{
+				Message:   "Lorem ipsum",
+				Level:     3,
+				Tags:      []string{"tag1", "tag2"},
+				CreatedAt: time.Date(2015, 10, 16, 8, 10, 11, 123000000, time.Local),
+				TraceID:   "trace1",
+			}
+
+			It("should print pretty records", func() {
+				printer := newRecordPrinter("pretty", false, out)
+				Expect(printer.print(record)).To(Succeed())
+
+				Expect(out.String()).To(Equal("2015-10-16 08:10:11.123 WARN   Lorem ipsum [tag1, tag2] trace=trace1\n"))
+			})
+
+			It("should color levels", func() {
+				printer := newRecordPrinter("pretty", true, out)
+				Expect(printer.print(record)).To(Succeed())
+
+				Expect(out.String()).To(ContainSubstring("\x1b[33mWARN  \x1b[0m"))
+			})
+
+			It("should print CSV records", func() {
+				printer := newRecordPrinter("csv", false, out)
+				Expect(printer.print(record)).To(Succeed())
+				Expect(printer.print(record)).To(Succeed())
+				Expect(printer.flush()).To(Succeed())
+
+				lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+				Expect(lines).To(HaveLen(3))
+				Expect(lines[0]).To(Equal("created_at,level,message,tags,trace_id,span_id"))
+				Expect(lines[1]).To(HavePrefix("2015-10-16T08:10:11.123"))
+				Expect(lines[1]).To(HaveSuffix(`,3,Lorem ipsum,"tag1,tag2",trace1,`))
+			})
+		})
+	})
+
+	Describe("commandDBPaths", func() {
+		var (
+			savedConfig     Config
+			savedConfigPath string
+			dir             string
+		)
+
+		BeforeEach(func() {
+			savedConfig = config
+			savedConfigPath = configPath
+
+			var err error
+			dir, err = ioutil.TempDir("", "logbook-commands")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			config = savedConfig
+			configPath = savedConfigPath
+			configPathRequired = false
+			os.RemoveAll(dir)
+		})
+
+		It("should resolve the path against the working directory", func() {
+			wd, err := os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(commandDBPaths("logbook.db", "")).To(Equal([]string{filepath.Join(wd, "logbook.db")}))
+		})
+
+		It("should take DB and shard files from config", func() {
+			shardsDir := filepath.Join(dir, "shards")
+			Expect(os.MkdirAll(filepath.Join(shardsDir, "testapp1"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(shardsDir, "testapp1", "2020-01"+shardExt), nil, 0600)).To(Succeed())
+
+			configFile := filepath.Join(dir, "logbook.yml")
+			Expect(ioutil.WriteFile(configFile, []byte(
+				"database:\n  path: "+filepath.Join(dir, "logbook.db")+"\n  shards:\n    period: month\n    dir: "+shardsDir+"\n",
+			), 0600)).To(Succeed())
+
+			Expect(commandDBPaths("", configFile)).To(Equal([]string{
+				filepath.Join(dir, "logbook.db"),
+				filepath.Join(shardsDir, "testapp1", "2020-01"+shardExt),
+			}))
+		})
+	})
+})
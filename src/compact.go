@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+// compactTxMaxSize limits the size of a single write transaction while
+// copying DB
+const compactTxMaxSize = 64 << 20
+
+// copyDB copies all buckets and keys of src into dst. Bucket sequences are
+// copied as well, so record keys stay unique. It returns ID of the last write
+// transaction of src the copy contains.
+func copyDB(dst, src *bolt.DB) (txID int, err error) {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return
+	}
+	defer func() { tx.Rollback() }()
+
+	size := 0
+
+	err = src.View(func(srcTx *bolt.Tx) error {
+		txID = srcTx.ID()
+
+		return srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+			return copyBucket(nil, name, srcBucket, func(path [][]byte, key, value []byte, seq uint64) (err error) {
+				if size += len(key) + len(value); size > compactTxMaxSize {
+					if err = tx.Commit(); err != nil {
+						return
+					}
+					if tx, err = dst.Begin(true); err != nil {
+						return
+					}
+					size = len(key) + len(value)
+				}
+
+				return putCopied(tx, path, key, value, seq)
+			})
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// copyBucket calls fn for the bucket and then for every its key. path is the
+// list of names of parent buckets, value is nil for buckets.
+func copyBucket(path [][]byte, name []byte, bucket *bolt.Bucket, fn func(path [][]byte, key, value []byte, seq uint64) error) error {
+	if err := fn(path, name, nil, bucket.Sequence()); err != nil {
+		return err
+	}
+
+	path = append(path[:len(path):len(path)], name)
+
+	return bucket.ForEach(func(key, value []byte) error {
+		if value == nil {
+			return copyBucket(path, key, bucket.Bucket(key), fn)
+		}
+
+		return fn(path, key, value, 0)
+	})
+}
+
+func putCopied(tx *bolt.Tx, path [][]byte, key, value []byte, seq uint64) error {
+	if len(path) == 0 {
+		bucket, err := tx.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return bucket.SetSequence(seq)
+	}
+
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		bucket = bucket.Bucket(name)
+	}
+
+	// keys are copied in order, so pages can be filled completely
+	bucket.FillPercent = 1.0
+
+	if value != nil {
+		return bucket.Put(key, value)
+	}
+
+	child, err := bucket.CreateBucket(key)
+	if err != nil {
+		return err
+	}
+	return child.SetSequence(seq)
+}
+
+// compactDBTo copies src into a fresh file at the path
+func compactDBTo(src *bolt.DB, path string) error {
+	os.Remove(path)
+
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err = copyDB(dst, src); err != nil {
+		dst.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return dst.Close()
+}
+
+// boltBucket is implemented by *bolt.Tx and *bolt.Bucket. Tx is treated as
+// the root bucket that contains only buckets.
+type boltBucket interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+	Cursor() *bolt.Cursor
+}
+
+// syncBucket makes contents of dst equal to src
+func syncBucket(dst, src boltBucket) (err error) {
+	dstBucket, _ := dst.(*bolt.Bucket)
+	srcBucket, _ := src.(*bolt.Bucket)
+
+	if dstBucket != nil && dstBucket.Sequence() != srcBucket.Sequence() {
+		if err = dstBucket.SetSequence(srcBucket.Sequence()); err != nil {
+			return
+		}
+	}
+
+	// keys removed from src or changed from value to bucket and back
+	var staleKeys, staleBuckets [][]byte
+
+	cursor := dst.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		switch {
+		case value == nil && src.Bucket(key) == nil:
+			staleBuckets = append(staleBuckets, append([]byte(nil), key...))
+		case value != nil && !hasValue(srcBucket, key):
+			staleKeys = append(staleKeys, append([]byte(nil), key...))
+		}
+	}
+
+	for _, key := range staleBuckets {
+		if err = dst.DeleteBucket(key); err != nil {
+			return
+		}
+	}
+
+	for _, key := range staleKeys {
+		if err = dstBucket.Delete(key); err != nil {
+			return
+		}
+	}
+
+	cursor = src.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		if value != nil {
+			if dstValue := dstBucket.Get(key); !hasValue(dstBucket, key) || !bytes.Equal(dstValue, value) {
+				if err = dstBucket.Put(key, value); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		child := dst.Bucket(key)
+		if child == nil {
+			if child, err = dst.CreateBucket(key); err != nil {
+				return
+			}
+		}
+
+		if err = syncBucket(child, src.Bucket(key)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// hasValue reports whether the bucket has a value rather than a nested bucket
+// at the key. Unlike Get it tells empty values from missing ones.
+func hasValue(bucket *bolt.Bucket, key []byte) bool {
+	k, v := bucket.Cursor().Seek(key)
+	return v != nil && bytes.Equal(k, key)
+}
+
+var (
+	// compactLock prevents compactions from overlapping with each other and
+	// with dropping shards
+	compactLock sync.Mutex
+)
+
+// compactTarget is the main DB or a shard being compacted along with its
+// compacted copy
+type compactTarget struct {
+	db    **bolt.DB
+	src   *bolt.DB
+	path  string
+	shard *shard
+	copy  *bolt.DB
+	// ID of the last write transaction of src the copy contains
+	txID    int
+	swapped bool
+}
+
+func newCompactTarget(target **bolt.DB, s *shard) *compactTarget {
+	return &compactTarget{db: target, src: *target, path: (*target).Path(), shard: s}
+}
+
+func (t *compactTarget) copyPath() string {
+	return t.path + ".compact"
+}
+
+// current reports whether DB is still open and isn't replaced. It should be
+// called with dbLock held.
+func (t *compactTarget) current() bool {
+	return *t.db == t.src
+}
+
+func (t *compactTarget) makeCopy() (err error) {
+	os.Remove(t.copyPath())
+
+	if t.copy, err = bolt.Open(t.copyPath(), 0600, nil); err != nil {
+		return
+	}
+
+	t.txID, err = copyDB(t.copy, t.src)
+
+	return
+}
+
+// catchUp applies changes made to DB since the copy was made or caught up
+// last time and reports whether there were any. It should be called with
+// dbLock held.
+func (t *compactTarget) catchUp() (changed bool, err error) {
+	if !t.current() {
+		return false, errDBNotOpen
+	}
+
+	err = t.src.View(func(srcTx *bolt.Tx) error {
+		if srcTx.ID() == t.txID {
+			return nil
+		}
+
+		changed = true
+
+		if err := t.copy.Update(func(tx *bolt.Tx) error { return syncBucket(tx, srcTx) }); err != nil {
+			return err
+		}
+
+		t.txID = srcTx.ID()
+
+		return nil
+	})
+
+	return
+}
+
+// swap replaces DB with the copy. DB is reopened if the copy can't be moved
+// to its path. It should be called with dbLock held.
+func (t *compactTarget) swap() (sizeBefore, sizeAfter int64, err error) {
+	if !t.current() {
+		return 0, 0, errDBNotOpen
+	}
+
+	path := t.path
+
+	if sizeBefore, err = fileSize(path); err != nil {
+		return
+	}
+
+	err = t.copy.Close()
+	t.copy = nil
+	if err != nil {
+		return
+	}
+
+	t.src.Close()
+
+	if err = os.Rename(t.copyPath(), path); err != nil {
+		err = fmt.Errorf("Can't swap compacted %s: %v", path, err)
+	} else {
+		t.swapped = true
+	}
+
+	// reopen DB even if the swap failed
+	var openErr error
+	*t.db, openErr = bolt.Open(path, 0600, nil)
+	checkErr(openErr, "bolt.Open failed")
+
+	if err != nil {
+		return
+	}
+
+	sizeAfter, err = fileSize(path)
+
+	return
+}
+
+// release removes the copy unless it's swapped in and releases the shard
+func (t *compactTarget) release() {
+	if t.copy != nil {
+		t.copy.Close()
+	}
+
+	if !t.swapped {
+		os.Remove(t.copyPath())
+	}
+
+	if t.shard != nil {
+		releaseShard(t.shard)
+	}
+}
+
+// compactSyncPasses limits catch-up passes made while writes go on
+const compactSyncPasses = 3
+
+// compactDB copies live data of the main DB and shards into fresh files and
+// swaps them in. Copies are made and caught up with changes while writes go
+// on. Writes are paused only for the last catch-up pass and the swap, reads
+// only for the swap. If a swap fails, DBs swapped before it stay compacted
+// and the rest are left as is.
+func compactDB() (sizeBefore, sizeAfter int64, err error) {
+	compactLock.Lock()
+	defer compactLock.Unlock()
+
+	var targets []*compactTarget
+	defer func() {
+		for _, t := range targets {
+			t.release()
+		}
+	}()
+
+	dbLock.RLock()
+	targets, err = copyCompactTargets()
+	dbLock.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	writesLock.Lock()
+	defer writesLock.Unlock()
+
+	// DBs can't change from now on
+	dbLock.RLock()
+	_, err = catchUpCompactTargets(targets)
+	dbLock.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	for _, t := range targets {
+		var before, after int64
+
+		if before, after, err = t.swap(); err != nil {
+			return
+		}
+
+		sizeBefore += before
+		sizeAfter += after
+	}
+
+	return
+}
+
+// copyCompactTargets makes copies of the main DB and shards and catches them
+// up with changes made while copying. It should be called with dbLock held.
+func copyCompactTargets() (targets []*compactTarget, err error) {
+	if db == nil {
+		return nil, errDBNotOpen
+	}
+
+	targets = []*compactTarget{newCompactTarget(&db, nil)}
+
+	shardsLock.Lock()
+	for _, s := range shards {
+		if _, err = s.acquire(); err != nil {
+			break
+		}
+
+		targets = append(targets, newCompactTarget(&s.db, s))
+	}
+	shardsLock.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	for _, t := range targets {
+		if err = t.makeCopy(); err != nil {
+			return
+		}
+	}
+
+	for i := 0; i < compactSyncPasses; i++ {
+		var changed bool
+
+		if changed, err = catchUpCompactTargets(targets); err != nil || !changed {
+			return
+		}
+	}
+
+	return
+}
+
+// catchUpCompactTargets catches copies up with changes of DBs and reports
+// whether there were any
+func catchUpCompactTargets(targets []*compactTarget) (changed bool, err error) {
+	for _, t := range targets {
+		var targetChanged bool
+
+		if targetChanged, err = t.catchUp(); err != nil {
+			return
+		}
+
+		changed = changed || targetChanged
+	}
+
+	return
+}
+
+// compactDBFile compacts DB file that isn't used by a running server
+func compactDBFile(path string) (sizeBefore, sizeAfter int64, err error) {
+	path = absPathToFile(path)
+	tmpPath := path + ".compact"
+
+	if sizeBefore, err = fileSize(path); err != nil {
+		return
+	}
+
+	src, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		err = errDBLocked
+	}
+	if err != nil {
+		return
+	}
+
+	err = compactDBTo(src, tmpPath)
+	src.Close()
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	sizeAfter, err = fileSize(path)
+	return
+}
+
+func fileSize(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Action: Compact =============================================================
+
+type CompactResponse struct {
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+}
+
+func compactHandler(c *gin.Context) {
+	sizeBefore, sizeAfter, err := compactDB()
+	panicOnErr(err)
+
+	c.JSON(200, CompactResponse{sizeBefore, sizeAfter})
+}
+
+// end of Action: Compact
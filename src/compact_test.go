@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compaction", func() {
+	saveRecords := func(application string, count int) {
+		records := make([]ApplicationLogRecord, count)
+		for i := range records {
+			records[i] = ApplicationLogRecord{application, &LogRecord{
+				Message: fmt.Sprintf("Message %d %s", i, strings.Repeat("lorem ipsum ", 20)),
+				Level:   1,
+				Tags:    []string{"tag1"},
+				TraceID: "trace1",
+			}}
+		}
+		Expect(saveLogRecords(records)).To(Succeed())
+	}
+
+	loadAll := func(application string) LogRecords {
+		logRecords, err := loadLogRecords(application, 0, []string{},
+			time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	Describe("compactDB", func() {
+		It("should keep all data", func() {
+			saveRecords("testapp1", 10)
+			saveRecords("testapp2", 5)
+
+			_, _, err := compactDB()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(loadAll("testapp1")).To(HaveLen(10))
+			Expect(loadAll("testapp2")).To(HaveLen(5))
+
+			traceRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(traceRecords).To(HaveLen(10))
+		})
+
+		It("should keep bucket sequences", func() {
+			saveRecords("testapp1", 3)
+
+			_, _, err := compactDB()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(db.View(func(tx *bolt.Tx) error {
+				Expect(tx.Bucket([]byte("testapp1")).Sequence()).To(Equal(uint64(3)))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("should reclaim space of deleted data", func() {
+			saveRecords("testapp1", 2000)
+
+			Expect(db.Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket([]byte("testapp1"))
+			})).To(Succeed())
+
+			sizeBefore, sizeAfter, err := compactDB()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sizeAfter).To(BeNumerically("<", sizeBefore))
+		})
+
+		It("should accept writes after compaction", func() {
+			_, _, err := compactDB()
+			Expect(err).NotTo(HaveOccurred())
+
+			saveRecords("testapp1", 1)
+			Expect(loadAll("testapp1")).To(HaveLen(1))
+		})
+	})
+
+	Describe("compactTarget", func() {
+		// dump returns keys, values and bucket sequences of DB by their paths
+		dump := func(boltDB *bolt.DB) map[string]string {
+			contents := make(map[string]string)
+
+			Expect(boltDB.View(func(tx *bolt.Tx) error {
+				return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+					return copyBucket(nil, name, bucket, func(path [][]byte, key, value []byte, seq uint64) error {
+						keyPath := string(bytes.Join(append(path, key), []byte("/")))
+
+						if value == nil {
+							contents[keyPath] = fmt.Sprintf("bucket %d", seq)
+						} else {
+							contents[keyPath] = string(value)
+						}
+						return nil
+					})
+				})
+			})).To(Succeed())
+
+			return contents
+		}
+
+		It("should catch the copy up with changes made after copying", func() {
+			saveRecords("testapp1", 5)
+			saveRecords("testapp2", 2)
+
+			t := newCompactTarget(&db, nil)
+			defer t.release()
+
+			Expect(t.makeCopy()).To(Succeed())
+
+			saveRecords("testapp1", 3)
+			saveRecords("testapp3", 1)
+
+			Expect(db.Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket([]byte("testapp2"))
+			})).To(Succeed())
+
+			changed, err := t.catchUp()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeTrue())
+
+			Expect(dump(t.copy)).To(Equal(dump(db)))
+
+			changed, err = t.catchUp()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeFalse())
+		})
+	})
+
+	Describe("compactDB with concurrent writes", func() {
+		It("should keep records saved while compacting", func() {
+			saveRecords("testapp1", 2000)
+
+			stop := make(chan struct{})
+			saved := make(chan int)
+
+			go func() {
+				defer GinkgoRecover()
+
+				n := 0
+				for {
+					select {
+					case <-stop:
+						saved <- n
+						return
+					default:
+					}
+
+					saveRecords("testapp2", 1)
+					n++
+				}
+			}()
+
+			_, _, err := compactDB()
+			close(stop)
+			Expect(err).NotTo(HaveOccurred())
+
+			n := <-saved
+
+			count, err := countLogRecords("testapp2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(n))
+		})
+	})
+
+	Describe("/compact", func() {
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			router = setupRouter()
+
+			saveRecords("testapp1", 1)
+
+			Expect(sendRequest("POST", "/compact", "")).To(Succeed())
+		})
+
+		It("should respond with file sizes", func() {
+			Expect(response.Code).To(Equal(200))
+
+			parsedRes := CompactResponse{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &parsedRes)).To(Succeed())
+			Expect(parsedRes.SizeBefore).To(BeNumerically(">", 0))
+			Expect(parsedRes.SizeAfter).To(BeNumerically(">", 0))
+		})
+	})
+})
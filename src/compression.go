@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed record values start with a header followed by the compressed
+// BSON:
+//
+//	0x00 'l' 'b' <codec> [<dictionary ID>] <payload>
+//
+// BSON documents start with their length as int32 little-endian. The header
+// read this way is bigger than any compressed value, so values saved before
+// compression was enabled are told apart and read as is.
+var compressedRecordMagic = []byte{0x00, 'l', 'b'}
+
+const (
+	codecSnappy = iota + 1
+	codecZstd
+	// zstd with a dictionary, the header contains big-endian uint32
+	// dictionary ID
+	codecZstdDict
+)
+
+// compressionCodecs maps database.compression.codec values to header codecs
+var compressionCodecs = map[string]byte{
+	"":       0,
+	"none":   0,
+	"snappy": codecSnappy,
+	"zstd":   codecZstd,
+}
+
+const (
+	// dictionaries are trained on samples of up to this size
+	dictionarySampleMaxSize = 4 << 10
+	dictionaryMaxSize       = 64 << 10
+
+	// cached dictionary decoders are dropped when there are more of them
+	dictDecodersMaxSize = 256
+)
+
+// dictionariesBucket is a top-level bucket that maps dictionary IDs to zstd
+// dictionaries. Every DB file keeps dictionaries of its records, so shards,
+// backups and compacted files stay readable on their own. Its name starts
+// with a zero byte to keep it apart from application buckets.
+var dictionariesBucket = []byte("\x00dictionaries")
+
+var errInvalidCompressedRecord = errors.New("Invalid compressed record")
+
+// recordDictionary is a trained zstd dictionary with encoder that uses it
+type recordDictionary struct {
+	id      uint32
+	data    []byte
+	encoder *zstd.Encoder
+}
+
+// recordCompressor compresses values of new records according to
+// database.compression and collects samples for dictionary training
+type recordCompressor struct {
+	lock sync.Mutex
+
+	codec           byte
+	dictionary      bool
+	sampleN         int
+	retrainInterval time.Duration
+
+	samples   [][]byte
+	training  bool
+	trainedAt time.Time
+	dict      *recordDictionary
+
+	// generation is changed by initCompression, so dictionaries trained with
+	// previous settings are dropped
+	generation int
+}
+
+var (
+	compressor = &recordCompressor{}
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	dictDecoders     = make(map[dictDecoderKey]*zstd.Decoder)
+	dictDecodersLock sync.Mutex
+)
+
+// dictDecoderKey identifies a dictionary by the DB file it's loaded from
+// since dictionary IDs are random and may collide across files
+type dictDecoderKey struct {
+	path string
+	id   uint32
+}
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// initCompression sets up compressor of new records. Records saved with
+// other settings stay readable.
+func initCompression() {
+	conf := currentConfig().Database.Compression
+
+	compressor.lock.Lock()
+	defer compressor.lock.Unlock()
+
+	compressor.codec = compressionCodecs[conf.Codec]
+	compressor.dictionary = conf.Dictionary && compressor.codec == codecZstd
+	compressor.sampleN = conf.Samples
+	compressor.retrainInterval = time.Duration(conf.RetrainInterval) * time.Minute
+
+	compressor.samples = nil
+	compressor.training = false
+	compressor.trainedAt = time.Time{}
+	compressor.dict = nil
+	compressor.generation++
+}
+
+// compress returns the value of the record to save along with the dictionary
+// it's compressed with. BSON is returned as is when compression is disabled.
+func (c *recordCompressor) compress(data []byte) ([]byte, *recordDictionary) {
+	c.lock.Lock()
+
+	codec := c.codec
+	if c.dictionary {
+		c.sample(data)
+	}
+	recordDict := c.dict
+
+	c.lock.Unlock()
+
+	if codec == 0 {
+		return data, nil
+	}
+
+	var value []byte
+
+	switch {
+	case codec == codecSnappy:
+		value = append(recordHeader(codecSnappy), snappy.Encode(nil, data)...)
+	case recordDict != nil:
+		header := append(recordHeader(codecZstdDict), dictionaryKey(recordDict.id)...)
+		value = recordDict.encoder.EncodeAll(data, header)
+	default:
+		initZstd()
+		value = zstdEncoder.EncodeAll(data, recordHeader(codecZstd))
+	}
+
+	// not worth it or can't be told apart from BSON
+	if len(value) >= len(data) || isBSONValue(value) {
+		return data, nil
+	}
+
+	return value, recordDict
+}
+
+func recordHeader(codec byte) []byte {
+	return append(append([]byte{}, compressedRecordMagic...), codec)
+}
+
+// sample remembers the record for dictionary training and starts training a
+// new dictionary when enough samples are collected. Records are compressed
+// with the previous dictionary until the new one is trained. It should be
+// called with lock held.
+func (c *recordCompressor) sample(data []byte) {
+	if c.training || c.dict != nil && (c.retrainInterval == 0 || time.Since(c.trainedAt) < c.retrainInterval) {
+		return
+	}
+
+	if len(data) > dictionarySampleMaxSize {
+		data = data[:dictionarySampleMaxSize]
+	}
+	c.samples = append(c.samples, append([]byte{}, data...))
+
+	if len(c.samples) < c.sampleN {
+		return
+	}
+
+	c.training = true
+	go c.train(c.samples, c.generation)
+
+	c.samples = nil
+}
+
+// train trains a dictionary on the samples and swaps it in
+func (c *recordCompressor) train(samples [][]byte, generation int) {
+	recordDict, err := trainDictionary(samples)
+	if err != nil {
+		log.Printf("Can't train compression dictionary: %v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if err == nil {
+		c.dict = recordDict
+	}
+
+	c.training = false
+	c.trainedAt = time.Now()
+}
+
+func trainDictionary(samples [][]byte) (*recordDictionary, error) {
+	data, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictionaryMaxSize,
+		HashBytes:   6,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordDictionary{info.ID(), data, encoder}, nil
+}
+
+// isBSONValue reports whether the value starts with its own length like BSON
+// documents do
+func isBSONValue(value []byte) bool {
+	return len(value) >= 4 && int(binary.LittleEndian.Uint32(value)) == len(value)
+}
+
+// putDictionary saves the dictionary to DB of the transaction if it isn't
+// there yet
+func putDictionary(tx *bolt.Tx, recordDict *recordDictionary) error {
+	bucket, err := tx.CreateBucketIfNotExists(dictionariesBucket)
+	if err != nil {
+		return err
+	}
+
+	key := dictionaryKey(recordDict.id)
+	if bucket.Get(key) != nil {
+		return nil
+	}
+
+	return bucket.Put(key, recordDict.data)
+}
+
+func dictionaryKey(id uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, id)
+	return key
+}
+
+// recordValue returns BSON of the record of the bucket or nil if the bucket
+// has no record. The result is safe to use after the transaction is closed.
+func recordValue(recordBucket *bolt.Bucket) ([]byte, error) {
+	value := recordBucket.Get([]byte("record"))
+	if value == nil {
+		return nil, nil
+	}
+
+	if isBSONValue(value) || len(value) <= len(compressedRecordMagic) || !bytes.HasPrefix(value, compressedRecordMagic) {
+		return append([]byte{}, value...), nil
+	}
+
+	codec := value[len(compressedRecordMagic)]
+	payload := value[len(compressedRecordMagic)+1:]
+
+	switch codec {
+	case codecSnappy:
+		return snappy.Decode(nil, payload)
+
+	case codecZstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(payload, nil)
+
+	case codecZstdDict:
+		if len(payload) < 4 {
+			return nil, errInvalidCompressedRecord
+		}
+
+		decoder, err := dictionaryDecoder(recordBucket.Tx(), binary.BigEndian.Uint32(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.DecodeAll(payload[4:], nil)
+	}
+
+	return nil, errInvalidCompressedRecord
+}
+
+// dictionaryDecoder returns decoder of the dictionary loading it from DB of
+// the transaction on first use
+func dictionaryDecoder(tx *bolt.Tx, id uint32) (*zstd.Decoder, error) {
+	key := dictDecoderKey{tx.DB().Path(), id}
+
+	dictDecodersLock.Lock()
+	defer dictDecodersLock.Unlock()
+
+	if decoder, ok := dictDecoders[key]; ok {
+		return decoder, nil
+	}
+
+	var data []byte
+	if bucket := tx.Bucket(dictionariesBucket); bucket != nil {
+		data = bucket.Get(dictionaryKey(id))
+	}
+
+	if data == nil {
+		return nil, errors.New("Compression dictionary is missing")
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// decoders of closed or replaced files are never used again, so the cache
+	// is just reset when it's full. Decoders that are in use stay valid.
+	if len(dictDecoders) >= dictDecodersMaxSize {
+		dictDecoders = make(map[dictDecoderKey]*zstd.Decoder)
+	}
+
+	dictDecoders[key] = decoder
+
+	return decoder, nil
+}
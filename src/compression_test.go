@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Record compression", func() {
+	start := time.Date(2015, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	message := func(i int) string {
+		return fmt.Sprintf("GET /api/v1/users/%d failed with status 500 in %dms\n", i, i%50) +
+			strings.Repeat("\tat com.example.api.UsersController.show(UsersController.java:42)\n", 3)
+	}
+
+	// saveRecords saves records from-th to (to-1)-th
+	saveRecords := func(from, to int) {
+		for i := from; i < to; i++ {
+			logRecord := LogRecord{
+				Message:   message(i),
+				Level:     2,
+				Tags:      []string{"http", "api"},
+				CreatedAt: start.Add(time.Duration(i) * time.Second),
+			}
+			Expect(saveLogRecord("testapp", &logRecord)).To(Succeed())
+		}
+	}
+
+	trainedDictionary := func() *recordDictionary {
+		compressor.lock.Lock()
+		defer compressor.lock.Unlock()
+		return compressor.dict
+	}
+
+	// recordValues returns stored values of the application records
+	recordValues := func() (values [][]byte) {
+		Expect(db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("testapp")).ForEach(func(key, value []byte) error {
+				if recordBucket := tx.Bucket([]byte("testapp")).Bucket(key); value == nil && recordBucket != nil {
+					values = append(values, append([]byte{}, recordBucket.Get([]byte("record"))...))
+				}
+				return nil
+			})
+		})).To(Succeed())
+		return
+	}
+
+	loadMessages := func() []string {
+		logRecords, err := loadLogRecords("testapp", 0, []string{"api"}, start, start.Add(time.Hour), 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		return logRecordMessages(logRecords)
+	}
+
+	BeforeEach(func() {
+		config.Database.Compression.Dictionary = true
+		config.Database.Compression.Samples = 20
+	})
+
+	AfterEach(func() {
+		config.Database.Compression.Codec = ""
+		config.Database.Compression.Dictionary = false
+		config.Database.Compression.Samples = 0
+		initCompression()
+	})
+
+	It("should compress records transparently to loading", func() {
+		for _, codec := range []string{"snappy", "zstd"} {
+			config.Database.Compression.Codec = codec
+			config.Database.Compression.Dictionary = false
+			initCompression()
+
+			db.Update(func(tx *bolt.Tx) error {
+				tx.DeleteBucket([]byte("testapp"))
+				return nil
+			})
+
+			saveRecords(0, 3)
+
+			for _, value := range recordValues() {
+				Expect(value[:4]).To(Equal(recordHeader(compressionCodecs[codec])), codec)
+			}
+
+			Expect(loadMessages()).To(Equal([]string{message(0), message(1), message(2)}), codec)
+		}
+	})
+
+	It("should train dictionary on recent records in background and save it to DB", func() {
+		config.Database.Compression.Codec = "zstd"
+		initCompression()
+
+		saveRecords(0, 20)
+
+		Eventually(trainedDictionary).ShouldNot(BeNil())
+
+		saveRecords(20, 30)
+
+		values := recordValues()
+		Expect(values).To(HaveLen(30))
+
+		for i, value := range values {
+			codec := byte(codecZstd)
+			if i >= 20 {
+				codec = codecZstdDict
+			}
+			Expect(value[3]).To(Equal(codec))
+		}
+
+		Expect(len(values[29])).To(BeNumerically("<", len(values[0])))
+
+		db.View(func(tx *bolt.Tx) error {
+			Expect(tx.Bucket(dictionariesBucket).Stats().KeyN).To(Equal(1))
+
+			applications, err := listApplications(tx, []string{"*"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applications).To(Equal([]string{"testapp"}))
+			return nil
+		})
+
+		Expect(loadMessages()).To(HaveLen(30))
+
+		// dictionaries are loaded from DB
+		dictDecodersLock.Lock()
+		dictDecoders = make(map[dictDecoderKey]*zstd.Decoder)
+		dictDecodersLock.Unlock()
+
+		Expect(loadMessages()).To(HaveLen(30))
+	})
+
+	It("should keep records readable when compression is disabled", func() {
+		config.Database.Compression.Codec = "zstd"
+		initCompression()
+
+		saveRecords(0, 20)
+		Eventually(trainedDictionary).ShouldNot(BeNil())
+		saveRecords(20, 25)
+
+		config.Database.Compression.Codec = "none"
+		initCompression()
+
+		logRecord := LogRecord{Message: "Plain", Tags: []string{"api"}, CreatedAt: start.Add(time.Minute)}
+		Expect(saveLogRecord("testapp", &logRecord)).To(Succeed())
+
+		values := recordValues()
+		var plain LogRecord
+		Expect(bson.Unmarshal(values[len(values)-1], &plain)).To(Succeed())
+		Expect(plain.Message).To(Equal("Plain"))
+
+		Expect(loadMessages()).To(HaveLen(26))
+
+		var problems []RecordProblem
+		checked, err := verifyLogRecords([]string{"testapp"}, func(problem RecordProblem) {
+			problems = append(problems, problem)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checked).To(Equal(26))
+		Expect(problems).To(BeEmpty())
+	})
+
+	It("should tell apart dictionaries with the same ID in different files", func() {
+		train := func(format string) *recordDictionary {
+			samples := make([][]byte, 100)
+			for i := range samples {
+				samples[i] = []byte(fmt.Sprintf(format, i, i%50))
+			}
+
+			recordDict, err := trainDictionary(samples)
+			Expect(err).NotTo(HaveOccurred())
+			return recordDict
+		}
+
+		formats := []string{
+			"GET /api/v1/users/%d failed with status 500 in %dms, retrying the request",
+			"Worker %d finished the job queue of the billing service, %d jobs left to process",
+		}
+
+		dict1 := train(formats[0])
+		dict2 := train(formats[1])
+
+		// give the second dictionary the ID of the first one
+		data := append([]byte{}, dict2.data...)
+		binary.LittleEndian.PutUint32(data[4:], dict1.id)
+
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(data))
+		Expect(err).NotTo(HaveOccurred())
+		dict2 = &recordDictionary{dict1.id, data, encoder}
+
+		dir, err := ioutil.TempDir("", "logbook-dictionaries")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		for i, recordDict := range []*recordDictionary{dict1, dict2} {
+			// references the dictionary content
+			record := []byte(fmt.Sprintf(formats[i], 12345, 7))
+
+			dictDB, err := bolt.Open(filepath.Join(dir, fmt.Sprintf("%d.db", i)), 0600, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(dictDB.Update(func(tx *bolt.Tx) error {
+				Expect(putDictionary(tx, recordDict)).To(Succeed())
+
+				recordBucket, err := tx.CreateBucket([]byte("record"))
+				Expect(err).NotTo(HaveOccurred())
+
+				header := append(recordHeader(codecZstdDict), dictionaryKey(recordDict.id)...)
+				return recordBucket.Put([]byte("record"), recordDict.encoder.EncodeAll(record, header))
+			})).To(Succeed())
+
+			Expect(dictDB.View(func(tx *bolt.Tx) error {
+				Expect(recordValue(tx.Bucket([]byte("record")))).To(Equal(record))
+				return nil
+			})).To(Succeed())
+
+			Expect(dictDB.Close()).To(Succeed())
+		}
+	})
+
+	It("should store records as is when compression doesn't help", func() {
+		config.Database.Compression.Codec = "snappy"
+		initCompression()
+
+		data, err := bson.Marshal(&LogRecord{Message: "x"})
+		Expect(err).NotTo(HaveOccurred())
+
+		value, recordDict := compressor.compress(data)
+		Expect(value).To(Equal(data))
+		Expect(recordDict).To(BeNil())
+	})
+})
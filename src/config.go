@@ -3,10 +3,20 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
-	"io/ioutil"
+)
+
+const (
+	defaultConfigPath = "../logbook.yml"
+	configEnvPrefix   = "LOGBOOK_"
 )
 
 type Config struct {
@@ -15,40 +25,345 @@ type Config struct {
 		Password string
 	}
 	Server struct {
-		Address string
-		Port    string
+		Address         string
+		Port            string
+		ShutdownTimeout int `yaml:"shutdownTimeout"` // seconds
+		TLS             struct {
+			Cert     string
+			Key      string
+			ClientCA string              `yaml:"clientCA"`
+			Clients  map[string][]string // client certificate CN => applications
+		}
 	}
 	Database struct {
-		Path string
+		Driver  string // "bolt", "memory" or "leveldb"
+		Path    string
+		LevelDB struct {
+			Path        string
+			WriteBuffer int  `yaml:"writeBuffer"` // MiB
+			NoSync      bool `yaml:"noSync"`      // don't fsync every write
+		} `yaml:"leveldb"`
+		Compression struct {
+			Codec           string // "none", "snappy" or "zstd"
+			Dictionary      bool   // train zstd dictionary on recent records
+			Samples         int    // number of records a dictionary is trained on
+			RetrainInterval int    `yaml:"retrainInterval"` // minutes, 0 disables retraining
+		}
+		Shards struct {
+			Period      string // "day", "month" or "year", sharding is disabled when empty
+			Dir         string
+			ArchiveDir  string `yaml:"archiveDir"`  // dropped shards are moved here when defined
+			MaxOpen     int    `yaml:"maxOpen"`     // least recently used shards are closed above it
+			IdleTimeout int    `yaml:"idleTimeout"` // minutes, 0 keeps unused shards open
+			MaxSkew     int    `yaml:"maxSkew"`     // days, 0 allows new shards for any time
+		}
 	}
 	Pagination struct {
 		PerPage int `yaml:"perPage"`
 	}
+	Syslog struct {
+		UDP         string // listen address, disabled when empty
+		TCP         string // listen address, disabled when empty
+		Application string // used when message has no APP-NAME
+	}
+	GELF struct {
+		UDP         string // listen address, disabled when empty
+		TCP         string // listen address, disabled when empty
+		Application string // used when message has no _application field
+	}
+	TCP struct {
+		Address string // listen address, disabled when empty
+		TLS     bool   // use server TLS certificate
+	}
+	Forward struct {
+		Address string // listen address, disabled when empty
+	}
+	Backup struct {
+		Dir      string // scheduled backups are disabled when empty
+		Interval int    // minutes
+		Keep     int    // number of backups to keep
+	}
+	Journal struct {
+		Path          string // asynchronous writes are disabled when empty
+		BufferSize    int    `yaml:"bufferSize"`    // records
+		FlushInterval int    `yaml:"flushInterval"` // milliseconds
+		Sync          string // "none", "write" or "interval"
+		SyncInterval  int    `yaml:"syncInterval"` // milliseconds, used by "interval" sync
+	}
+	Archive struct {
+		Dir      string // archiving is disabled when empty
+		After    int    // days, older records are archived
+		Interval int    // minutes
+	}
+	Metrics struct {
+		Applications    []string // applications labeled in metrics, others are labeled "other"
+		MaxApplications int      `yaml:"maxApplications"` // applications labeled on first use when applications is empty
+	}
 }
 
-var config Config
+var (
+	config     Config
+	configLock sync.RWMutex
+
+	configPath         string
+	configPathRequired bool
+	configFlagValues   = make(map[string]string)
+)
+
+func defaultConfig() (conf Config) {
+	conf.Server.Address = "127.0.0.1"
+	conf.Server.Port = "11610"
+	conf.Server.ShutdownTimeout = 10
+	conf.Database.Driver = "bolt"
+	conf.Database.Path = "../db/logbook.db"
+	conf.Database.LevelDB.Path = "../db/logbook.leveldb"
+	conf.Database.LevelDB.WriteBuffer = 16
+	conf.Database.Compression.Codec = "none"
+	conf.Database.Compression.Dictionary = true
+	conf.Database.Compression.Samples = 1000
+	conf.Database.Compression.RetrainInterval = 1440
+	conf.Database.Shards.Dir = "../db/shards"
+	conf.Database.Shards.MaxOpen = 64
+	conf.Database.Shards.IdleTimeout = 10
+	conf.Database.Shards.MaxSkew = 30
+	conf.Pagination.PerPage = 100
+	conf.Syslog.Application = "syslog"
+	conf.GELF.Application = "gelf"
+	conf.Backup.Interval = 1440
+	conf.Backup.Keep = 7
+	conf.Journal.BufferSize = 10000
+	conf.Journal.FlushInterval = 100
+	conf.Journal.Sync = "none"
+	conf.Journal.SyncInterval = 1000
+	conf.Archive.After = 90
+	conf.Archive.Interval = 1440
+	conf.Metrics.MaxApplications = 100
+	return
+}
 
-func prepareConfig() {
+func prepareConfig(args []string) {
 	configfile := flag.String(
 		"config",
-		"../logbook.yml",
-		"path to configuration file",
+		"",
+		"path to configuration file (default \""+defaultConfigPath+"\")",
 	)
 
-	flag.Parse()
+	for _, field := range configFields(&config) {
+		flag.String(field.path, "", "overrides "+field.path+" ($"+field.envName()+")")
+	}
 
-	var (
-		confData []byte
-		err      error
-	)
+	flag.CommandLine.Parse(args)
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			configFlagValues[f.Name] = f.Value.String()
+		}
+	})
+
+	setConfigPath(*configfile)
+
+	var err error
 
-	if confData, err = ioutil.ReadFile(absPathToFile(*configfile)); err != nil {
-		fmt.Printf("Error opening config file: %v", err)
+	if config, err = buildValidConfig(); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+}
 
-	if err = yaml.Unmarshal(confData, &config); err != nil {
-		fmt.Printf("Invalid config file format")
-		os.Exit(1)
+// setConfigPath sets path to the config file from the flag value or from the
+// environment variable. Config file is required when its path is set.
+func setConfigPath(configfile string) {
+	switch {
+	case len(configfile) > 0:
+		configPath, configPathRequired = configfile, true
+	case len(os.Getenv(configEnvPrefix+"CONFIG")) > 0:
+		configPath, configPathRequired = os.Getenv(configEnvPrefix+"CONFIG"), true
+	default:
+		configPath = defaultConfigPath
+	}
+
+	configPath = absPathToFile(configPath)
+}
+
+// buildValidConfig builds config and checks it with validateConfig
+func buildValidConfig() (conf Config, err error) {
+	if conf, err = buildConfig(); err != nil {
+		return
 	}
+
+	if errs := validateConfig(&conf); len(errs) > 0 {
+		err = errs
+	}
+
+	return
+}
+
+// buildStorageConfig builds config and checks only its database section
+func buildStorageConfig() (conf Config, err error) {
+	if conf, err = buildConfig(); err != nil {
+		return
+	}
+
+	if errs := validateStorageConfig(&conf); len(errs) > 0 {
+		err = errs
+	}
+
+	return
+}
+
+// buildConfig composes config from defaults, config file, environment
+// variables and command-line flags. Every next source overrides the previous.
+func buildConfig() (conf Config, err error) {
+	conf = defaultConfig()
+
+	confData, err := ioutil.ReadFile(configPath)
+
+	switch {
+	case err == nil:
+		if err = yaml.UnmarshalStrict(confData, &conf); err != nil {
+			err = fmt.Errorf("Invalid config file format (%s): %v", configPath, err)
+			return
+		}
+	case os.IsNotExist(err) && !configPathRequired:
+		// Config file is optional when it isn't specified explicitly
+	default:
+		err = fmt.Errorf("Error opening config file: %v", err)
+		return
+	}
+
+	err = applyConfigOverrides(&conf, os.LookupEnv, configFlagValues)
+
+	return
+}
+
+// configField is a leaf field of Config addressed by its path in the config
+// file, e.g. "server.tls.clientCA"
+type configField struct {
+	path  string
+	value reflect.Value
+}
+
+func (f configField) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(f.path, ".", "_", -1))
+}
+
+func configFields(conf *Config) []configField {
+	return collectConfigFields(reflect.ValueOf(conf).Elem(), "")
+}
+
+func collectConfigFields(v reflect.Value, prefix string) (fields []configField) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name)
+		}
+
+		path := prefix + name
+
+		if v.Field(i).Kind() == reflect.Struct {
+			fields = append(fields, collectConfigFields(v.Field(i), path+".")...)
+		} else {
+			fields = append(fields, configField{path, v.Field(i)})
+		}
+	}
+
+	return
+}
+
+func applyConfigOverrides(conf *Config, lookupEnv func(string) (string, bool), flagValues map[string]string) error {
+	for _, field := range configFields(conf) {
+		if str, ok := lookupEnv(field.envName()); ok {
+			if err := setConfigField(field.value, str); err != nil {
+				return fmt.Errorf("Invalid value of %s: %v", field.envName(), err)
+			}
+		}
+
+		if str, ok := flagValues[field.path]; ok {
+			if err := setConfigField(field.value, str); err != nil {
+				return fmt.Errorf("Invalid value of --%s: %v", field.path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setConfigField parses str into the config field. Lists are comma-separated,
+// maps of lists are written as "key1=a,b;key2=c".
+func setConfigField(v reflect.Value, str string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(str)
+
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case v.Type() == reflect.TypeOf([]string{}):
+		v.Set(reflect.ValueOf(extractTags(str)))
+
+	case v.Type() == reflect.TypeOf(map[string][]string{}):
+		m := make(map[string][]string)
+
+		for _, pair := range strings.Split(str, ";") {
+			if len(pair) == 0 {
+				continue
+			}
+
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q should be in key=value format", pair)
+			}
+
+			m[kv[0]] = extractTags(kv[1])
+		}
+
+		v.Set(reflect.ValueOf(m))
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// currentConfig returns a snapshot of config that is safe to use while config
+// is being reloaded
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	return config
+}
+
+// reloadConfig rereads config and applies the settings that don't need
+// a restart. Server, TLS certificates and database settings are kept as is.
+func reloadConfig() {
+	newConfig, err := buildValidConfig()
+	if err != nil {
+		log.Printf("Config reload failed: %v", err)
+		return
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	config.Auth = newConfig.Auth
+	config.Server.TLS.Clients = newConfig.Server.TLS.Clients
+	config.Pagination = newConfig.Pagination
+	config.Metrics = newConfig.Metrics
+
+	log.Println("Config reloaded")
 }
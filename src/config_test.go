@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Describe("reloadConfig", func() {
+		var (
+			savedConfig     Config
+			savedConfigPath string
+			configFile      string
+		)
+
+		BeforeEach(func() {
+			savedConfig = config
+			savedConfigPath = configPath
+
+			f, err := ioutil.TempFile("", "logbook_config")
+			Expect(err).NotTo(HaveOccurred())
+			configFile = f.Name()
+			f.Close()
+
+			configPath = configFile
+		})
+
+		AfterEach(func() {
+			config = savedConfig
+			configPath = savedConfigPath
+			os.Remove(configFile)
+		})
+
+		writeConfig := func(data string) {
+			Expect(ioutil.WriteFile(configFile, []byte(data), 0600)).To(Succeed())
+		}
+
+		It("should apply reloadable settings", func() {
+			writeConfig("auth:\n  user: newuser\n  password: newpassword\npagination:\n  perPage: 5\n")
+
+			reloadConfig()
+
+			Expect(config.Auth.User).To(Equal("newuser"))
+			Expect(config.Auth.Password).To(Equal("newpassword"))
+			Expect(config.Pagination.PerPage).To(Equal(5))
+		})
+
+		It("should keep settings that need a restart", func() {
+			writeConfig("auth:\n  user: newuser\n  password: newpassword\nserver:\n  port: 12345\ndatabase:\n  path: other.db\n")
+
+			reloadConfig()
+
+			Expect(config.Server.Port).To(Equal(savedConfig.Server.Port))
+			Expect(config.Database.Path).To(Equal(savedConfig.Database.Path))
+		})
+
+		It("should keep config as is when file is invalid", func() {
+			writeConfig("auth: [")
+
+			reloadConfig()
+
+			Expect(config).To(Equal(savedConfig))
+		})
+
+		It("should keep config as is when new config doesn't pass validation", func() {
+			writeConfig("auth:\n  user: newuser\n  password: newpassword\npagination:\n  perPage: 0\n")
+
+			reloadConfig()
+
+			Expect(config).To(Equal(savedConfig))
+		})
+
+		It("should apply new credentials to the running router", func() {
+			gin.SetMode(gin.TestMode)
+			router := setupRouter()
+
+			writeConfig("auth:\n  user: newuser\n  password: newpassword\npagination:\n  perPage: 5\n")
+			reloadConfig()
+
+			req, _ := http.NewRequest("GET", "http://logbook.test/apptest/stats", nil)
+
+			req.SetBasicAuth(savedConfig.Auth.User, savedConfig.Auth.Password)
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, req)
+			Expect(response.Code).To(Equal(401))
+
+			req.SetBasicAuth("newuser", "newpassword")
+			response = httptest.NewRecorder()
+			router.ServeHTTP(response, req)
+			Expect(response.Code).NotTo(Equal(401))
+		})
+	})
+
+	Describe("applyConfigOverrides", func() {
+		var (
+			conf       Config
+			env        map[string]string
+			flagValues map[string]string
+		)
+
+		BeforeEach(func() {
+			conf = defaultConfig()
+			conf.Auth.User = "fileuser"
+
+			env = map[string]string{}
+			flagValues = map[string]string{}
+		})
+
+		lookupEnv := func(name string) (value string, ok bool) {
+			value, ok = env[name]
+			return
+		}
+
+		It("should set fields from environment variables", func() {
+			env["LOGBOOK_AUTH_USER"] = "envuser"
+			env["LOGBOOK_PAGINATION_PERPAGE"] = "5"
+			env["LOGBOOK_SERVER_TLS_CLIENTCA"] = "ca.pem"
+			env["LOGBOOK_SERVER_TLS_CLIENTS"] = "billing=billing,billing-worker;ops=*"
+
+			Expect(applyConfigOverrides(&conf, lookupEnv, flagValues)).To(Succeed())
+
+			Expect(conf.Auth.User).To(Equal("envuser"))
+			Expect(conf.Pagination.PerPage).To(Equal(5))
+			Expect(conf.Server.TLS.ClientCA).To(Equal("ca.pem"))
+			Expect(conf.Server.TLS.Clients).To(Equal(map[string][]string{
+				"billing": []string{"billing", "billing-worker"},
+				"ops":     []string{"*"},
+			}))
+		})
+
+		It("should set fields from flags", func() {
+			flagValues["server.port"] = "12345"
+
+			Expect(applyConfigOverrides(&conf, lookupEnv, flagValues)).To(Succeed())
+
+			Expect(conf.Server.Port).To(Equal("12345"))
+		})
+
+		It("should prefer flags to environment variables", func() {
+			env["LOGBOOK_AUTH_USER"] = "envuser"
+			flagValues["auth.user"] = "flaguser"
+
+			Expect(applyConfigOverrides(&conf, lookupEnv, flagValues)).To(Succeed())
+
+			Expect(conf.Auth.User).To(Equal("flaguser"))
+		})
+
+		It("should keep fields that aren't overridden", func() {
+			Expect(applyConfigOverrides(&conf, lookupEnv, flagValues)).To(Succeed())
+
+			Expect(conf.Auth.User).To(Equal("fileuser"))
+		})
+
+		It("should fail on invalid value", func() {
+			env["LOGBOOK_PAGINATION_PERPAGE"] = "many"
+
+			Expect(applyConfigOverrides(&conf, lookupEnv, flagValues)).NotTo(Succeed())
+		})
+	})
+
+	Describe("buildConfig", func() {
+		var savedConfigPath string
+
+		BeforeEach(func() {
+			savedConfigPath = configPath
+			configPath = "/nonexistent/logbook.yml"
+		})
+
+		AfterEach(func() {
+			configPath = savedConfigPath
+			configPathRequired = false
+		})
+
+		It("should use defaults when config file is missing", func() {
+			conf, err := buildConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf).To(Equal(defaultConfig()))
+		})
+
+		Context("when config file is specified explicitly", func() {
+			BeforeEach(func() {
+				configPathRequired = true
+			})
+
+			It("should fail when config file is missing", func() {
+				_, err := buildConfig()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("buildStorageConfig", func() {
+		var (
+			savedConfigPath string
+			configFile      string
+		)
+
+		BeforeEach(func() {
+			savedConfigPath = configPath
+
+			f, err := ioutil.TempFile("", "logbook_config")
+			Expect(err).NotTo(HaveOccurred())
+			configFile = f.Name()
+			f.Close()
+
+			configPath = configFile
+		})
+
+		AfterEach(func() {
+			configPath = savedConfigPath
+			os.Remove(configFile)
+		})
+
+		It("should ignore sections other than database", func() {
+			Expect(ioutil.WriteFile(configFile, []byte("database:\n  path: other.db\nserver:\n  port: invalid\n"), 0600)).To(Succeed())
+
+			conf, err := buildStorageConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Database.Path).To(Equal("other.db"))
+		})
+
+		It("should fail when database section is invalid", func() {
+			Expect(ioutil.WriteFile(configFile, []byte("database:\n  driver: unknown\n"), 0600)).To(Succeed())
+
+			_, err := buildStorageConfig()
+			Expect(err).To(MatchError(ContainSubstring("database.driver")))
+		})
+	})
+})
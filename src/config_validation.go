@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConfigError describes an invalid config value addressed by its path in the
+// config file
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs)+1)
+	lines[0] = "Invalid config:"
+	for i, err := range errs {
+		lines[i+1] = "  " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs *ConfigErrors) add(path, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{path, fmt.Sprintf(format, args...)})
+}
+
+func (errs *ConfigErrors) checkFile(path, filePath string) {
+	if _, err := os.Stat(absPathToFile(filePath)); err != nil {
+		errs.add(path, "can't access file: %v", err)
+	}
+}
+
+// validateConfig checks every config value and returns all found errors
+func validateConfig(conf *Config) (errs ConfigErrors) {
+	if conf.Auth.User == "" {
+		errs.add("auth.user", "should be defined")
+	}
+
+	if conf.Auth.Password == "" {
+		errs.add("auth.password", "should be defined")
+	}
+
+	if port, err := strconv.Atoi(conf.Server.Port); err != nil || port < 1 || port > 65535 {
+		errs.add("server.port", "should be a number between 1 and 65535, got %q", conf.Server.Port)
+	}
+
+	if conf.Server.ShutdownTimeout < 0 {
+		errs.add("server.shutdownTimeout", "shouldn't be negative, got %d", conf.Server.ShutdownTimeout)
+	}
+
+	tls := conf.Server.TLS
+
+	switch {
+	case tls.Cert != "" && tls.Key == "":
+		errs.add("server.tls.key", "should be defined when server.tls.cert is defined")
+	case tls.Cert == "" && tls.Key != "":
+		errs.add("server.tls.cert", "should be defined when server.tls.key is defined")
+	case tls.Cert != "":
+		errs.checkFile("server.tls.cert", tls.Cert)
+		errs.checkFile("server.tls.key", tls.Key)
+	}
+
+	if tls.ClientCA != "" {
+		if tls.Cert == "" {
+			errs.add("server.tls.clientCA", "requires server.tls.cert and server.tls.key to be defined")
+		} else {
+			errs.checkFile("server.tls.clientCA", tls.ClientCA)
+		}
+	}
+
+	for commonName, apps := range tls.Clients {
+		if len(apps) == 0 {
+			errs.add("server.tls.clients."+commonName, "should contain at least one application")
+		}
+	}
+
+	errs = append(errs, validateStorageConfig(conf)...)
+
+	if conf.Pagination.PerPage < 1 {
+		errs.add("pagination.perPage", "should be greater or equal to 1, got %d", conf.Pagination.PerPage)
+	}
+
+	if (conf.Syslog.UDP != "" || conf.Syslog.TCP != "") && conf.Syslog.Application == "" {
+		errs.add("syslog.application", "should be defined when syslog input is enabled")
+	}
+
+	if (conf.GELF.UDP != "" || conf.GELF.TCP != "") && conf.GELF.Application == "" {
+		errs.add("gelf.application", "should be defined when GELF input is enabled")
+	}
+
+	if conf.TCP.TLS && tls.Cert == "" {
+		errs.add("tcp.tls", "requires server.tls.cert and server.tls.key to be defined")
+	}
+
+	if conf.Backup.Dir != "" && conf.Database.Driver != "bolt" {
+		errs.add("backup.dir", "is supported only by bolt driver")
+	}
+
+	if conf.Backup.Dir != "" {
+		if conf.Backup.Interval < 1 {
+			errs.add("backup.interval", "should be greater or equal to 1, got %d", conf.Backup.Interval)
+		}
+
+		if conf.Backup.Keep < 1 {
+			errs.add("backup.keep", "should be greater or equal to 1, got %d", conf.Backup.Keep)
+		}
+	}
+
+	if conf.Journal.Path != "" {
+		if conf.Journal.BufferSize < 1 {
+			errs.add("journal.bufferSize", "should be greater or equal to 1, got %d", conf.Journal.BufferSize)
+		}
+
+		if conf.Journal.FlushInterval < 1 {
+			errs.add("journal.flushInterval", "should be greater or equal to 1, got %d", conf.Journal.FlushInterval)
+		}
+
+		if !journalSyncPolicies[conf.Journal.Sync] {
+			errs.add("journal.sync", "should be one of none, write, interval, got %q", conf.Journal.Sync)
+		}
+
+		if conf.Journal.Sync == "interval" && conf.Journal.SyncInterval < 1 {
+			errs.add("journal.syncInterval", "should be greater or equal to 1, got %d", conf.Journal.SyncInterval)
+		}
+	}
+
+	if conf.Metrics.MaxApplications < 0 {
+		errs.add("metrics.maxApplications", "shouldn't be negative, got %d", conf.Metrics.MaxApplications)
+	}
+
+	if conf.Archive.Dir != "" && conf.Database.Driver != "bolt" {
+		errs.add("archive.dir", "is supported only by bolt driver")
+	}
+
+	if conf.Archive.Dir != "" {
+		if conf.Archive.After < 1 {
+			errs.add("archive.after", "should be greater or equal to 1, got %d", conf.Archive.After)
+		}
+
+		if conf.Archive.Interval < 1 {
+			errs.add("archive.interval", "should be greater or equal to 1, got %d", conf.Archive.Interval)
+		}
+	}
+
+	return
+}
+
+// validateStorageConfig checks the database section. The commands that take
+// paths from config check only this section.
+func validateStorageConfig(conf *Config) (errs ConfigErrors) {
+	if _, ok := storageDrivers[conf.Database.Driver]; !ok {
+		errs.add("database.driver", "should be one of bolt, memory, leveldb, got %q", conf.Database.Driver)
+	}
+
+	if conf.Database.Driver == "leveldb" {
+		if conf.Database.LevelDB.Path == "" {
+			errs.add("database.leveldb.path", "should be defined")
+		}
+
+		if conf.Database.LevelDB.WriteBuffer < 1 {
+			errs.add("database.leveldb.writeBuffer", "should be greater or equal to 1, got %d", conf.Database.LevelDB.WriteBuffer)
+		}
+	}
+
+	if conf.Database.Path == "" && conf.Database.Driver == "bolt" {
+		errs.add("database.path", "should be defined")
+	}
+
+	compression := conf.Database.Compression
+
+	if _, ok := compressionCodecs[compression.Codec]; !ok {
+		errs.add("database.compression.codec", "should be one of none, snappy, zstd, got %q", compression.Codec)
+	}
+
+	if compressionCodecs[compression.Codec] != 0 && conf.Database.Driver != "bolt" {
+		errs.add("database.compression.codec", "is supported only by bolt driver")
+	}
+
+	if compression.Codec == "zstd" && compression.Dictionary {
+		if compression.Samples < 1 {
+			errs.add("database.compression.samples", "should be greater or equal to 1, got %d", compression.Samples)
+		}
+
+		if compression.RetrainInterval < 0 {
+			errs.add("database.compression.retrainInterval", "shouldn't be negative, got %d", compression.RetrainInterval)
+		}
+	}
+
+	shards := conf.Database.Shards
+
+	if shards.Period != "" && conf.Database.Driver != "bolt" {
+		errs.add("database.shards.period", "is supported only by bolt driver")
+	}
+
+	if _, ok := shardPeriodFormats[shards.Period]; shards.Period != "" && !ok {
+		errs.add("database.shards.period", "should be one of day, month, year, got %q", shards.Period)
+	}
+
+	if shards.Period != "" && shards.Dir == "" {
+		errs.add("database.shards.dir", "should be defined when sharding is enabled")
+	}
+
+	if shards.ArchiveDir != "" && absPathToFile(shards.ArchiveDir) == absPathToFile(shards.Dir) {
+		errs.add("database.shards.archiveDir", "should differ from database.shards.dir")
+	}
+
+	if shards.Period != "" {
+		if shards.MaxOpen < 1 {
+			errs.add("database.shards.maxOpen", "should be greater or equal to 1, got %d", shards.MaxOpen)
+		}
+
+		if shards.IdleTimeout < 0 {
+			errs.add("database.shards.idleTimeout", "shouldn't be negative, got %d", shards.IdleTimeout)
+		}
+
+		if shards.MaxSkew < 0 {
+			errs.add("database.shards.maxSkew", "shouldn't be negative, got %d", shards.MaxSkew)
+		}
+	}
+
+	return
+}
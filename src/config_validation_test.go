@@ -0,0 +1,189 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config validation", func() {
+	var conf Config
+
+	BeforeEach(func() {
+		conf = defaultConfig()
+		conf.Auth.User = "user"
+		conf.Auth.Password = "password"
+	})
+
+	errorPaths := func(errs ConfigErrors) (paths []string) {
+		for _, err := range errs {
+			paths = append(paths, err.Path)
+		}
+		return
+	}
+
+	It("should accept valid config", func() {
+		Expect(validateConfig(&conf)).To(BeEmpty())
+	})
+
+	It("should report every invalid field with its path", func() {
+		conf.Auth.User = ""
+		conf.Server.Port = "port"
+		conf.Pagination.PerPage = 0
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"auth.user", "server.port", "pagination.perPage",
+		))
+	})
+
+	It("should require TLS key when TLS cert is defined", func() {
+		conf.Server.TLS.Cert = "/nonexistent/server.crt"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("server.tls.key"))
+	})
+
+	It("should check that TLS files exist", func() {
+		conf.Server.TLS.Cert = "/nonexistent/server.crt"
+		conf.Server.TLS.Key = "/nonexistent/server.key"
+		conf.Server.TLS.ClientCA = "/nonexistent/ca.crt"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"server.tls.cert", "server.tls.key", "server.tls.clientCA",
+		))
+	})
+
+	It("should require TLS cert for client CA", func() {
+		conf.Server.TLS.ClientCA = "/nonexistent/ca.crt"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("server.tls.clientCA"))
+	})
+
+	It("should check backup schedule when backups are enabled", func() {
+		conf.Backup.Interval = 0
+		conf.Backup.Keep = 0
+
+		Expect(validateConfig(&conf)).To(BeEmpty())
+
+		conf.Backup.Dir = "/var/backups/logbook"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("backup.interval", "backup.keep"))
+	})
+
+	It("should check journal options when journal is enabled", func() {
+		conf.Journal.BufferSize = 0
+		conf.Journal.FlushInterval = 0
+
+		Expect(validateConfig(&conf)).To(BeEmpty())
+
+		conf.Journal.Path = "../db/logbook.journal"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("journal.bufferSize", "journal.flushInterval"))
+	})
+
+	It("should check journal sync options", func() {
+		conf.Journal.Path = "../db/logbook.journal"
+		conf.Journal.Sync = "always"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("journal.sync"))
+
+		conf.Journal.Sync = "interval"
+		conf.Journal.SyncInterval = 0
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("journal.syncInterval"))
+	})
+
+	It("should check archive options when archiving is enabled", func() {
+		conf.Archive.After = 0
+		conf.Archive.Interval = 0
+
+		Expect(validateConfig(&conf)).To(BeEmpty())
+
+		conf.Archive.Dir = "/var/lib/logbook/archive"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("archive.after", "archive.interval"))
+
+		conf.Archive.After = 90
+		conf.Archive.Interval = 1440
+		conf.Database.Driver = "memory"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("archive.dir"))
+	})
+
+	It("should check shards config", func() {
+		conf.Database.Shards.Period = "week"
+		conf.Database.Shards.Dir = ""
+		conf.Database.Shards.ArchiveDir = "../db/shards"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"database.shards.period", "database.shards.dir",
+		))
+
+		conf.Database.Shards.Period = "day"
+		conf.Database.Shards.Dir = "../db/shards"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("database.shards.archiveDir"))
+
+		conf.Database.Shards.ArchiveDir = ""
+		conf.Database.Shards.MaxOpen = 0
+		conf.Database.Shards.IdleTimeout = -1
+		conf.Database.Shards.MaxSkew = -1
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"database.shards.maxOpen", "database.shards.idleTimeout", "database.shards.maxSkew",
+		))
+	})
+
+	It("should check database driver", func() {
+		conf.Database.Driver = "sqlite"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("database.driver"))
+
+		conf.Database.Driver = "memory"
+		conf.Database.Path = ""
+		conf.Database.Shards.Period = "day"
+		conf.Backup.Dir = "/var/backups/logbook"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("database.shards.period", "backup.dir"))
+	})
+
+	It("should check LevelDB options when LevelDB driver is used", func() {
+		conf.Database.LevelDB.Path = ""
+		conf.Database.LevelDB.WriteBuffer = 0
+
+		Expect(validateConfig(&conf)).To(BeEmpty())
+
+		conf.Database.Driver = "leveldb"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"database.leveldb.path", "database.leveldb.writeBuffer",
+		))
+	})
+
+	It("should check compression options", func() {
+		conf.Database.Compression.Codec = "gzip"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("database.compression.codec"))
+
+		conf.Database.Compression.Codec = "zstd"
+		conf.Database.Compression.Samples = 0
+		conf.Database.Compression.RetrainInterval = -1
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf(
+			"database.compression.samples", "database.compression.retrainInterval",
+		))
+
+		conf.Database.Compression.Dictionary = false
+		conf.Database.Driver = "leveldb"
+
+		Expect(errorPaths(validateConfig(&conf))).To(ConsistOf("database.compression.codec"))
+	})
+
+	It("should describe all errors in error message", func() {
+		conf.Auth.User = ""
+		conf.Pagination.PerPage = 0
+
+		message := validateConfig(&conf).Error()
+
+		Expect(message).To(ContainSubstring("auth.user: should be defined"))
+		Expect(message).To(ContainSubstring("pagination.perPage: should be greater or equal to 1, got 0"))
+	})
+})
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RecordProblem is an integrity problem of a record bucket
+type RecordProblem struct {
+	Application string
+	Key         string
+	Problem     string
+}
+
+func (p RecordProblem) String() string {
+	return fmt.Sprintf("%s/%s: %s", p.Application, p.Key, p.Problem)
+}
+
+// forEachRecordBucket calls fn for every record bucket of the application
+// with key between keyStart and keyEnd. Nil keys mean no bounds.
+func forEachRecordBucket(appBucket *bolt.Bucket, keyStart, keyEnd []byte, fn func(key []byte, recordBucket *bolt.Bucket) error) error {
+	cursor := appBucket.Cursor()
+
+	key, value := cursor.First()
+	if keyStart != nil {
+		key, value = cursor.Seek(keyStart)
+	}
+
+	for ; key != nil; key, value = cursor.Next() {
+		if keyEnd != nil && bytes.Compare(key, keyEnd) > 0 {
+			break
+		}
+
+		// record buckets have nil values
+		if value != nil || bytes.Equal(key, traceIndexBucket) {
+			continue
+		}
+
+		if err := fn(key, appBucket.Bucket(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countLogRecords returns the number of records of the application
+func countLogRecords(application string) (count int, err error) {
+	err = viewDB(func(tx *bolt.Tx) error {
+		appBucket := tx.Bucket([]byte(application))
+		if appBucket == nil {
+			return nil
+		}
+
+		return forEachRecordBucket(appBucket, nil, nil, func(_ []byte, _ *bolt.Bucket) error {
+			count++
+			return nil
+		})
+	})
+
+	return
+}
+
+// dumpLogRecords calls fn for every record of the application created
+// between startTime and endTime. Zero times mean no bounds.
+func dumpLogRecords(application string, startTime, endTime time.Time, fn func(LogRecord) error) error {
+	var keyStart, keyEnd []byte
+
+	if !startTime.IsZero() {
+		keyStart = recordKey(startTime, "")
+	}
+	if !endTime.IsZero() {
+		keyEnd = recordKey(endTime, "_")
+	}
+
+	return viewDB(func(tx *bolt.Tx) error {
+		appBucket := tx.Bucket([]byte(application))
+		if appBucket == nil {
+			return nil
+		}
+
+		return forEachRecordBucket(appBucket, keyStart, keyEnd, func(_ []byte, recordBucket *bolt.Bucket) error {
+			data, err := recordValue(recordBucket)
+			if err != nil || data == nil {
+				return err
+			}
+
+			var logRecord LogRecord
+			if err := bson.Unmarshal(data, &logRecord); err != nil {
+				return err
+			}
+
+			return fn(logRecord)
+		})
+	})
+}
+
+// verifyLogRecords checks every record bucket of the applications and calls
+// fn for every problem found. It returns the number of checked records.
+func verifyLogRecords(applications []string, fn func(RecordProblem)) (checked int, err error) {
+	err = viewDB(func(tx *bolt.Tx) error {
+		for _, application := range applications {
+			appBucket := tx.Bucket([]byte(application))
+			if appBucket == nil {
+				continue
+			}
+
+			err := forEachRecordBucket(appBucket, nil, nil, func(key []byte, recordBucket *bolt.Bucket) error {
+				checked++
+
+				if problem := checkRecordBucket(recordBucket); len(problem) > 0 {
+					fn(RecordProblem{application, string(key), problem})
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// checkRecordBucket returns description of the record bucket problem or an
+// empty string if the bucket is fine
+func checkRecordBucket(recordBucket *bolt.Bucket) string {
+	data, err := recordValue(recordBucket)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("record can't be decompressed (%v)", err)
+	case data == nil:
+		return "record is missing"
+	}
+
+	var logRecord LogRecord
+	if err := bson.Unmarshal(data, &logRecord); err != nil {
+		return fmt.Sprintf("record can't be decoded (%v)", err)
+	}
+
+	level := recordBucket.Get([]byte("level"))
+	switch {
+	case level == nil:
+		return "level is missing"
+	case len(level) != 1 || int(level[0]) != logRecord.Level:
+		return fmt.Sprintf("level %v doesn't match record level %d", level, logRecord.Level)
+	}
+
+	return ""
+}
+
+// migrateBoltFile copies records of every application of the Bolt file to
+// the storage by batches of batchSize records. Records that can't be decoded
+// are skipped. It returns the numbers of migrated and skipped records.
+func migrateBoltFile(path string, dst Storage, batchSize int) (migrated, skipped int, err error) {
+	src, err := openBoltReadOnly(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	batch := make([]ApplicationLogRecord, 0, batchSize)
+
+	flush := func() error {
+		if err := dst.Save(batch); err != nil {
+			return err
+		}
+
+		migrated += len(batch)
+		batch = batch[:0]
+
+		return nil
+	}
+
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, appBucket *bolt.Bucket) error {
+			if isServiceBucket(name) {
+				return nil
+			}
+
+			application := string(name)
+
+			return forEachRecordBucket(appBucket, nil, nil, func(_ []byte, recordBucket *bolt.Bucket) error {
+				data, err := recordValue(recordBucket)
+				if err != nil || data == nil {
+					skipped++
+					return nil
+				}
+
+				logRecord := new(LogRecord)
+				if err := bson.Unmarshal(data, logRecord); err != nil {
+					skipped++
+					return nil
+				}
+
+				batch = append(batch, ApplicationLogRecord{application, logRecord})
+
+				if len(batch) == batchSize {
+					return flush()
+				}
+
+				return nil
+			})
+		})
+	})
+
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+
+	return
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DB inspection", func() {
+	now := time.Now()
+
+	BeforeEach(func() {
+		saveTestLogRecord("testapp1", "Message 1", 1, now.Add(-2*time.Hour))
+		saveTestLogRecord("testapp1", "Message 2", 2, now.Add(-time.Hour))
+		saveTestLogRecord("testapp1", "Message 3", 3, now)
+		saveTestLogRecord("testapp2", "Message 4", 4, now)
+	})
+
+	Describe("countLogRecords", func() {
+		It("should count records without trace index", func() {
+			Expect(countLogRecords("testapp1")).To(Equal(3))
+			Expect(countLogRecords("testapp2")).To(Equal(1))
+			Expect(countLogRecords("unknown")).To(Equal(0))
+		})
+	})
+
+	Describe("dumpLogRecords", func() {
+		dump := func(startTime, endTime time.Time) (messages []string) {
+			err := dumpLogRecords("testapp1", startTime, endTime, func(logRecord LogRecord) error {
+				messages = append(messages, logRecord.Message)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return
+		}
+
+		It("should dump all records", func() {
+			Expect(dump(time.Time{}, time.Time{})).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+		})
+
+		It("should dump records in the time range", func() {
+			Expect(dump(now.Add(-90*time.Minute), now.Add(-30*time.Minute))).To(Equal([]string{"Message 2"}))
+		})
+	})
+
+	Describe("verifyLogRecords", func() {
+		corrupt := func(application string, fn func(recordBucket *bolt.Bucket) error) {
+			Expect(db.Update(func(tx *bolt.Tx) error {
+				appBucket := tx.Bucket([]byte(application))
+				key, _ := appBucket.Cursor().First()
+				return fn(appBucket.Bucket(key))
+			})).To(Succeed())
+		}
+
+		verify := func() (checked int, problems []string) {
+			checked, err := verifyLogRecords([]string{"testapp1", "testapp2"}, func(problem RecordProblem) {
+				problems = append(problems, problem.Problem)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return
+		}
+
+		It("should not find problems in valid records", func() {
+			checked, problems := verify()
+			Expect(checked).To(Equal(4))
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("should find missing record", func() {
+			corrupt("testapp1", func(recordBucket *bolt.Bucket) error {
+				return recordBucket.Delete([]byte("record"))
+			})
+
+			_, problems := verify()
+			Expect(problems).To(Equal([]string{"record is missing"}))
+		})
+
+		It("should find undecodable record", func() {
+			corrupt("testapp1", func(recordBucket *bolt.Bucket) error {
+				return recordBucket.Put([]byte("record"), []byte("garbage"))
+			})
+
+			_, problems := verify()
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0]).To(HavePrefix("record can't be decoded"))
+		})
+
+		It("should find level mismatch", func() {
+			corrupt("testapp2", func(recordBucket *bolt.Bucket) error {
+				return recordBucket.Put([]byte("level"), []byte{1})
+			})
+
+			_, problems := verify()
+			Expect(problems).To(Equal([]string{"level [1] doesn't match record level 4"}))
+		})
+	})
+
+	Describe("runDBCommand", func() {
+		var (
+			out     *syncBuffer
+			dir     string
+			suiteDB *bolt.DB
+		)
+
+		BeforeEach(func() {
+			out = &syncBuffer{}
+
+			var err error
+			dir, err = ioutil.TempDir("", "logbook-db-inspect")
+			Expect(err).NotTo(HaveOccurred())
+
+			suiteDB = db
+		})
+
+		AfterEach(func() {
+			db = suiteDB
+			os.RemoveAll(dir)
+		})
+
+		// copyDB copies the suite DB to the files of the directory
+		copyDB := func(names ...string) (paths []string) {
+			for _, name := range names {
+				path := filepath.Join(dir, name)
+				Expect(db.View(func(tx *bolt.Tx) error {
+					return tx.CopyFile(path, 0600)
+				})).To(Succeed())
+				paths = append(paths, path)
+			}
+			return
+		}
+
+		It("should list applications", func() {
+			Expect(runDBCommand("apps", dbOptions{paths: copyDB("logbook.db")}, out)).To(BeTrue())
+			Expect(out.String()).To(Equal("testapp1\ntestapp2\n"))
+		})
+
+		It("should count records", func() {
+			Expect(runDBCommand("count", dbOptions{paths: copyDB("logbook.db")}, out)).To(BeTrue())
+			Expect(out.String()).To(Equal("testapp1\t3\ntestapp2\t1\n"))
+		})
+
+		It("should dump records as JSON", func() {
+			Expect(runDBCommand("dump", dbOptions{paths: copyDB("logbook.db"), application: "testapp2"}, out)).To(BeTrue())
+			Expect(out.String()).To(ContainSubstring(`"message":"Message 4","level":4`))
+		})
+
+		It("should report verification problems", func() {
+			Expect(db.Update(func(tx *bolt.Tx) error {
+				appBucket := tx.Bucket([]byte("testapp2"))
+				key, _ := appBucket.Cursor().First()
+				return appBucket.Bucket(key).Delete([]byte("record"))
+			})).To(Succeed())
+
+			Expect(runDBCommand("verify", dbOptions{paths: copyDB("logbook.db")}, out)).To(BeFalse())
+			Expect(out.String()).To(ContainSubstring("testapp2/"))
+			Expect(out.String()).To(ContainSubstring("Checked 4 records, found 1 problems"))
+		})
+
+		It("should sum up results of all DB files", func() {
+			paths := copyDB("logbook.db", "shard.db")
+
+			Expect(runDBCommand("apps", dbOptions{paths: paths}, out)).To(BeTrue())
+			Expect(runDBCommand("count", dbOptions{paths: paths}, out)).To(BeTrue())
+			Expect(runDBCommand("verify", dbOptions{paths: paths}, out)).To(BeTrue())
+
+			Expect(out.String()).To(Equal(
+				"testapp1\ntestapp2\n" +
+					"testapp1\t6\ntestapp2\t2\n" +
+					"Checked 8 records, found 0 problems\n",
+			))
+		})
+
+		It("should fail when DB file can't be opened", func() {
+			_, err := runDBCommand("apps", dbOptions{paths: []string{filepath.Join(dir, "missing", "logbook.db")}}, out)
+			Expect(err).To(MatchError(HavePrefix("Can't open")))
+		})
+	})
+})
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const forwardInputName = "Forward"
+
+var (
+	forwardMessageKeys = []string{"message", "log", "msg"}
+	forwardLevelKeys   = []string{"level", "severity"}
+)
+
+// fluentEventTime is EventTime extension of the Forward protocol
+type fluentEventTime time.Time
+
+func init() {
+	msgpack.RegisterExt(0, (*fluentEventTime)(nil))
+}
+
+func (t *fluentEventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(time.Time(*t).Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(time.Time(*t).Nanosecond()))
+	return b, nil
+}
+
+func (t *fluentEventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return errors.New("Invalid EventTime length")
+	}
+
+	*t = fluentEventTime(time.Unix(
+		int64(binary.BigEndian.Uint32(b)),
+		int64(binary.BigEndian.Uint32(b[4:])),
+	))
+
+	return nil
+}
+
+func startForwardInput() {
+	if len(config.Forward.Address) > 0 {
+		serveTCP(forwardInputName, config.Forward.Address, func(conn net.Conn) {
+			handleForwardConnection(conn)
+		})
+	}
+}
+
+// handleForwardConnection reads Forward protocol messages in Message, Forward,
+// PackedForward and CompressedPackedForward modes. Entries of every message
+// are saved in a single batch and acknowledged if the client asks for it.
+func handleForwardConnection(conn io.ReadWriter) {
+	decoder := msgpack.NewDecoder(bufio.NewReader(conn))
+	decoder.UseLooseInterfaceDecoding(true)
+
+	encoder := msgpack.NewEncoder(conn)
+
+	for {
+		msg, err := decoder.DecodeInterface()
+		if err != nil {
+			if err != io.EOF {
+				logInputError(forwardInputName, err)
+			}
+			return
+		}
+
+		records, option, err := parseForwardMessage(msg)
+		if err != nil {
+			logInputError(forwardInputName, err)
+			return
+		}
+
+		if len(records) > 0 {
+			if err = saveLogRecords(records); err != nil {
+				logInputError(forwardInputName, err)
+				// don't ack, so the client will retry
+				return
+			}
+		}
+
+		if chunk, ok := option["chunk"]; ok {
+			if err = encoder.Encode(map[string]interface{}{"ack": chunk}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func parseForwardMessage(msg interface{}) (records []ApplicationLogRecord, option map[string]interface{}, err error) {
+	arr, ok := msg.([]interface{})
+	if !ok || len(arr) < 2 {
+		err = errors.New("Message should be an array")
+		return
+	}
+
+	application, ok := arr[0].(string)
+	if !ok {
+		err = errors.New("Tag should be a string")
+		return
+	}
+
+	switch entries := arr[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		option, _ = forwardOption(arr, 2)
+
+		for _, entry := range entries {
+			entryArr, ok := entry.([]interface{})
+			if !ok || len(entryArr) < 2 {
+				err = errors.New("Entry should be an array of time and record")
+				return
+			}
+
+			records, err = appendForwardEntry(records, application, entryArr[0], entryArr[1])
+			if err != nil {
+				return
+			}
+		}
+
+	case string:
+		// PackedForward mode: [tag, msgpack stream of entries, option]
+		option, _ = forwardOption(arr, 2)
+		records, err = parsePackedForwardEntries(application, []byte(entries), option)
+
+	case []byte:
+		option, _ = forwardOption(arr, 2)
+		records, err = parsePackedForwardEntries(application, entries, option)
+
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(arr) < 3 {
+			err = errors.New("Message should contain time and record")
+			return
+		}
+
+		option, _ = forwardOption(arr, 3)
+
+		records, err = appendForwardEntry(records, application, arr[1], arr[2])
+	}
+
+	return
+}
+
+func forwardOption(arr []interface{}, i int) (option map[string]interface{}, ok bool) {
+	if len(arr) > i {
+		option, ok = arr[i].(map[string]interface{})
+	}
+	return
+}
+
+func parsePackedForwardEntries(application string, packed []byte, option map[string]interface{}) (records []ApplicationLogRecord, err error) {
+	var stream io.Reader = bytes.NewReader(packed)
+
+	// CompressedPackedForward mode
+	if option["compressed"] == "gzip" {
+		if stream, err = gzip.NewReader(stream); err != nil {
+			return
+		}
+	}
+
+	decoder := msgpack.NewDecoder(stream)
+	decoder.UseLooseInterfaceDecoding(true)
+
+	for {
+		var entry interface{}
+
+		if entry, err = decoder.DecodeInterface(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		entryArr, ok := entry.([]interface{})
+		if !ok || len(entryArr) < 2 {
+			err = errors.New("Entry should be an array of time and record")
+			return
+		}
+
+		if records, err = appendForwardEntry(records, application, entryArr[0], entryArr[1]); err != nil {
+			return
+		}
+	}
+}
+
+func appendForwardEntry(records []ApplicationLogRecord, application string, eventTime, record interface{}) ([]ApplicationLogRecord, error) {
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return records, errors.New("Record should be a map")
+	}
+
+	logRecord := forwardRecordToLogRecord(fields)
+
+	switch t := eventTime.(type) {
+	case *fluentEventTime:
+		logRecord.CreatedAt = time.Time(*t)
+	case int64:
+		logRecord.CreatedAt = time.Unix(t, 0)
+	case uint64:
+		logRecord.CreatedAt = time.Unix(int64(t), 0)
+	default:
+		return records, errors.New("Invalid event time")
+	}
+
+	if err := checkInputRecord(application, logRecord); err != nil {
+		// skip invalid record but keep the rest of the chunk
+		logInputError(forwardInputName, err)
+		return records, nil
+	}
+
+	return append(records, ApplicationLogRecord{application, logRecord}), nil
+}
+
+// forwardRecordToLogRecord takes message and level from the well-known fields
+// and turns the rest of scalar fields into "name=value" tags
+func forwardRecordToLogRecord(fields map[string]interface{}) *LogRecord {
+	logRecord := &LogRecord{Level: levelNames["info"], Tags: []string{}}
+
+	used := make(map[string]bool)
+
+	for _, key := range forwardMessageKeys {
+		if value, ok := forwardScalar(fields[key]); ok {
+			logRecord.Message = value
+			used[key] = true
+			break
+		}
+	}
+
+	for _, key := range forwardLevelKeys {
+		value, ok := forwardScalar(fields[key])
+		if !ok {
+			continue
+		}
+
+		if level, known := levelNames[strings.ToLower(value)]; known {
+			logRecord.Level = level
+		} else if level, err := strconv.Atoi(value); err == nil && level >= 0 && level <= 5 {
+			logRecord.Level = level
+		} else {
+			continue
+		}
+
+		used[key] = true
+		break
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if value, ok := forwardScalar(fields[name]); ok && value != "" {
+			logRecord.Tags = append(logRecord.Tags, name+"="+value)
+		}
+	}
+
+	logRecord.Tags = uniqStrings(logRecord.Tags)
+
+	return logRecord
+}
+
+func forwardScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(bytes.TrimRight(v, "\n")), true
+	case int64, uint64, float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Forward input", func() {
+	eventTime := time.Unix(1500000000, 123000000)
+
+	entry := func(message string) []interface{} {
+		t := fluentEventTime(eventTime)
+		return []interface{}{&t, map[string]interface{}{
+			"log":       message,
+			"level":     "error",
+			"container": "web",
+		}}
+	}
+
+	packEntries := func(entries ...[]interface{}) []byte {
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		for _, e := range entries {
+			Expect(encoder.Encode(e)).To(Succeed())
+		}
+		return buf.Bytes()
+	}
+
+	loadForwardRecords := func() LogRecords {
+		logRecords, err := loadLogRecords("fwdapp", 0, []string{},
+			eventTime.Add(-time.Second), eventTime.Add(time.Second), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	// send writes the message to the connection handler and returns
+	// the decoded response if ack is expected
+	send := func(message []interface{}, expectAck bool) (ack map[string]interface{}) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			handleForwardConnection(server)
+			server.Close()
+		}()
+
+		Expect(msgpack.NewEncoder(client).Encode(message)).To(Succeed())
+
+		if expectAck {
+			Expect(msgpack.NewDecoder(client).Decode(&ack)).To(Succeed())
+		}
+
+		client.Close()
+		Eventually(done).Should(BeClosed())
+
+		return
+	}
+
+	It("should save record sent in Message mode", func() {
+		send(append([]interface{}{"fwdapp"}, entry("Message one")...), false)
+
+		logRecords := loadForwardRecords()
+		Expect(logRecords).To(HaveLen(1))
+		Expect(logRecords[0].Message).To(Equal("Message one"))
+		Expect(logRecords[0].Level).To(Equal(4))
+		Expect(logRecords[0].Tags).To(ConsistOf("container=web"))
+		Expect(logRecords[0].CreatedAt.Equal(eventTime)).To(BeTrue())
+	})
+
+	It("should save records sent in Forward mode", func() {
+		send([]interface{}{"fwdapp", []interface{}{entry("Message one"), entry("Message two")}}, false)
+
+		Expect(loadForwardRecords()).To(HaveLen(2))
+	})
+
+	It("should save records sent in PackedForward mode", func() {
+		send([]interface{}{"fwdapp", packEntries(entry("Message one"), entry("Message two"))}, false)
+
+		Expect(loadForwardRecords()).To(HaveLen(2))
+	})
+
+	It("should save records sent in CompressedPackedForward mode", func() {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(packEntries(entry("Message one"), entry("Message two")))
+		w.Close()
+
+		send([]interface{}{
+			"fwdapp", buf.Bytes(), map[string]interface{}{"compressed": "gzip"},
+		}, false)
+
+		Expect(loadForwardRecords()).To(HaveLen(2))
+	})
+
+	It("should acknowledge chunk", func() {
+		ack := send([]interface{}{
+			"fwdapp",
+			[]interface{}{entry("Message one")},
+			map[string]interface{}{"chunk": "p8n9gmxTQVC8/nh2wlKKeQ=="},
+		}, true)
+
+		Expect(ack).To(HaveKeyWithValue("ack", "p8n9gmxTQVC8/nh2wlKKeQ=="))
+		Expect(loadForwardRecords()).To(HaveLen(1))
+	})
+
+	Describe("forwardRecordToLogRecord", func() {
+		It("should accept numeric level", func() {
+			logRecord := forwardRecordToLogRecord(map[string]interface{}{
+				"message": "Message one",
+				"level":   int64(3),
+			})
+
+			Expect(logRecord.Message).To(Equal("Message one"))
+			Expect(logRecord.Level).To(Equal(3))
+			Expect(logRecord.Tags).To(BeEmpty())
+		})
+
+		It("should keep unknown level as tag", func() {
+			logRecord := forwardRecordToLogRecord(map[string]interface{}{
+				"message": "Message one",
+				"level":   "verbose",
+			})
+
+			Expect(logRecord.Level).To(Equal(1))
+			Expect(logRecord.Tags).To(ConsistOf("level=verbose"))
+		})
+	})
+})
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gelfInputName = "GELF"
+
+	gelfMaxChunks    = 128
+	gelfChunkTimeout = 5 * time.Second
+	gelfMaxSize      = 8 * 1024 * 1024
+
+	// maximum number of chunked messages being received at once
+	gelfMaxChunkedMessages = 1024
+	// how often incomplete chunked messages are expired
+	gelfChunksExpireInterval = time.Second
+
+	// default level according to GELF spec
+	gelfDefaultLevel = 1
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	createdAt time.Time
+}
+
+var (
+	gelfChunkedMessages     = make(map[string]*gelfChunkedMessage)
+	gelfChunkedMessagesLock sync.Mutex
+
+	gelfChunksExpirerStop    chan struct{}
+	gelfChunksExpirerRunning sync.WaitGroup
+)
+
+func startGELFInputs() {
+	if len(config.GELF.UDP) > 0 {
+		serveUDP(gelfInputName, config.GELF.UDP, handleGELFDatagram)
+		startGELFChunksExpirer()
+	}
+
+	if len(config.GELF.TCP) > 0 {
+		serveTCP(gelfInputName, config.GELF.TCP, func(conn net.Conn) {
+			handleGELFStream(conn)
+		})
+	}
+}
+
+func stopGELFInputs() {
+	if gelfChunksExpirerStop != nil {
+		close(gelfChunksExpirerStop)
+		gelfChunksExpirerRunning.Wait()
+		gelfChunksExpirerStop = nil
+	}
+}
+
+// handleGELFStream handles null-byte delimited messages of TCP connection.
+// TCP messages can't be compressed. Reading stops on a message bigger than
+// gelfMaxSize, so the connection is dropped.
+func handleGELFStream(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), gelfMaxSize)
+	scanner.Split(scanGELFMessages)
+
+	for scanner.Scan() {
+		if data := bytes.TrimRight(scanner.Bytes(), "\r\n"); len(data) > 0 {
+			handleGELFMessage(data)
+		}
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		logInputError(gelfInputName, errors.New("Message is too large, closing connection"))
+	}
+}
+
+// scanGELFMessages is a split function for bufio.Scanner that splits data by
+// null bytes
+func scanGELFMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// startGELFChunksExpirer drops chunked messages that weren't received
+// completely in gelfChunkTimeout in the background
+func startGELFChunksExpirer() {
+	gelfChunksExpirerStop = make(chan struct{})
+	gelfChunksExpirerRunning.Add(1)
+
+	go func(stop chan struct{}) {
+		defer gelfChunksExpirerRunning.Done()
+
+		ticker := time.NewTicker(gelfChunksExpireInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				expireGELFChunks(time.Now().Add(-gelfChunkTimeout))
+			}
+		}
+	}(gelfChunksExpirerStop)
+}
+
+// expireGELFChunks drops chunked messages created before the time
+func expireGELFChunks(before time.Time) {
+	gelfChunkedMessagesLock.Lock()
+	defer gelfChunkedMessagesLock.Unlock()
+
+	for id, msg := range gelfChunkedMessages {
+		if msg.createdAt.Before(before) {
+			delete(gelfChunkedMessages, id)
+		}
+	}
+}
+
+func handleGELFDatagram(data []byte) {
+	var err error
+
+	if bytes.HasPrefix(data, gelfChunkMagic) {
+		if data, err = addGELFChunk(data); err != nil || data == nil {
+			if err != nil {
+				logInputError(gelfInputName, err)
+			}
+			return
+		}
+	}
+
+	if data, err = decompressGELF(data); err != nil {
+		logInputError(gelfInputName, err)
+		return
+	}
+
+	handleGELFMessage(data)
+}
+
+func handleGELFMessage(data []byte) {
+	application, logRecord, err := parseGELFMessage(data)
+	if err != nil {
+		logInputError(gelfInputName, err)
+		return
+	}
+
+	if application == "" {
+		application = currentConfig().GELF.Application
+	}
+
+	saveInputRecord(gelfInputName, application, &logRecord)
+}
+
+// addGELFChunk stores the chunk and returns the whole message when all its
+// chunks are received
+func addGELFChunk(chunk []byte) (data []byte, err error) {
+	// magic (2 bytes), message ID (8 bytes), sequence number, sequence count
+	if len(chunk) < 12 {
+		err = errors.New("Chunk is too short")
+		return
+	}
+
+	id := string(chunk[2:10])
+	seqNum, seqCount := int(chunk[10]), int(chunk[11])
+
+	if seqCount == 0 || seqCount > gelfMaxChunks || seqNum >= seqCount {
+		err = fmt.Errorf("Invalid chunk sequence %d/%d", seqNum, seqCount)
+		return
+	}
+
+	gelfChunkedMessagesLock.Lock()
+	defer gelfChunkedMessagesLock.Unlock()
+
+	msg, ok := gelfChunkedMessages[id]
+	if !ok {
+		if len(gelfChunkedMessages) >= gelfMaxChunkedMessages {
+			err = errors.New("Too many incomplete chunked messages")
+			return
+		}
+
+		msg = &gelfChunkedMessage{
+			chunks:    make([][]byte, seqCount),
+			createdAt: time.Now(),
+		}
+		gelfChunkedMessages[id] = msg
+	}
+
+	if len(msg.chunks) != seqCount {
+		err = errors.New("Chunk sequence count mismatch")
+		return
+	}
+
+	if msg.chunks[seqNum] == nil {
+		msg.chunks[seqNum] = chunk[12:]
+		msg.received++
+	}
+
+	if msg.received < seqCount {
+		return
+	}
+
+	delete(gelfChunkedMessages, id)
+
+	data = bytes.Join(msg.chunks, nil)
+
+	return
+}
+
+func decompressGELF(data []byte) ([]byte, error) {
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+
+	switch {
+	case len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) > 2 && data[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err = ioutil.ReadAll(io.LimitReader(reader, gelfMaxSize+1))
+	if err == nil && len(data) > gelfMaxSize {
+		err = errors.New("Decompressed message is too large")
+	}
+
+	return data, err
+}
+
+// parseGELFMessage maps GELF message onto log record. Host and additional
+// fields become "name=value" tags, except "_application" which defines the
+// application.
+func parseGELFMessage(data []byte) (application string, logRecord LogRecord, err error) {
+	var msg map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&msg); err != nil {
+		err = fmt.Errorf("Invalid JSON: %v", err)
+		return
+	}
+
+	logRecord.Message, _ = msg["short_message"].(string)
+	logRecord.Tags = []string{}
+
+	severity := gelfDefaultLevel
+
+	if level, ok := msg["level"].(json.Number); ok {
+		n, convErr := level.Int64()
+		if convErr != nil || n < 0 || n >= int64(len(syslogLevels)) {
+			err = fmt.Errorf("Invalid level: %v", level)
+			return
+		}
+		severity = int(n)
+	}
+
+	logRecord.Level = syslogLevels[severity]
+
+	if timestamp, ok := msg["timestamp"].(json.Number); ok {
+		seconds, convErr := timestamp.Float64()
+		if convErr != nil {
+			err = fmt.Errorf("Invalid timestamp: %v", timestamp)
+			return
+		}
+
+		sec, frac := math.Modf(seconds)
+		logRecord.CreatedAt = time.Unix(int64(sec), int64(frac*1e9)).Round(time.Millisecond)
+	}
+
+	if host, ok := msg["host"].(string); ok && host != "" {
+		logRecord.Tags = append(logRecord.Tags, "host="+host)
+	}
+
+	fields := make([]string, 0, len(msg))
+	for name := range msg {
+		if strings.HasPrefix(name, "_") && name != "_id" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, name := range fields {
+		value := fmt.Sprint(msg[name])
+
+		if name == "_application" {
+			application = value
+			continue
+		}
+
+		logRecord.Tags = append(logRecord.Tags, name[1:]+"="+value)
+	}
+
+	return
+}
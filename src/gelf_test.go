@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GELF", func() {
+	const message = `{"version":"1.1","host":"example.org","short_message":"A short message","level":3,"timestamp":1385053862.3072,"_application":"gelfapp","_user_id":9001,"_some_info":"foo"}`
+
+	loadGELFRecords := func() LogRecords {
+		logRecords, err := loadLogRecords("gelfapp", 0, []string{},
+			time.Unix(1385053862, 0), time.Unix(1385053863, 0), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	Describe("parseGELFMessage", func() {
+		It("should map GELF fields onto log record", func() {
+			application, logRecord, err := parseGELFMessage([]byte(message))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(application).To(Equal("gelfapp"))
+			Expect(logRecord.Message).To(Equal("A short message"))
+			Expect(logRecord.Level).To(Equal(4))
+			Expect(logRecord.Tags).To(Equal([]string{"host=example.org", "some_info=foo", "user_id=9001"}))
+			Expect(logRecord.CreatedAt.Equal(time.Unix(1385053862, 307000000))).To(BeTrue())
+		})
+
+		It("should use default level", func() {
+			_, logRecord, err := parseGELFMessage([]byte(`{"short_message":"A short message"}`))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecord.Level).To(Equal(5))
+		})
+
+		It("should fail on invalid JSON", func() {
+			_, _, err := parseGELFMessage([]byte(`{"short_message":`))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail on invalid level", func() {
+			_, _, err := parseGELFMessage([]byte(`{"short_message":"A short message","level":8}`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("handleGELFDatagram", func() {
+		It("should save uncompressed message", func() {
+			handleGELFDatagram([]byte(message))
+			Expect(loadGELFRecords()).To(HaveLen(1))
+		})
+
+		It("should save gzipped message", func() {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write([]byte(message))
+			w.Close()
+
+			handleGELFDatagram(buf.Bytes())
+			Expect(loadGELFRecords()).To(HaveLen(1))
+		})
+
+		It("should save zlib compressed message", func() {
+			var buf bytes.Buffer
+			w := zlib.NewWriter(&buf)
+			w.Write([]byte(message))
+			w.Close()
+
+			handleGELFDatagram(buf.Bytes())
+			Expect(loadGELFRecords()).To(HaveLen(1))
+		})
+
+		It("should save chunked message when all chunks are received", func() {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write([]byte(message))
+			w.Close()
+
+			data := buf.Bytes()
+			half := len(data) / 2
+
+			chunk := func(seqNum byte, part []byte) []byte {
+				header := []byte{0x1e, 0x0f, 1, 2, 3, 4, 5, 6, 7, 8, seqNum, 2}
+				return append(header, part...)
+			}
+
+			handleGELFDatagram(chunk(1, data[half:]))
+			Expect(loadGELFRecords()).To(BeEmpty())
+
+			handleGELFDatagram(chunk(0, data[:half]))
+			Expect(loadGELFRecords()).To(HaveLen(1))
+		})
+	})
+
+	Describe("addGELFChunk", func() {
+		chunk := func(id int) []byte {
+			return []byte{0x1e, 0x0f, byte(id >> 8), byte(id), 0, 0, 0, 0, 0, 0, 0, 2, 'x'}
+		}
+
+		AfterEach(func() {
+			expireGELFChunks(time.Now().Add(time.Hour))
+		})
+
+		It("should limit the number of incomplete messages", func() {
+			for id := 0; id < gelfMaxChunkedMessages; id++ {
+				_, err := addGELFChunk(chunk(id))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			_, err := addGELFChunk(chunk(gelfMaxChunkedMessages))
+			Expect(err).To(MatchError("Too many incomplete chunked messages"))
+
+			expireGELFChunks(time.Now().Add(time.Second))
+
+			_, err = addGELFChunk(chunk(gelfMaxChunkedMessages))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should expire only messages created before the time", func() {
+			addGELFChunk(chunk(1))
+
+			expireGELFChunks(time.Now().Add(-time.Second))
+			Expect(gelfChunkedMessages).To(HaveLen(1))
+
+			expireGELFChunks(time.Now().Add(time.Second))
+			Expect(gelfChunkedMessages).To(BeEmpty())
+		})
+	})
+
+	Describe("handleGELFStream", func() {
+		It("should save null-byte delimited messages", func() {
+			handleGELFStream(strings.NewReader(message + "\x00\x00" + message + "\n"))
+			Expect(loadGELFRecords()).To(HaveLen(2))
+		})
+
+		It("should stop reading on a too large message", func() {
+			tooLarge := bytes.Repeat([]byte("a"), gelfMaxSize+1)
+
+			handleGELFStream(io.MultiReader(
+				strings.NewReader(message+"\x00"),
+				bytes.NewReader(tooLarge),
+				strings.NewReader("\x00"+message+"\x00"),
+			))
+			Expect(loadGELFRecords()).To(HaveLen(1))
+		})
+	})
+})
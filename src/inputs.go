@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+const maxDatagramSize = 65536
+
+// levelNames maps commonly used level names onto log record level
+var levelNames = map[string]int{
+	"trace":    0,
+	"debug":    0,
+	"info":     1,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"err":      4,
+	"crit":     5,
+	"critical": 5,
+	"fatal":    5,
+	"alert":    5,
+	"emerg":    5,
+}
+
+var (
+	inputListeners []io.Closer
+	inputHandlers  sync.WaitGroup
+
+	inputConns     = make(map[net.Conn]struct{})
+	inputConnsLock sync.Mutex
+)
+
+// startInputs starts listeners of non-HTTP inputs enabled in config
+func startInputs() {
+	startSyslogInputs()
+	startGELFInputs()
+	startTCPInput()
+	startForwardInput()
+}
+
+// stopInputs closes listeners and active connections of the inputs and waits
+// for the received messages to be handled
+func stopInputs() {
+	for _, listener := range inputListeners {
+		listener.Close()
+	}
+
+	stopGELFInputs()
+
+	inputConnsLock.Lock()
+	for conn := range inputConns {
+		conn.Close()
+	}
+	inputConnsLock.Unlock()
+
+	inputHandlers.Wait()
+}
+
+// serveTCP accepts connections and handles every connection in its own
+// goroutine
+func serveTCP(name, address string, handle func(conn net.Conn)) {
+	listener, err := net.Listen("tcp", address)
+	checkErr(err, "Can't start "+name+" TCP listener")
+
+	log.Printf("Starting %s TCP listener on %s\n", name, address)
+
+	serveListener(name, listener, handle)
+}
+
+// serveTLS works like serveTCP but wraps connections with TLS using server
+// certificate
+func serveTLS(name, address string, handle func(conn net.Conn)) {
+	tlsConfig, err := prepareTLSConfig()
+	checkErr(err, "Can't prepare TLS config")
+
+	cert, err := tls.LoadX509KeyPair(
+		absPathToFile(config.Server.TLS.Cert),
+		absPathToFile(config.Server.TLS.Key),
+	)
+	checkErr(err, "Can't load TLS certificate")
+
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	listener, err := tls.Listen("tcp", address, tlsConfig)
+	checkErr(err, "Can't start "+name+" TLS listener")
+
+	log.Printf("Starting %s TLS listener on %s\n", name, address)
+
+	serveListener(name, listener, handle)
+}
+
+func serveListener(name string, listener net.Listener, handle func(conn net.Conn)) {
+	inputListeners = append(inputListeners, listener)
+
+	inputHandlers.Add(1)
+	go func() {
+		defer inputHandlers.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// listener is closed
+				return
+			}
+
+			inputConnsLock.Lock()
+			inputConns[conn] = struct{}{}
+			inputConnsLock.Unlock()
+
+			inputHandlers.Add(1)
+			go func() {
+				defer inputHandlers.Done()
+
+				defer func() {
+					inputConnsLock.Lock()
+					delete(inputConns, conn)
+					inputConnsLock.Unlock()
+
+					conn.Close()
+				}()
+
+				defer recoverInputHandler(name)
+
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// serveUDP reads datagrams and handles every datagram in its own goroutine
+func serveUDP(name, address string, handle func(data []byte)) {
+	conn, err := net.ListenPacket("udp", address)
+	checkErr(err, "Can't start "+name+" UDP listener")
+
+	log.Printf("Starting %s UDP listener on %s\n", name, address)
+
+	inputListeners = append(inputListeners, conn)
+
+	inputHandlers.Add(1)
+	go func() {
+		defer inputHandlers.Done()
+
+		buf := make([]byte, maxDatagramSize)
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				// connection is closed
+				return
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			inputHandlers.Add(1)
+			go func() {
+				defer inputHandlers.Done()
+				defer recoverInputHandler(name)
+
+				handle(data)
+			}()
+		}
+	}()
+}
+
+// recoverInputHandler logs a panic of an input handler so a malformed message
+// can't bring the server down
+func recoverInputHandler(source string) {
+	if r := recover(); r != nil {
+		log.Printf("Input handler of %s panicked: %v\n%s", source, r, debug.Stack())
+	}
+}
+
+func logInputError(name string, err error) {
+	log.Printf("%s: %v", name, err)
+}
+
+func checkInputRecord(application string, logRecord *LogRecord) error {
+	if application == "" {
+		return errors.New("Application should be defined")
+	}
+
+	if logRecord.Message == "" {
+		return errors.New("Message should be defined")
+	}
+
+	if err := checkShardCreatedAt(logRecord.CreatedAt); err != nil {
+		return err
+	}
+
+	return checkCommonParams(strconv.Itoa(logRecord.Level), logRecord.Tags)
+}
+
+// saveInputRecord checks and saves log record received by an input. Errors
+// are logged since there is nobody to respond to.
+func saveInputRecord(name, application string, logRecord *LogRecord) error {
+	logRecord.Tags = uniqStrings(logRecord.Tags)
+
+	err := checkInputRecord(application, logRecord)
+	if err == nil {
+		err = saveLogRecord(application, logRecord)
+	}
+
+	if err != nil {
+		logInputError(name, err)
+	}
+
+	return err
+}
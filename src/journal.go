@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Journal entry layout:
+//
+//	<length uint32><CRC-32 uint32><BSON of journalEntry>
+//
+// Integers are little-endian, CRC is computed over BSON. A torn entry at the
+// end of the journal left by a crash is ignored on replay. A segment corrupted
+// in the middle is kept aside with the corrupted suffix.
+const (
+	journalHeaderLen   = 8
+	journalEntryMaxLen = 64 << 20
+
+	// number of records saved at once on replay
+	journalReplayBatchSize = 1000
+
+	// suffix of the journal segment that is being flushed to storage
+	journalFlushingExt = ".flushing"
+	// suffix of journal segments that can't be replayed completely
+	journalCorruptedExt = ".corrupted"
+
+	// syncInterval of a journal that isn't fsynced
+	journalNoSync = -1
+)
+
+// journalSyncPolicies are values of journal.sync option
+var journalSyncPolicies = map[string]bool{"none": true, "write": true, "interval": true}
+
+var errJournalCorrupted = errors.New("Journal entry is corrupted")
+
+// journalFile is implemented by *os.File
+type journalFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type journalEntry struct {
+	Application string    `bson:"application"`
+	LogRecord   LogRecord `bson:"record"`
+}
+
+// recordRing is a fixed-size FIFO buffer of records
+type recordRing struct {
+	records []ApplicationLogRecord
+	head    int
+	n       int
+}
+
+func newRecordRing(size int) *recordRing {
+	return &recordRing{records: make([]ApplicationLogRecord, size)}
+}
+
+func (r *recordRing) free() int {
+	return len(r.records) - r.n
+}
+
+func (r *recordRing) push(record ApplicationLogRecord) {
+	r.records[(r.head+r.n)%len(r.records)] = record
+	r.n++
+}
+
+// drain removes all records from the ring and returns them
+func (r *recordRing) drain() []ApplicationLogRecord {
+	drained := make([]ApplicationLogRecord, r.n)
+
+	for i := range drained {
+		drained[i] = r.records[(r.head+i)%len(r.records)]
+		r.records[(r.head+i)%len(r.records)] = ApplicationLogRecord{}
+	}
+
+	r.head, r.n = 0, 0
+
+	return drained
+}
+
+// recordJournal acknowledges records as soon as they are appended to the
+// journal file and kept in the ring. Flusher saves them to storage in the
+// background. Journal is rotated on every flush, so it contains only records
+// that aren't saved yet.
+type recordJournal struct {
+	path          string
+	flushInterval time.Duration
+	// see openJournal
+	syncInterval time.Duration
+
+	lock sync.Mutex
+	// signaled when records are added to the ring or space is freed
+	cond *sync.Cond
+	file journalFile
+	// size of complete entries of the current segment
+	size int64
+	// set when a failed write may have left a torn entry after size
+	torn   bool
+	ring   *recordRing
+	closed bool
+	// drained is set by flusher when all the records are saved on close
+	drained bool
+
+	// closing is closed on close to interrupt waiting for flush interval
+	closing chan struct{}
+	flushed chan struct{}
+	syncing sync.WaitGroup
+}
+
+// journal is nil when asynchronous writes are disabled
+var journal *recordJournal
+
+// startJournal replays records left in the journal by the previous run and
+// starts accepting records asynchronously
+func startJournal() error {
+	conf := currentConfig().Journal
+	if conf.Path == "" {
+		return nil
+	}
+
+	syncInterval := time.Duration(journalNoSync)
+
+	switch conf.Sync {
+	case "write":
+		syncInterval = 0
+	case "interval":
+		syncInterval = time.Duration(conf.SyncInterval) * time.Millisecond
+	}
+
+	j, err := openJournal(absPathToFile(conf.Path), conf.BufferSize, time.Duration(conf.FlushInterval)*time.Millisecond, syncInterval)
+	if err != nil {
+		return err
+	}
+
+	journal = j
+
+	return nil
+}
+
+// stopJournal flushes buffered records to storage and closes the journal
+func stopJournal() {
+	if journal != nil {
+		journal.close()
+		journal = nil
+	}
+}
+
+// openJournal replays the journal and opens it for appending. Journal is
+// fsynced on every append when syncInterval is zero, every syncInterval in
+// the background when it's positive and never when it's journalNoSync.
+func openJournal(path string, bufferSize int, flushInterval, syncInterval time.Duration) (*recordJournal, error) {
+	j := &recordJournal{
+		path:          path,
+		flushInterval: flushInterval,
+		syncInterval:  syncInterval,
+		ring:          newRecordRing(bufferSize),
+		closing:       make(chan struct{}),
+		flushed:       make(chan struct{}),
+	}
+	j.cond = sync.NewCond(&j.lock)
+
+	// the flushing segment precedes the current one
+	for _, segment := range []string{path + journalFlushingExt, path} {
+		replayed, err := replayJournal(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		if replayed > 0 {
+			log.Printf("Replayed %d records from %s", replayed, segment)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j.file = file
+
+	go j.flusher()
+
+	if syncInterval > 0 {
+		j.syncing.Add(1)
+		go j.syncer()
+	}
+
+	return j, nil
+}
+
+// replayJournal saves records of the journal segment to storage and removes
+// the segment. Records saved before the crash are saved again. If an entry in
+// the middle of the segment is corrupted, records preceding it are saved and
+// the segment is kept aside.
+func replayJournal(path string) (replayed int, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	r := bufio.NewReader(f)
+	batch := make([]ApplicationLogRecord, 0, journalReplayBatchSize)
+
+	var offset, n int64
+
+	for err == nil {
+		var entry *journalEntry
+
+		if entry, n, err = readJournalEntry(r); err != nil {
+			break
+		}
+
+		offset += n
+
+		batch = append(batch, ApplicationLogRecord{entry.Application, &entry.LogRecord})
+
+		if len(batch) == cap(batch) {
+			err = storeLogRecords(batch)
+			replayed += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	f.Close()
+
+	corrupted := false
+
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// the rest of the segment is a torn entry
+		err = nil
+	case err == errJournalCorrupted:
+		// a corrupted entry reaching the end of the segment is a torn one
+		corrupted = offset+n < info.Size()
+		err = nil
+	}
+
+	if err == nil && len(batch) > 0 {
+		err = storeLogRecords(batch)
+		replayed += len(batch)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if corrupted {
+		keptPath, err := keepCorruptedJournal(path)
+		if err != nil {
+			return replayed, err
+		}
+
+		log.Printf("Journal entry at offset %d of %s is corrupted, the segment is kept in %s", offset, path, keptPath)
+
+		return replayed, nil
+	}
+
+	err = os.Remove(path)
+
+	return
+}
+
+// keepCorruptedJournal moves the journal segment aside so it isn't replaced by
+// new segments
+func keepCorruptedJournal(path string) (keptPath string, err error) {
+	keptPath = path + journalCorruptedExt
+	for n := 1; fileExists(keptPath); n++ {
+		keptPath = fmt.Sprintf("%s%s.%d", path, journalCorruptedExt, n)
+	}
+
+	err = os.Rename(path, keptPath)
+
+	return
+}
+
+// readJournalEntry reads the entry and returns its length including header.
+// The length is returned for corrupted entries as well unless the header is
+// torn.
+func readJournalEntry(r io.Reader) (*journalEntry, int64, error) {
+	header := make([]byte, journalHeaderLen)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header)
+	n := int64(journalHeaderLen) + int64(length)
+
+	if length > journalEntryMaxLen {
+		return nil, n, errJournalCorrupted
+	}
+
+	data := make([]byte, length)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, n, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, n, errJournalCorrupted
+	}
+
+	entry := new(journalEntry)
+	if err := bson.Unmarshal(data, entry); err != nil {
+		return nil, n, errJournalCorrupted
+	}
+
+	return entry, n, nil
+}
+
+func appendJournalEntry(buf []byte, record ApplicationLogRecord) ([]byte, error) {
+	data, err := bson.Marshal(&journalEntry{record.Application, *record.LogRecord})
+	if err != nil {
+		return buf, err
+	}
+
+	header := make([]byte, journalHeaderLen)
+	binary.LittleEndian.PutUint32(header, uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+
+	return append(append(buf, header...), data...), nil
+}
+
+// append writes records to the journal with a single write and adds them to
+// the ring. It waits while the ring is full. Batches bigger than the ring are
+// saved to storage synchronously.
+func (j *recordJournal) append(records []ApplicationLogRecord) (err error) {
+	if len(records) > len(j.ring.records) {
+		return storeLogRecords(records)
+	}
+
+	var buf []byte
+
+	for _, record := range records {
+		if buf, err = appendJournalEntry(buf, record); err != nil {
+			return
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for !j.closed && j.ring.free() < len(records) {
+		j.cond.Wait()
+	}
+
+	if j.closed {
+		return errDBNotOpen
+	}
+
+	if err = j.repair(); err != nil {
+		return
+	}
+
+	_, err = j.file.Write(buf)
+	if err == nil && j.syncInterval == 0 {
+		err = j.file.Sync()
+	}
+
+	if err != nil {
+		// records aren't acknowledged, so they shouldn't be replayed. If
+		// truncation fails, the next append retries it.
+		j.torn = true
+		j.repair()
+		return
+	}
+
+	j.size += int64(len(buf))
+
+	for _, record := range records {
+		logRecord := copyLogRecord(*record.LogRecord)
+		record.LogRecord = &logRecord
+
+		j.ring.push(record)
+	}
+
+	j.cond.Broadcast()
+
+	return
+}
+
+// repair truncates the current segment to its last complete entry after a
+// failed write, so the next entries don't follow a torn one
+func (j *recordJournal) repair() error {
+	if !j.torn {
+		return nil
+	}
+
+	if err := j.file.Truncate(j.size); err != nil {
+		return err
+	}
+
+	if _, err := j.file.Seek(j.size, io.SeekStart); err != nil {
+		return err
+	}
+
+	j.torn = false
+
+	return nil
+}
+
+// syncer fsyncs the journal every syncInterval until it's closed
+func (j *recordJournal) syncer() {
+	defer j.syncing.Done()
+
+	ticker := time.NewTicker(j.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.closing:
+			return
+		case <-ticker.C:
+		}
+
+		j.lock.Lock()
+		err := j.file.Sync()
+		j.lock.Unlock()
+
+		if err != nil {
+			log.Printf("Journal sync failed: %v", err)
+		}
+	}
+}
+
+// flusher saves records of the ring to storage every flushInterval. Failed
+// batches are retried until they are saved. If saving fails on close, the
+// batch and records of the ring are left in the journal to be replayed on the
+// next start.
+func (j *recordJournal) flusher() {
+	defer close(j.flushed)
+
+	for {
+		j.lock.Lock()
+
+		for !j.closed && j.ring.n == 0 {
+			j.cond.Wait()
+		}
+
+		if j.ring.n == 0 {
+			j.drained = true
+			j.lock.Unlock()
+			return
+		}
+
+		j.lock.Unlock()
+
+		j.wait()
+
+		batch, err := j.rotate()
+		if err != nil {
+			log.Printf("Journal rotation failed: %v", err)
+			j.wait()
+			continue
+		}
+
+		for {
+			if err = storeLogRecords(batch); err == nil {
+				break
+			}
+
+			if j.isClosed() {
+				log.Printf("Flushing journal failed, records are kept in %s and %s: %v", j.path+journalFlushingExt, j.path, err)
+				return
+			}
+
+			log.Printf("Flushing journal failed, retrying: %v", err)
+			j.wait()
+		}
+
+		if err = os.Remove(j.path + journalFlushingExt); err != nil {
+			log.Printf("Can't remove flushed journal: %v", err)
+		}
+	}
+}
+
+// wait waits for flush interval unless the journal is closed
+func (j *recordJournal) wait() {
+	timer := time.NewTimer(j.flushInterval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-j.closing:
+	}
+}
+
+func (j *recordJournal) isClosed() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.closed
+}
+
+// rotate takes records of the ring and starts a new journal segment. The
+// previous segment is kept until the records are saved.
+func (j *recordJournal) rotate() (batch []ApplicationLogRecord, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err = os.Rename(j.path, j.path+journalFlushingExt); err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		os.Rename(j.path+journalFlushingExt, j.path)
+		return
+	}
+
+	j.file.Close()
+	j.file = file
+	j.size, j.torn = 0, false
+
+	batch = j.ring.drain()
+	j.cond.Broadcast()
+
+	return
+}
+
+// close stops accepting records and waits for the buffered ones to be saved.
+// The current segment is kept if some of them aren't saved.
+func (j *recordJournal) close() {
+	j.lock.Lock()
+	j.closed = true
+	j.cond.Broadcast()
+	j.lock.Unlock()
+
+	close(j.closing)
+
+	<-j.flushed
+	j.syncing.Wait()
+
+	j.file.Close()
+
+	if j.drained {
+		os.Remove(j.path)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// failingStorage fails to save records
+type failingStorage struct {
+	Storage
+}
+
+func (failingStorage) Save([]ApplicationLogRecord) error {
+	return errDBNotOpen
+}
+
+// failingJournalFile counts syncs and may fail them or write a half of the
+// data and fail
+type failingJournalFile struct {
+	*os.File
+	failWrite bool
+	failSync  bool
+	syncs     int
+}
+
+func (f *failingJournalFile) Write(data []byte) (int, error) {
+	if !f.failWrite {
+		return f.File.Write(data)
+	}
+
+	n, _ := f.File.Write(data[:len(data)/2])
+	return n, errors.New("No space left on device")
+}
+
+func (f *failingJournalFile) Sync() error {
+	f.syncs++
+
+	if f.failSync {
+		return errors.New("Input/output error")
+	}
+	return f.File.Sync()
+}
+
+var _ = Describe("Journal", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	start := time.Date(2015, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	newRecord := func(message string, i int) ApplicationLogRecord {
+		return ApplicationLogRecord{"testapp", &LogRecord{
+			Message:   message,
+			Level:     1,
+			Tags:      []string{},
+			CreatedAt: start.Add(time.Duration(i) * time.Second),
+		}}
+	}
+
+	loadMessages := func() []string {
+		logRecords, err := loadLogRecords("testapp", 0, []string{}, start, start.Add(time.Hour), 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		return logRecordMessages(logRecords)
+	}
+
+	writeSegment := func(path string, records ...ApplicationLogRecord) {
+		var buf []byte
+
+		for _, record := range records {
+			var err error
+			buf, err = appendJournalEntry(buf, record)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(ioutil.WriteFile(path, buf, 0600)).To(Succeed())
+	}
+
+	readSegmentMessages := func(path string) (messages []string) {
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		r := bufio.NewReader(f)
+
+		for {
+			entry, _, err := readJournalEntry(r)
+			if err == io.EOF {
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			messages = append(messages, entry.LogRecord.Message)
+		}
+	}
+
+	failJournalFile := func(failWrite, failSync bool) (restore func()) {
+		journal.lock.Lock()
+		defer journal.lock.Unlock()
+
+		file := journal.file
+		journal.file = &failingJournalFile{File: file.(*os.File), failWrite: failWrite, failSync: failSync}
+
+		return func() {
+			journal.lock.Lock()
+			defer journal.lock.Unlock()
+			journal.file = file
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-journal")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(dir, "logbook.journal")
+	})
+
+	AfterEach(func() {
+		stopJournal()
+		os.RemoveAll(dir)
+	})
+
+	Describe("recordRing", func() {
+		It("should keep records in order when wrapping around", func() {
+			ring := newRecordRing(3)
+			ring.head = 2
+
+			for i := 0; i < 3; i++ {
+				ring.push(newRecord(fmt.Sprintf("Message %d", i), i))
+			}
+
+			Expect(ring.free()).To(BeZero())
+
+			drained := ring.drain()
+			Expect(drained).To(HaveLen(3))
+			Expect(drained[0].LogRecord.Message).To(Equal("Message 0"))
+			Expect(drained[2].LogRecord.Message).To(Equal("Message 2"))
+			Expect(ring.free()).To(Equal(3))
+		})
+	})
+
+	Context("when enabled", func() {
+		JustBeforeEach(func() {
+			var err error
+			journal, err = openJournal(path, 10, time.Hour, journalNoSync)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should acknowledge records before they are saved to storage", func() {
+			record := newRecord("Message 1", 1)
+			Expect(saveLogRecords([]ApplicationLogRecord{record})).To(Succeed())
+
+			Expect(loadMessages()).To(BeEmpty())
+
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically(">", journalHeaderLen))
+
+			stopJournal()
+
+			Expect(loadMessages()).To(Equal([]string{"Message 1"}))
+
+			_, err = os.Stat(path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("should save batches bigger than the ring synchronously", func() {
+			records := make([]ApplicationLogRecord, 11)
+			for i := range records {
+				records[i] = newRecord(fmt.Sprintf("Message %d", i), i)
+			}
+
+			Expect(saveLogRecords(records)).To(Succeed())
+
+			Expect(loadMessages()).To(HaveLen(11))
+		})
+
+		It("should truncate an entry torn by a failed write", func() {
+			Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 1", 1)})).To(Succeed())
+
+			restore := failJournalFile(true, false)
+			Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 2", 2)})).NotTo(Succeed())
+			restore()
+
+			Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 3", 3)})).To(Succeed())
+
+			Expect(readSegmentMessages(path)).To(Equal([]string{"Message 1", "Message 3"}))
+
+			stopJournal()
+
+			Expect(loadMessages()).To(Equal([]string{"Message 1", "Message 3"}))
+		})
+
+		Context("with sync on every write", func() {
+			JustBeforeEach(func() {
+				journal.syncInterval = 0
+			})
+
+			It("should drop entries that failed to sync", func() {
+				Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 1", 1)})).To(Succeed())
+
+				restore := failJournalFile(false, true)
+				Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 2", 2)})).NotTo(Succeed())
+				restore()
+
+				Expect(readSegmentMessages(path)).To(Equal([]string{"Message 1"}))
+			})
+		})
+
+		Context("with a corrupted entry at the end of a segment", func() {
+			BeforeEach(func() {
+				writeSegment(path, newRecord("Message 1", 1), newRecord("Message 2", 2))
+
+				// flip the last byte of the second entry
+				data, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				data[len(data)-1] ^= 0xff
+				Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+			})
+
+			It("should treat it as a torn entry", func() {
+				Expect(loadMessages()).To(Equal([]string{"Message 1"}))
+
+				_, err := os.Stat(path + journalCorruptedExt)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Context("with a corrupted entry in the middle of a segment", func() {
+			var data []byte
+
+			BeforeEach(func() {
+				writeSegment(path, newRecord("Message 1", 1))
+
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+
+				writeSegment(path, newRecord("Message 1", 1), newRecord("Message 2", 2), newRecord("Message 3", 3))
+
+				// flip a byte of the second entry
+				data, err = ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				data[info.Size()+journalHeaderLen] ^= 0xff
+				Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+			})
+
+			It("should replay records preceding it and keep the segment", func() {
+				Expect(loadMessages()).To(Equal([]string{"Message 1"}))
+
+				kept, err := ioutil.ReadFile(path + journalCorruptedExt)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(kept).To(Equal(data))
+
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeZero())
+			})
+		})
+
+		Context("with records left by crash", func() {
+			BeforeEach(func() {
+				writeSegment(path+journalFlushingExt, newRecord("Message 1", 1))
+				writeSegment(path, newRecord("Message 2", 2), newRecord("Message 3", 3))
+
+				// torn entry
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+				Expect(err).NotTo(HaveOccurred())
+				f.Write([]byte{100, 0, 0, 0, 1, 2})
+				f.Close()
+			})
+
+			It("should replay them on start", func() {
+				Expect(loadMessages()).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+
+				_, err := os.Stat(path + journalFlushingExt)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeZero())
+			})
+		})
+	})
+
+	It("should keep records of the journal when saving fails on close", func() {
+		restoreStorage := swapStorage(failingStorage{storage})
+		defer func() {
+			if restoreStorage != nil {
+				restoreStorage()
+			}
+		}()
+
+		var err error
+		journal, err = openJournal(path, 10, 10*time.Millisecond, journalNoSync)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 1", 1)})).To(Succeed())
+
+		// the first record is being flushed, the second one is only in the ring
+		Eventually(func() bool { return fileExists(path + journalFlushingExt) }).Should(BeTrue())
+		Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 2", 2)})).To(Succeed())
+
+		stopJournal()
+
+		restoreStorage()
+		restoreStorage = nil
+
+		Expect(loadMessages()).To(BeEmpty())
+
+		journal, err = openJournal(path, 10, time.Hour, journalNoSync)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(loadMessages()).To(Equal([]string{"Message 1", "Message 2"}))
+	})
+
+	It("should sync the journal in background", func() {
+		var err error
+		journal, err = openJournal(path, 10, time.Hour, 10*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+
+		restore := failJournalFile(false, false)
+		defer restore()
+
+		Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 1", 1)})).To(Succeed())
+
+		Eventually(func() int {
+			journal.lock.Lock()
+			defer journal.lock.Unlock()
+			return journal.file.(*failingJournalFile).syncs
+		}).Should(BeNumerically(">", 1))
+	})
+
+	It("should flush records in background", func() {
+		var err error
+		journal, err = openJournal(path, 10, 10*time.Millisecond, journalNoSync)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(saveLogRecords([]ApplicationLogRecord{newRecord("Message 1", 1)})).To(Succeed())
+
+		Eventually(loadMessages).Should(Equal([]string{"Message 1"}))
+	})
+})
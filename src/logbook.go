@@ -1,10 +1,55 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
 func main() {
-	prepareConfig()
+	command, args := "", os.Args[1:]
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "":
+		runServer(args)
+	case "check-config":
+		checkConfigCommand(args)
+	case "query":
+		queryCommand(args)
+	case "db":
+		dbCommand(args)
+	case "compact":
+		compactCommand(args)
+	case "migrate":
+		migrateCommand(args)
+	default:
+		fmt.Printf("Unknown command: %s\n", command)
+		os.Exit(1)
+	}
+}
+
+func runServer(args []string) {
+	prepareConfig(args)
 
 	initDB()
-	defer closeDB()
 
 	startServer()
+	startInputs()
+	startBackups()
+	startArchiving()
+
+	waitForShutdownSignal()
+
+	log.Println("Shutting down")
+
+	stopServer()
+	stopInputs()
+	stopBackups()
+	stopArchiving()
+	closeDB()
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -31,6 +33,11 @@ var _ = AfterSuite(func() {
 var _ = BeforeEach(func() {
 	db.Update(func(tx *bolt.Tx) (err error) {
 		err = tx.ForEach(func(name []byte, b *bolt.Bucket) (err error) {
+			// the file keeps its record key layout
+			if bytes.Equal(name, metaBucket) {
+				return
+			}
+
 			err = tx.DeleteBucket(name)
 			return
 		})
@@ -38,6 +45,30 @@ var _ = BeforeEach(func() {
 	})
 })
 
+// saveTestLogRecord saves the log record of the trace1 trace
+func saveTestLogRecord(application, message string, level int, createdAt time.Time, tags ...string) {
+	logRecord := LogRecord{Message: message, Level: level, Tags: tags, CreatedAt: createdAt, TraceID: "trace1"}
+	Expect(saveLogRecord(application, &logRecord)).To(Succeed())
+}
+
+func logRecordMessages(logRecords LogRecords) (messages []string) {
+	for _, logRecord := range logRecords {
+		messages = append(messages, logRecord.Message)
+	}
+	return
+}
+
+// swapStorage replaces the global storage and returns a function that
+// restores the previous one
+func swapStorage(s Storage) (restore func()) {
+	prevStorage := storage
+	storage = s
+
+	return func() {
+		storage = prevStorage
+	}
+}
+
 func TestLogbook(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Logbook Suite")
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "logbook"
+
+	// label of applications that aren't labeled by their names
+	otherApplicationLabel = "other"
+)
+
+var (
+	ingestedRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "records_ingested_total",
+			Help:      "Number of saved log records.",
+		},
+		[]string{"application", "level"},
+	)
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "method", "code"},
+	)
+
+	batchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_batch_duration_seconds",
+			Help:      "Time spent waiting for a db.Batch write to be committed.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+
+	dbSize = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_size_bytes",
+			Help:      "Size of the database file.",
+		},
+		func() (size float64) {
+			viewDB(func(tx *bolt.Tx) error {
+				size = float64(tx.Size())
+				return nil
+			})
+			return
+		},
+	)
+
+	// applications labeled on first use
+	labeledApplications     = make(map[string]struct{})
+	labeledApplicationsLock sync.Mutex
+
+	dbOpenTransactions = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_open_transactions",
+			Help:      "Number of currently open read transactions.",
+		},
+		func() float64 {
+			dbLock.RLock()
+			defer dbLock.RUnlock()
+
+			if db == nil {
+				return 0
+			}
+			return float64(db.Stats().OpenTxN)
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		ingestedRecords,
+		requestDuration,
+		batchDuration,
+		dbSize,
+		dbOpenTransactions,
+	)
+}
+
+func observeIngestedRecord(application string, level int) {
+	ingestedRecords.WithLabelValues(applicationLabel(application), strconv.Itoa(level)).Inc()
+}
+
+// applicationLabel keeps the number of application label values bounded since
+// inputs accept any application names. Applications listed in
+// metrics.applications are labeled by their names. When the list is empty,
+// first metrics.maxApplications applications are. The rest are labeled
+// "other".
+func applicationLabel(application string) string {
+	conf := currentConfig().Metrics
+
+	if len(conf.Applications) > 0 {
+		for _, app := range conf.Applications {
+			if app == application {
+				return application
+			}
+		}
+
+		return otherApplicationLabel
+	}
+
+	labeledApplicationsLock.Lock()
+	defer labeledApplicationsLock.Unlock()
+
+	if _, ok := labeledApplications[application]; ok {
+		return application
+	}
+
+	if len(labeledApplications) < conf.MaxApplications {
+		labeledApplications[application] = struct{}{}
+		return application
+	}
+
+	return otherApplicationLabel
+}
+
+func observeBatch(start time.Time) {
+	batchDuration.Observe(time.Since(start).Seconds())
+}
+
+// measureRequests records duration of requests to known routes
+func measureRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+
+		requestDuration.WithLabelValues(
+			route, c.Request.Method, strconv.Itoa(c.Writer.Status()),
+		).Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+		router = setupRouter()
+	})
+
+	Describe("/metrics", func() {
+		var savedConfig Config
+
+		BeforeEach(func() {
+			savedConfig = config
+			config.Metrics.Applications = []string{"metricsapp"}
+
+			Expect(
+				sendRequest("POST", "/metricsapp/put", "message=Lorem%20ipsum&level=3"),
+			).To(Succeed())
+
+			Expect(sendRequest("GET", "/metrics")).To(Succeed())
+		})
+
+		AfterEach(func() {
+			config = savedConfig
+		})
+
+		It("should respond with 200", func() {
+			Expect(response.Code).To(Equal(200))
+		})
+
+		It("should expose ingest counts", func() {
+			Expect(response.Body.String()).To(ContainSubstring(
+				`logbook_records_ingested_total{application="metricsapp",level="3"}`,
+			))
+		})
+
+		It("should expose request durations per route", func() {
+			Expect(response.Body.String()).To(ContainSubstring(
+				`logbook_http_request_duration_seconds_count{code="200",method="POST",route="/:application/put"}`,
+			))
+		})
+
+		It("should expose database metrics", func() {
+			Expect(response.Body.String()).To(ContainSubstring("logbook_db_batch_duration_seconds_count"))
+			Expect(response.Body.String()).To(ContainSubstring("logbook_db_size_bytes"))
+			Expect(response.Body.String()).To(ContainSubstring("logbook_db_open_transactions"))
+		})
+	})
+
+	Describe("applicationLabel", func() {
+		var savedConfig Config
+
+		BeforeEach(func() {
+			savedConfig = config
+		})
+
+		AfterEach(func() {
+			config = savedConfig
+		})
+
+		It("should label only configured applications", func() {
+			config.Metrics.Applications = []string{"app1", "app2"}
+
+			Expect(applicationLabel("app1")).To(Equal("app1"))
+			Expect(applicationLabel("app2")).To(Equal("app2"))
+			Expect(applicationLabel("app3")).To(Equal("other"))
+		})
+
+		It("should label up to maxApplications applications", func() {
+			labeledApplicationsLock.Lock()
+			labeled := len(labeledApplications)
+			labeledApplicationsLock.Unlock()
+
+			config.Metrics.MaxApplications = labeled + 1
+
+			Expect(applicationLabel("labelapp1")).To(Equal("labelapp1"))
+			Expect(applicationLabel("labelapp2")).To(Equal("other"))
+			Expect(applicationLabel("labelapp1")).To(Equal("labelapp1"))
+		})
+	})
+})
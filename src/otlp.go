@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpMaxBodySize = 16 * 1024 * 1024
+
+	// used by OpenTelemetry SDKs when service name isn't set
+	otlpDefaultServiceName = "unknown_service"
+)
+
+// Action: OTLP logs ===========================================================
+
+func otlpLogsHandler(c *gin.Context) {
+	isJSON := strings.HasPrefix(c.ContentType(), "application/json")
+
+	if !isJSON && c.ContentType() != "application/x-protobuf" {
+		c.JSON(415, ErrorResponse{"Content type should be application/x-protobuf or application/json"})
+		return
+	}
+
+	body, err := readOTLPBody(c)
+	if err != nil {
+		c.JSON(400, ErrorResponse{err.Error()})
+		return
+	}
+
+	var req collogs.ExportLogsServiceRequest
+
+	if isJSON {
+		if body, err = otlpJSONDecodeIDs(body); err == nil {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, &req)
+		}
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+
+	if err != nil {
+		c.JSON(400, ErrorResponse{"Invalid export request: " + err.Error()})
+		return
+	}
+
+	records, rejected := otlpRequestToLogRecords(&req)
+
+	if mutualTLSEnabled() {
+		commonName := c.Request.TLS.PeerCertificates[0].Subject.CommonName
+
+		for _, record := range records {
+			if !clientAllowedToWrite(commonName, record.Application) {
+				c.JSON(403, ErrorResponse{"Client certificate isn't allowed to write to " + record.Application})
+				return
+			}
+		}
+	}
+
+	if len(records) > 0 {
+		panicOnErr(saveLogRecords(records))
+	}
+
+	resp := &collogs.ExportLogsServiceResponse{}
+
+	if rejected > 0 {
+		resp.PartialSuccess = &collogs.ExportLogsPartialSuccess{
+			RejectedLogRecords: rejected,
+			ErrorMessage:       "Invalid log records were rejected",
+		}
+	}
+
+	var data []byte
+
+	if isJSON {
+		data, err = protojson.Marshal(resp)
+	} else {
+		data, err = proto.Marshal(resp)
+	}
+	panicOnErr(err)
+
+	c.Data(200, c.ContentType(), data)
+}
+
+// end of Action: OTLP logs
+
+func readOTLPBody(c *gin.Context) ([]byte, error) {
+	var body io.Reader = c.Request.Body
+
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		body = gz
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, otlpMaxBodySize+1))
+	if err == nil && len(data) > otlpMaxBodySize {
+		err = fmt.Errorf("Request body is larger than %d bytes", otlpMaxBodySize)
+	}
+
+	return data, err
+}
+
+// otlpJSONDecodeIDs replaces hex trace and span IDs of OTLP/JSON log records
+// with base64 protojson expects for bytes fields
+func otlpJSONDecodeIDs(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep 64-bit timestamps sent as numbers intact
+	decoder.UseNumber()
+
+	var req map[string]interface{}
+	if err := decoder.Decode(&req); err != nil {
+		return nil, err
+	}
+
+	for _, resourceLogs := range otlpJSONList(req, "resourceLogs", "resource_logs") {
+		for _, scopeLogs := range otlpJSONList(resourceLogs, "scopeLogs", "scope_logs") {
+			for _, logRecord := range otlpJSONList(scopeLogs, "logRecords", "log_records") {
+				if err := otlpJSONDecodeID(logRecord, 16, "traceId", "trace_id"); err != nil {
+					return nil, err
+				}
+				if err := otlpJSONDecodeID(logRecord, 8, "spanId", "span_id"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return json.Marshal(req)
+}
+
+// otlpJSONList returns objects of the list field having any of the names
+func otlpJSONList(obj map[string]interface{}, names ...string) (list []map[string]interface{}) {
+	for _, name := range names {
+		items, _ := obj[name].([]interface{})
+
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				list = append(list, m)
+			}
+		}
+	}
+
+	return
+}
+
+// otlpJSONDecodeID converts hex ID field having any of the names to base64.
+// Empty IDs are allowed, others should have exactly size bytes.
+func otlpJSONDecodeID(obj map[string]interface{}, size int, names ...string) error {
+	for _, name := range names {
+		value, ok := obj[name]
+		if !ok {
+			continue
+		}
+
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s should be a hex string", name)
+		}
+
+		id, err := hex.DecodeString(str)
+		if err != nil || (len(id) != 0 && len(id) != size) {
+			return fmt.Errorf("%s should be %d hex-encoded bytes", name, size)
+		}
+
+		obj[name] = base64.StdEncoding.EncodeToString(id)
+	}
+
+	return nil
+}
+
+// otlpRequestToLogRecords maps OTLP log records onto log records. service.name
+// resource attribute is used as application.
+func otlpRequestToLogRecords(req *collogs.ExportLogsServiceRequest) (records []ApplicationLogRecord, rejected int64) {
+	for _, resourceLogs := range req.ResourceLogs {
+		application := otlpDefaultServiceName
+
+		for _, attr := range resourceLogs.GetResource().GetAttributes() {
+			if attr.Key == "service.name" {
+				if name := otlpValueString(attr.Value); name != "" {
+					application = name
+				}
+			}
+		}
+
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, otlpRecord := range scopeLogs.LogRecords {
+				logRecord := otlpLogRecord(otlpRecord)
+
+				if err := checkInputRecord(application, logRecord); err != nil {
+					rejected++
+					continue
+				}
+
+				records = append(records, ApplicationLogRecord{application, logRecord})
+			}
+		}
+	}
+
+	return
+}
+
+func otlpLogRecord(otlpRecord *logspb.LogRecord) *LogRecord {
+	logRecord := &LogRecord{
+		Message: otlpValueString(otlpRecord.Body),
+		Level:   otlpLevel(otlpRecord.SeverityNumber, otlpRecord.SeverityText),
+		Tags:    []string{},
+	}
+
+	switch {
+	case otlpRecord.TimeUnixNano > 0:
+		logRecord.CreatedAt = time.Unix(0, int64(otlpRecord.TimeUnixNano))
+	case otlpRecord.ObservedTimeUnixNano > 0:
+		logRecord.CreatedAt = time.Unix(0, int64(otlpRecord.ObservedTimeUnixNano))
+	}
+
+	for _, attr := range otlpRecord.Attributes {
+		if value := otlpValueString(attr.Value); value != "" {
+			logRecord.Tags = append(logRecord.Tags, attr.Key+"="+value)
+		}
+	}
+
+	logRecord.Tags = uniqStrings(logRecord.Tags)
+
+	if len(otlpRecord.TraceId) > 0 {
+		logRecord.TraceID = hex.EncodeToString(otlpRecord.TraceId)
+	}
+
+	if len(otlpRecord.SpanId) > 0 {
+		logRecord.SpanID = hex.EncodeToString(otlpRecord.SpanId)
+	}
+
+	return logRecord
+}
+
+// otlpLevel maps SeverityNumber (1-24) onto log record level. SeverityText is
+// used when SeverityNumber is unspecified.
+func otlpLevel(severity logspb.SeverityNumber, severityText string) int {
+	switch {
+	case severity >= logspb.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return 5
+	case severity >= logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return 4
+	case severity >= logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return 3
+	case severity >= logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return 1
+	case severity > logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED:
+		return 0
+	}
+
+	if level, ok := levelNames[strings.ToLower(severityText)]; ok {
+		return level
+	}
+
+	return 1
+}
+
+func otlpValueString(value *commonpb.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case nil:
+		return ""
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return fmt.Sprint(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return fmt.Sprint(v.IntValue)
+	case *commonpb.AnyValue_DoubleValue:
+		return fmt.Sprint(v.DoubleValue)
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]string, len(v.ArrayValue.Values))
+		for i, el := range v.ArrayValue.Values {
+			values[i] = otlpValueString(el)
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		pairs := make([]string, len(v.KvlistValue.Values))
+		for i, kv := range v.KvlistValue.Values {
+			pairs[i] = kv.Key + "=" + otlpValueString(kv.Value)
+		}
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	return ""
+}
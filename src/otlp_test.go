@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OTLP", func() {
+	createdAt := time.Date(2015, 10, 16, 8, 10, 11, 123000000, time.Local)
+
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+		router = setupRouter()
+	})
+
+	sendOTLP := func(contentType string, body []byte) {
+		req, err := http.NewRequest("POST", "http://logbook.test/v1/logs", strings.NewReader(string(body)))
+		Expect(err).NotTo(HaveOccurred())
+
+		req.SetBasicAuth(config.Auth.User, config.Auth.Password)
+		req.Header.Set("Content-Type", contentType)
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+	}
+
+	loadOTLPRecords := func() LogRecords {
+		logRecords, err := loadLogRecords("checkout", 0, []string{},
+			createdAt.Add(-time.Second), createdAt.Add(time.Second), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	Context("with protobuf request", func() {
+		BeforeEach(func() {
+			req := &collogs.ExportLogsServiceRequest{
+				ResourceLogs: []*logspb.ResourceLogs{{
+					Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+						Key:   "service.name",
+						Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "checkout"}},
+					}}},
+					ScopeLogs: []*logspb.ScopeLogs{{
+						LogRecords: []*logspb.LogRecord{
+							{
+								TimeUnixNano:   uint64(createdAt.UnixNano()),
+								SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+								Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Payment failed"}},
+								Attributes: []*commonpb.KeyValue{{
+									Key:   "order_id",
+									Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 42}},
+								}},
+								TraceId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+								SpanId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+							},
+							{
+								TimeUnixNano: uint64(createdAt.UnixNano()),
+							},
+						},
+					}},
+				}},
+			}
+
+			data, err := proto.Marshal(req)
+			Expect(err).NotTo(HaveOccurred())
+
+			sendOTLP("application/x-protobuf", data)
+		})
+
+		It("should respond with 200 and partial success", func() {
+			Expect(response.Code).To(Equal(200))
+
+			var resp collogs.ExportLogsServiceResponse
+			Expect(proto.Unmarshal(response.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.PartialSuccess.RejectedLogRecords).To(Equal(int64(1)))
+		})
+
+		It("should save log records to service bucket", func() {
+			logRecords := loadOTLPRecords()
+
+			Expect(logRecords).To(HaveLen(1))
+			Expect(logRecords[0].Message).To(Equal("Payment failed"))
+			Expect(logRecords[0].Level).To(Equal(4))
+			Expect(logRecords[0].Tags).To(ConsistOf("order_id=42"))
+			Expect(logRecords[0].TraceID).To(Equal("0102030405060708090a0b0c0d0e0f10"))
+			Expect(logRecords[0].SpanID).To(Equal("0102030405060708"))
+		})
+	})
+
+	Context("with JSON request", func() {
+		BeforeEach(func() {
+			sendOTLP("application/json", []byte(fmt.Sprintf(`{
+				"resourceLogs": [{
+					"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+					"scopeLogs": [{
+						"logRecords": [{
+							"timeUnixNano": "%d",
+							"severityText": "warning",
+							"body": {"stringValue": "Slow response"},
+							"traceId": "5b8efff798038103d269b633813fc60c",
+							"spanId": "eee19b7ec3c1b174"
+						}]
+					}]
+				}]
+			}`, createdAt.UnixNano())))
+		})
+
+		It("should respond with 200", func() {
+			Expect(response.Code).To(Equal(200))
+		})
+
+		It("should save log records to service bucket", func() {
+			logRecords := loadOTLPRecords()
+
+			Expect(logRecords).To(HaveLen(1))
+			Expect(logRecords[0].Message).To(Equal("Slow response"))
+			Expect(logRecords[0].Level).To(Equal(3))
+			Expect(logRecords[0].TraceID).To(Equal("5b8efff798038103d269b633813fc60c"))
+			Expect(logRecords[0].SpanID).To(Equal("eee19b7ec3c1b174"))
+		})
+	})
+
+	Context("with JSON request with malformed trace ID", func() {
+		BeforeEach(func() {
+			sendOTLP("application/json", []byte(fmt.Sprintf(`{
+				"resourceLogs": [{
+					"scopeLogs": [{
+						"logRecords": [{
+							"timeUnixNano": "%d",
+							"body": {"stringValue": "Slow response"},
+							"traceId": "W47/95gDgQPSabYzgT/GDA=="
+						}]
+					}]
+				}]
+			}`, createdAt.UnixNano())))
+		})
+
+		It("should respond with 400", func() {
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body.String()).To(ContainSubstring("traceId"))
+		})
+	})
+
+	Context("with unsupported content type", func() {
+		BeforeEach(func() {
+			sendOTLP("text/plain", []byte("Lorem ipsum"))
+		})
+
+		It("should respond with 415", func() {
+			Expect(response.Code).To(Equal(415))
+		})
+	})
+})
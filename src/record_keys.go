@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// metaBucket is a top-level bucket that keeps settings of the DB file. Its
+// name starts with a zero byte to keep it apart from application buckets.
+var metaBucket = []byte("\x00meta")
+
+// recordKeyLayoutKey of metaBucket keeps time layout of record keys. Files
+// without it have legacy keys that put day before month, so their keys
+// aren't ordered by time across months.
+var recordKeyLayoutKey = []byte("recordKeyLayout")
+
+var errOutdatedRecordKeys = errors.New("Record keys have outdated layout, run `logbook migrate --keys` first")
+
+// isServiceBucket reports whether the top-level bucket isn't an application
+// bucket
+func isServiceBucket(name []byte) bool {
+	return len(name) > 0 && name[0] == 0
+}
+
+func hasRecordKeyLayout(tx *bolt.Tx) bool {
+	meta := tx.Bucket(metaBucket)
+	return meta != nil && meta.Get(recordKeyLayoutKey) != nil
+}
+
+// recordKeysOutdated reports whether the DB file has application buckets with
+// legacy record keys
+func recordKeysOutdated(tx *bolt.Tx) bool {
+	if hasRecordKeyLayout(tx) {
+		return false
+	}
+
+	cursor := tx.Cursor()
+
+	for name, _ := cursor.First(); name != nil; name, _ = cursor.Next() {
+		if !isServiceBucket(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// migrateRecordKeys rewrites legacy record keys of the DB file along with
+// their trace index entries and marks the file as migrated. Keys are
+// rewritten in a single transaction, so an interrupted migration leaves the
+// file as is. It returns the number of rewritten keys.
+func migrateRecordKeys(boltDB *bolt.DB) (migrated int, err error) {
+	var marked bool
+
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		marked = hasRecordKeyLayout(tx)
+		return nil
+	})
+	if err != nil || marked {
+		return
+	}
+
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Cursor()
+
+		for name, _ := cursor.First(); name != nil; name, _ = cursor.Next() {
+			if isServiceBucket(name) {
+				continue
+			}
+
+			n, err := migrateAppRecordKeys(tx.Bucket(name))
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			migrated += n
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(recordKeyLayoutKey, []byte(recordKeyTimeFormat))
+	})
+
+	return
+}
+
+// openRecordKeys migrates record keys of the freshly opened DB file and logs
+// the result
+func openRecordKeys(boltDB *bolt.DB) error {
+	migrated, err := migrateRecordKeys(boltDB)
+	if err != nil {
+		return fmt.Errorf("Can't migrate record keys of %s: %v", boltDB.Path(), err)
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated %d record keys of %s", migrated, boltDB.Path())
+	}
+
+	return nil
+}
+
+// migrateRecordKeysFile migrates record keys of the DB file at the path. It
+// fails when DB is locked by a running server.
+func migrateRecordKeysFile(path string) (migrated int, err error) {
+	boltDB, err := bolt.Open(absPathToFile(path), 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		err = errDBLocked
+	}
+	if err != nil {
+		return
+	}
+	defer boltDB.Close()
+
+	return migrateRecordKeys(boltDB)
+}
+
+func migrateAppRecordKeys(appBucket *bolt.Bucket) (migrated int, err error) {
+	newKeys := make(map[string][]byte)
+
+	err = forEachRecordBucket(appBucket, nil, nil, func(key []byte, _ *bolt.Bucket) error {
+		newKey, err := legacyRecordKey(key)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(key, newKey) {
+			newKeys[string(key)] = newKey
+		}
+		return nil
+	})
+	if err != nil || len(newKeys) == 0 {
+		return
+	}
+
+	for key, newKey := range newKeys {
+		if err = moveBucket(appBucket, []byte(key), newKey); err != nil {
+			return
+		}
+	}
+
+	traceBucket := appBucket.Bucket(traceIndexBucket)
+	if traceBucket == nil {
+		return len(newKeys), nil
+	}
+
+	traceKeys := make(map[string][]byte)
+
+	err = traceBucket.ForEach(func(key, _ []byte) error {
+		i := bytes.IndexByte(key, 0)
+		if i < 0 {
+			return nil
+		}
+
+		if newKey, ok := newKeys[string(key[i+1:])]; ok {
+			traceKeys[string(key)] = traceIndexKey(string(key[:i]), newKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for key, newKey := range traceKeys {
+		if err = traceBucket.Delete([]byte(key)); err != nil {
+			return
+		}
+
+		if err = traceBucket.Put(newKey, []byte{}); err != nil {
+			return
+		}
+	}
+
+	return len(newKeys), nil
+}
+
+// legacyRecordKey converts the legacy record key that puts day before month
+// to the current layout
+func legacyRecordKey(key []byte) ([]byte, error) {
+	if len(key) < len(recordKeyTimeFormat) {
+		return nil, fmt.Errorf("Invalid record key %q", key)
+	}
+
+	newKey := append([]byte(nil), key...)
+	copy(newKey[5:7], key[8:10])
+	copy(newKey[8:10], key[5:7])
+
+	if _, err := recordKeyTime(newKey); err != nil {
+		return nil, fmt.Errorf("Invalid record key %q", key)
+	}
+
+	return newKey, nil
+}
+
+// moveBucket moves the record bucket to the new key. Record buckets don't
+// have nested buckets.
+func moveBucket(appBucket *bolt.Bucket, key, newKey []byte) error {
+	src := appBucket.Bucket(key)
+
+	dst, err := appBucket.CreateBucket(newKey)
+	if err != nil {
+		return fmt.Errorf("Can't move %s to %s: %v", key, newKey, err)
+	}
+
+	err = src.ForEach(func(k, v []byte) error {
+		return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	})
+	if err != nil {
+		return err
+	}
+
+	return appBucket.DeleteBucket(key)
+}
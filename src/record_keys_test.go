@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Record keys", func() {
+	var (
+		dir    string
+		boltDB *bolt.DB
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-record-keys")
+		Expect(err).NotTo(HaveOccurred())
+
+		boltDB, err = bolt.Open(filepath.Join(dir, "legacy.db"), 0600, nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		boltDB.Close()
+		os.RemoveAll(dir)
+	})
+
+	// putLegacyRecord saves the record of the trace1 trace under the legacy key
+	putLegacyRecord := func(key, message string) {
+		data, err := bson.Marshal(LogRecord{Message: message, Level: 1, CreatedAt: time.Now(), TraceID: "trace1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(boltDB.Update(func(tx *bolt.Tx) error {
+			appBucket, err := tx.CreateBucketIfNotExists([]byte("testapp"))
+			if err != nil {
+				return err
+			}
+
+			recordBucket, err := appBucket.CreateBucket([]byte(key))
+			if err != nil {
+				return err
+			}
+			if err = recordBucket.Put([]byte("level"), []byte{1}); err != nil {
+				return err
+			}
+			if err = recordBucket.Put([]byte("record"), data); err != nil {
+				return err
+			}
+
+			traceBucket, err := appBucket.CreateBucketIfNotExists(traceIndexBucket)
+			if err != nil {
+				return err
+			}
+
+			return traceBucket.Put(traceIndexKey("trace1", []byte(key)), []byte{})
+		})).To(Succeed())
+	}
+
+	// keys returns record keys and trace index keys of the application
+	keys := func() (recordKeys, traceKeys []string) {
+		Expect(boltDB.View(func(tx *bolt.Tx) error {
+			appBucket := tx.Bucket([]byte("testapp"))
+
+			err := forEachRecordBucket(appBucket, nil, nil, func(key []byte, _ *bolt.Bucket) error {
+				recordKeys = append(recordKeys, string(key))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return appBucket.Bucket(traceIndexBucket).ForEach(func(key, _ []byte) error {
+				traceKeys = append(traceKeys, string(key))
+				return nil
+			})
+		})).To(Succeed())
+		return
+	}
+
+	outdated := func() (result bool) {
+		Expect(boltDB.View(func(tx *bolt.Tx) error {
+			result = recordKeysOutdated(tx)
+			return nil
+		})).To(Succeed())
+		return
+	}
+
+	It("should put month before day", func() {
+		putLegacyRecord("2015-18-11T00:00:00.000_1", "Message November")
+		putLegacyRecord("2015-20-10T00:00:00.000_2", "Message October")
+		putLegacyRecord("2015-10-10T00:00:00.000_3", "Message Same")
+
+		Expect(outdated()).To(BeTrue())
+
+		Expect(migrateRecordKeys(boltDB)).To(Equal(2))
+		Expect(outdated()).To(BeFalse())
+
+		recordKeys, traceKeys := keys()
+		Expect(recordKeys).To(Equal([]string{
+			"2015-10-10T00:00:00.000_3",
+			"2015-10-20T00:00:00.000_2",
+			"2015-11-18T00:00:00.000_1",
+		}))
+		Expect(traceKeys).To(Equal([]string{
+			"trace1\x002015-10-10T00:00:00.000_3",
+			"trace1\x002015-10-20T00:00:00.000_2",
+			"trace1\x002015-11-18T00:00:00.000_1",
+		}))
+	})
+
+	It("should keep record contents", func() {
+		putLegacyRecord("2015-20-10T00:00:00.000_1", "Message October")
+
+		Expect(migrateRecordKeys(boltDB)).To(Equal(1))
+
+		Expect(boltDB.View(func(tx *bolt.Tx) error {
+			recordBucket := tx.Bucket([]byte("testapp")).Bucket([]byte("2015-10-20T00:00:00.000_1"))
+			Expect(recordBucket).NotTo(BeNil())
+			Expect(recordBucket.Get([]byte("level"))).To(Equal([]byte{1}))
+
+			var logRecord LogRecord
+			Expect(bson.Unmarshal(recordBucket.Get([]byte("record")), &logRecord)).To(Succeed())
+			Expect(logRecord.Message).To(Equal("Message October"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should migrate keys only once", func() {
+		putLegacyRecord("2015-20-10T00:00:00.000_1", "Message October")
+
+		Expect(migrateRecordKeys(boltDB)).To(Equal(1))
+		Expect(migrateRecordKeys(boltDB)).To(Equal(0))
+
+		recordKeys, _ := keys()
+		Expect(recordKeys).To(Equal([]string{"2015-10-20T00:00:00.000_1"}))
+	})
+
+	It("should mark empty DB file as migrated", func() {
+		Expect(outdated()).To(BeFalse())
+		Expect(migrateRecordKeys(boltDB)).To(Equal(0))
+
+		putLegacyRecord("2015-10-20T00:00:00.000_1", "Message October")
+		Expect(outdated()).To(BeFalse())
+	})
+
+	It("should keep the file as is when a key is invalid", func() {
+		putLegacyRecord("2015-20-10T00:00:00.000_1", "Message October")
+		putLegacyRecord("2015-10-40T00:00:00.000_2", "Message Invalid")
+
+		_, err := migrateRecordKeys(boltDB)
+		Expect(err).To(MatchError(ContainSubstring("Invalid record key")))
+
+		Expect(outdated()).To(BeTrue())
+
+		recordKeys, _ := keys()
+		Expect(recordKeys).To(ContainElement("2015-20-10T00:00:00.000_1"))
+	})
+})
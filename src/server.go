@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const defaultShutdownTimeout = 10 * time.Second
+
+var server *http.Server
+
 func startServer() {
 	bindAddress := config.Server.Address + ":" + config.Server.Port
 
@@ -13,10 +21,50 @@ func startServer() {
 
 	gin.SetMode(gin.ReleaseMode)
 
-	router := setupRouter()
+	server = &http.Server{
+		Addr:    bindAddress,
+		Handler: setupRouter(),
+	}
 
-	if err := router.Run(bindAddress); err != nil {
-		log.Fatalf("Can't start server: %v", err)
+	var tlsErr error
+
+	if tlsEnabled() {
+		if server.TLSConfig, tlsErr = prepareHTTPTLSConfig(); tlsErr != nil {
+			log.Fatalf("Can't prepare TLS config: %v", tlsErr)
+		}
+	}
+
+	go func() {
+		var err error
+
+		if tlsEnabled() {
+			err = server.ListenAndServeTLS(
+				absPathToFile(config.Server.TLS.Cert),
+				absPathToFile(config.Server.TLS.Key),
+			)
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Can't start server: %v", err)
+		}
+	}()
+}
+
+// stopServer stops accepting new connections and waits for the active
+// requests to be finished, but not longer than shutdown timeout
+func stopServer() {
+	timeout := time.Duration(config.Server.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown failed: %v", err)
 	}
 }
 
@@ -24,13 +72,89 @@ func setupRouter() (router *gin.Engine) {
 	router = gin.New()
 
 	router.Use(
+		abortResponses(),
 		gin.Recovery(),
-		gin.BasicAuth(gin.Accounts{config.Auth.User: config.Auth.Password}),
+		measureRequests(),
 	)
 
-	router.POST("/:application/put", createLogHandler)
-	router.GET("/:application/get", getLogsHandler)
-	router.GET("/:application/stats", appStatsHandler)
+	router.GET("/healthz", healthHandler)
+	router.GET("/readyz", readinessHandler)
+
+	authorized := router.Group("/", basicAuth())
+
+	if mutualTLSEnabled() {
+		authorized.Use(requireClientCert())
+	}
+
+	authorized.GET("/metrics", metricsHandler())
+	authorized.POST("/v1/logs", otlpLogsHandler)
+
+	if mutualTLSEnabled() {
+		authorized.POST("/:application/put", clientCertAuth(), createLogHandler)
+		authorized.POST("/:application/batch", clientCertAuth(), createLogsBatchHandler)
+		authorized.DELETE("/:application", clientCertAuth(), deleteLogsHandler)
+	} else {
+		authorized.POST("/:application/put", createLogHandler)
+		authorized.POST("/:application/batch", createLogsBatchHandler)
+		authorized.DELETE("/:application", deleteLogsHandler)
+	}
+	authorized.GET("/:application/get", getLogsHandler)
+	authorized.GET("/:application/stats", appStatsHandler)
+	authorized.GET("/search", searchLogsHandler)
+
+	// these work with Bolt files directly
+	if _, ok := storage.(boltStorage); ok {
+		authorized.GET("/backup", backupHandler)
+		authorized.POST("/compact", compactHandler)
+		authorized.GET("/shards", listShardsHandler)
+		authorized.DELETE("/shards", dropShardsHandler)
+		authorized.POST("/archive", archiveHandler)
+	}
 
 	return
 }
+
+// basicAuth works like gin.BasicAuth but takes credentials from the current
+// config on every request, so they can be changed by config reload
+func basicAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := currentConfig().Auth
+
+		user, password, ok := c.Request.BasicAuth()
+
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(auth.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) != 1 {
+			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+			c.AbortWithStatus(401)
+			return
+		}
+
+		c.Set(gin.AuthUserKey, user)
+		c.Next()
+	}
+}
+
+const responseAbortedKey = "responseAborted"
+
+// abortResponse makes abortResponses break the connection after the handler
+// returns. It's used when the response is already started, so an error status
+// can't be sent.
+func abortResponse(c *gin.Context) {
+	c.Set(responseAbortedKey, true)
+	c.Abort()
+}
+
+// abortResponses panics with http.ErrAbortHandler after handlers that called
+// abortResponse, so net/http breaks the connection instead of finishing the
+// response. It should be the first middleware since gin.Recovery would
+// recover the panic.
+func abortResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.GetBool(responseAbortedKey) {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
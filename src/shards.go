@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+const shardExt = ".db"
+
+// shardsCloseInterval is how often idle shards are looked for
+const shardsCloseInterval = time.Minute
+
+var errCreatedAtTooFar = errors.New("Created at is too far from now")
+
+// Shard periods and formats of their names
+var shardPeriodFormats = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// shard is a DB file that contains records of a single application created
+// within a single period. It has the same layout as the main DB.
+type shard struct {
+	application string
+	period      string
+	start       time.Time // UTC
+	path        string
+	db          *bolt.DB // nil while the shard is closed
+
+	// refs is the number of users of the open shard, it isn't closed until
+	// they release it
+	refs     int
+	lastUsed time.Time
+}
+
+// end returns start of the next period
+func (s *shard) end() time.Time {
+	switch s.period {
+	case "day":
+		return s.start.AddDate(0, 0, 1)
+	case "month":
+		return s.start.AddDate(0, 1, 0)
+	}
+	return s.start.AddDate(1, 0, 0)
+}
+
+// open opens shard DB if it isn't open yet. It should be called with
+// shardsLock held.
+func (s *shard) open() (err error) {
+	if s.db != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return
+	}
+
+	if s.db, err = bolt.Open(s.path, 0600, nil); err != nil {
+		return
+	}
+
+	if err = openRecordKeys(s.db); err != nil {
+		s.db.Close()
+		s.db = nil
+		return
+	}
+
+	openShardsN++
+
+	return
+}
+
+// close closes shard DB if it's open. It should be called with shardsLock
+// held and only when the shard isn't used.
+func (s *shard) close() {
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+		openShardsN--
+	}
+}
+
+// acquire opens the shard and marks it as used, so it isn't closed until it's
+// released. Least recently used shards are closed when too many of them are
+// open. It should be called with shardsLock held.
+func (s *shard) acquire() (*bolt.DB, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	s.refs++
+	s.lastUsed = time.Now()
+
+	closeLRUShards(currentConfig().Database.Shards.MaxOpen)
+
+	return s.db, nil
+}
+
+// releaseShard marks the shard as not used by the caller anymore
+func releaseShard(s *shard) {
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	s.refs--
+	s.lastUsed = time.Now()
+}
+
+var (
+	// shards are sorted by application and start
+	shards      []*shard
+	openShardsN int
+	shardsLock  sync.Mutex
+
+	shardsCloserStop    chan struct{}
+	shardsCloserRunning sync.WaitGroup
+)
+
+// closeLRUShards closes least recently used shards that aren't used until no
+// more than maxOpen shards are open. Zero maxOpen means no limit. It should be
+// called with shardsLock held.
+func closeLRUShards(maxOpen int) {
+	for maxOpen > 0 && openShardsN > maxOpen {
+		var lru *shard
+
+		for _, s := range shards {
+			if s.refs == 0 && s.db != nil && (lru == nil || s.lastUsed.Before(lru.lastUsed)) {
+				lru = s
+			}
+		}
+
+		// all open shards are used
+		if lru == nil {
+			return
+		}
+
+		lru.close()
+	}
+}
+
+// closeIdleShards closes shards that weren't used since the time
+func closeIdleShards(usedBefore time.Time) {
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	for _, s := range shards {
+		if s.refs == 0 && s.db != nil && s.lastUsed.Before(usedBefore) {
+			s.close()
+		}
+	}
+}
+
+// checkShardCreatedAt checks that the record created at the time doesn't
+// create a shard too far from now. Zero database.shards.maxSkew disables the
+// check.
+func checkShardCreatedAt(createdAt time.Time) error {
+	conf := currentConfig().Database.Shards
+	if conf.Period == "" || conf.MaxSkew == 0 || createdAt.IsZero() {
+		return nil
+	}
+
+	maxSkew := time.Duration(conf.MaxSkew) * 24 * time.Hour
+
+	if skew := time.Since(createdAt); skew > maxSkew || skew < -maxSkew {
+		return errCreatedAtTooFar
+	}
+
+	return nil
+}
+
+// shardPeriodStart returns start of the period containing t
+func shardPeriodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+
+	switch period {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// escapeShardDirName makes the application name safe to be used as a dir name
+func escapeShardDirName(application string) string {
+	name := url.PathEscape(application)
+
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+
+	return name
+}
+
+func shardPath(dir, application, period string, start time.Time) string {
+	return filepath.Join(
+		absPathToFile(dir),
+		escapeShardDirName(application),
+		start.Format(shardPeriodFormats[period])+shardExt,
+	)
+}
+
+// parseShardPath parses application and period from the shard path
+func parseShardPath(path string) (s *shard, err error) {
+	application, err := url.PathUnescape(filepath.Base(filepath.Dir(path)))
+	if err != nil {
+		return
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), shardExt)
+
+	for period, format := range shardPeriodFormats {
+		if len(name) != len(format) {
+			continue
+		}
+
+		start, err := time.ParseInLocation(format, name, time.UTC)
+		if err == nil {
+			return &shard{application: application, period: period, start: start, path: path}, nil
+		}
+	}
+
+	return nil, errors.New("Invalid shard name")
+}
+
+func sortShards() {
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].application != shards[j].application {
+			return shards[i].application < shards[j].application
+		}
+		return shards[i].start.Before(shards[j].start)
+	})
+}
+
+// initShards registers existing shard files. Shards are opened on demand.
+func initShards() {
+	dir := currentConfig().Database.Shards.Dir
+	if dir == "" {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(absPathToFile(dir), "*", "*"+shardExt))
+	checkErr(err, "Can't list shards")
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	shards = nil
+
+	for _, path := range paths {
+		s, err := parseShardPath(path)
+		checkErr(err, "Can't parse shard path "+path)
+
+		shards = append(shards, s)
+	}
+
+	sortShards()
+
+	startShardsCloser()
+}
+
+// startShardsCloser closes shards that weren't used for
+// database.shards.idleTimeout minutes in the background
+func startShardsCloser() {
+	idleTimeout := time.Duration(currentConfig().Database.Shards.IdleTimeout) * time.Minute
+	if idleTimeout == 0 {
+		return
+	}
+
+	shardsCloserStop = make(chan struct{})
+	shardsCloserRunning.Add(1)
+
+	go func(stop chan struct{}) {
+		defer shardsCloserRunning.Done()
+
+		ticker := time.NewTicker(shardsCloseInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				closeIdleShards(time.Now().Add(-idleTimeout))
+			}
+		}
+	}(shardsCloserStop)
+}
+
+func closeShards() {
+	if shardsCloserStop != nil {
+		close(shardsCloserStop)
+		shardsCloserRunning.Wait()
+		shardsCloserStop = nil
+	}
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	for _, s := range shards {
+		s.close()
+	}
+
+	shards = nil
+}
+
+// writeDB returns DB the record created at createdAt should be saved to and
+// its shard, which should be released after use. The shard is nil for the main
+// DB. It should be called with dbLock held.
+func writeDB(application string, createdAt time.Time) (*bolt.DB, *shard, error) {
+	conf := currentConfig().Database.Shards
+	if conf.Period == "" {
+		return db, nil, nil
+	}
+
+	start := shardPeriodStart(createdAt, conf.Period)
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	for _, s := range shards {
+		if s.application == application && !createdAt.Before(s.start) && createdAt.Before(s.end()) {
+			boltDB, err := s.acquire()
+			if err != nil {
+				return nil, nil, err
+			}
+			return boltDB, s, nil
+		}
+	}
+
+	if err := checkShardCreatedAt(createdAt); err != nil {
+		return nil, nil, err
+	}
+
+	s := &shard{
+		application: application,
+		period:      conf.Period,
+		start:       start,
+		path:        shardPath(conf.Dir, application, conf.Period, start),
+	}
+
+	shards = append(shards, s)
+	sortShards()
+
+	boltDB, err := s.acquire()
+	if err != nil {
+		shards = removeShard(shards, s)
+		return nil, nil, err
+	}
+
+	return boltDB, s, nil
+}
+
+func removeShard(list []*shard, s *shard) []*shard {
+	for i := range list {
+		if list[i] == s {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// dbSource is a DB that may contain records of an application. start and end
+// are bounds of the shard period, they are zero for the main DB.
+type dbSource struct {
+	shard *shard // nil for the main DB
+	start time.Time
+	end   time.Time
+}
+
+// acquire returns DB of the source opening the shard if needed. The shard
+// isn't closed until the source is released.
+func (s dbSource) acquire() (*bolt.DB, error) {
+	if s.shard == nil {
+		return db, nil
+	}
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	return s.shard.acquire()
+}
+
+func (s dbSource) release() {
+	if s.shard != nil {
+		releaseShard(s.shard)
+	}
+}
+
+// keyRange returns range of record keys of the time range narrowed to the
+// shard period
+func (s dbSource) keyRange(startTime, endTime time.Time) (keyStart, keyEnd []byte) {
+	if !s.start.IsZero() && startTime.Before(s.start) {
+		startTime = s.start
+	}
+
+	if !s.end.IsZero() && !endTime.Before(s.end) {
+		endTime = s.end.Add(-time.Nanosecond)
+	}
+
+	return recordKey(startTime, ""), recordKey(endTime, "_")
+}
+
+// appDBs returns the main DB and shards of the application that overlap the
+// time range in chronological order. Zero times mean no bounds. Shards aren't
+// opened until sources are acquired. It should be called with dbLock held.
+func appDBs(application string, startTime, endTime time.Time) (sources []dbSource) {
+	sources = []dbSource{{}}
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	for _, s := range shards {
+		if s.application != application ||
+			(!startTime.IsZero() && !startTime.Before(s.end())) ||
+			(!endTime.IsZero() && endTime.Before(s.start)) {
+			continue
+		}
+
+		sources = append(sources, dbSource{s, s.start, s.end()})
+	}
+
+	return
+}
+
+// viewAppDBs calls fn with read-only transaction of every DB returned by
+// appDBs until fn returns true. Shards are opened one at a time.
+func viewAppDBs(application string, startTime, endTime time.Time, fn func(tx *bolt.Tx, source dbSource) (done bool, err error)) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	for _, source := range appDBs(application, startTime, endTime) {
+		done, err := viewDBSource(source, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func viewDBSource(source dbSource, fn func(tx *bolt.Tx, source dbSource) (done bool, err error)) (done bool, err error) {
+	boltDB, err := source.acquire()
+	if err != nil {
+		return
+	}
+	defer source.release()
+
+	err = boltDB.View(func(tx *bolt.Tx) (err error) {
+		done, err = fn(tx, source)
+		return
+	})
+
+	return
+}
+
+// shardApplications returns names of applications that have shards
+func shardApplications() (applications []string) {
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	for i, s := range shards {
+		if i == 0 || shards[i-1].application != s.application {
+			applications = append(applications, s.application)
+		}
+	}
+
+	return
+}
+
+// ShardInfo describes a shard file
+type ShardInfo struct {
+	Application string    `json:"application"`
+	Period      string    `json:"period"`
+	Start       time.Time `json:"start"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+}
+
+func (s *shard) info() ShardInfo {
+	size, _ := fileSize(s.path)
+	return ShardInfo{s.application, s.period, s.start, s.path, size}
+}
+
+func listShards() (infos []ShardInfo) {
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	infos = make([]ShardInfo, len(shards))
+	for i, s := range shards {
+		infos[i] = s.info()
+	}
+
+	return
+}
+
+// dropShards closes and removes shards of the applications that entirely
+// precede the time. If archiveDir is set, shard files are moved there
+// instead of removing.
+func dropShards(patterns []string, before time.Time, archiveDir string) (dropped []ShardInfo, err error) {
+	compactLock.Lock()
+	defer compactLock.Unlock()
+
+	writesLock.Lock()
+	defer writesLock.Unlock()
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	shardsLock.Lock()
+	defer shardsLock.Unlock()
+
+	kept := shards[:0:0]
+
+	for i, s := range shards {
+		matched, err := matchApplication(patterns, s.application)
+		if err != nil {
+			return dropped, err
+		}
+
+		if !matched || s.end().After(before) {
+			kept = append(kept, s)
+			continue
+		}
+
+		info := s.info()
+
+		s.close()
+
+		if archiveDir != "" {
+			err = archiveShard(s, archiveDir)
+		} else {
+			err = os.Remove(s.path)
+		}
+
+		if err != nil {
+			shards = append(kept, shards[i:]...)
+			return dropped, err
+		}
+
+		dropped = append(dropped, info)
+	}
+
+	shards = kept
+
+	return
+}
+
+func archiveShard(s *shard, archiveDir string) error {
+	path := shardPath(archiveDir, s.application, s.period, s.start)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.Rename(s.path, path)
+}
+
+// Action: Shards ==============================================================
+
+func listShardsHandler(c *gin.Context) {
+	c.JSON(200, listShards())
+}
+
+func dropShardsHandler(c *gin.Context) {
+	beforeStr := c.Query("before")
+	applications := uniqStrings(extractTags(c.Query("applications")))
+
+	if len(applications) == 0 {
+		applications = []string{"*"}
+	}
+
+	if !checkDateTimeFormat(beforeStr) {
+		c.JSON(422, ErrorResponse{"Before has invalid format"})
+		return
+	}
+
+	if err := checkApplicationPatterns(applications); err != nil {
+		c.JSON(422, ErrorResponse{err.Error()})
+		return
+	}
+
+	before, _ := parseDateTime(beforeStr, false)
+
+	dropped, err := dropShards(applications, before, currentConfig().Database.Shards.ArchiveDir)
+	panicOnErr(err)
+
+	if dropped == nil {
+		dropped = []ShardInfo{}
+	}
+
+	c.JSON(200, dropped)
+}
+
+// end of Action: Shards
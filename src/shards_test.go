@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shards", func() {
+	var dir string
+
+	saveRecord := func(application, message string, createdAt time.Time) {
+		saveTestLogRecord(application, message, 1, createdAt)
+	}
+
+	jan := time.Date(2015, 1, 15, 10, 0, 0, 0, time.UTC)
+	feb := time.Date(2015, 2, 15, 10, 0, 0, 0, time.UTC)
+	mar := time.Date(2015, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-shards")
+		Expect(err).NotTo(HaveOccurred())
+
+		config.Database.Shards.Period = "month"
+		config.Database.Shards.Dir = filepath.Join(dir, "shards")
+		initShards()
+	})
+
+	AfterEach(func() {
+		closeShards()
+		config.Database.Shards.Period = ""
+		config.Database.Shards.Dir = ""
+		config.Database.Shards.ArchiveDir = ""
+		config.Database.Shards.MaxOpen = 0
+		config.Database.Shards.MaxSkew = 0
+		os.RemoveAll(dir)
+	})
+
+	It("should save records to shard files", func() {
+		saveRecord("testapp1", "Message 1", jan)
+		saveRecord("testapp1", "Message 2", feb)
+		saveRecord("../testapp2", "Message 3", feb)
+
+		Expect(filepath.Join(dir, "shards", "testapp1", "2015-01.db")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "shards", "testapp1", "2015-02.db")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "shards", "%2E.%2Ftestapp2", "2015-02.db")).To(BeAnExistingFile())
+
+		Expect(db.View(func(tx *bolt.Tx) error {
+			Expect(tx.Bucket([]byte("testapp1"))).To(BeNil())
+			return nil
+		})).To(Succeed())
+	})
+
+	Describe("loadLogRecords", func() {
+		It("should load records from all shards of the time range in order", func() {
+			saveRecord("testapp1", "Message 2", feb)
+			saveRecord("testapp1", "Message 1", jan)
+			saveRecord("testapp1", "Message 3", mar)
+			saveRecord("testapp2", "Message 4", feb)
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), feb.Add(time.Hour), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+		})
+
+		It("should paginate across shards", func() {
+			config.Pagination.PerPage = 2
+			defer func() { config.Pagination.PerPage = 100 }()
+
+			saveRecord("testapp1", "Message 1", jan)
+			saveRecord("testapp1", "Message 2", feb)
+			saveRecord("testapp1", "Message 3", mar)
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), mar.Add(time.Hour), 2)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 3"}))
+		})
+
+		It("should load records saved before sharding was enabled", func() {
+			config.Database.Shards.Period = ""
+			saveRecord("testapp1", "Message 1", jan)
+			config.Database.Shards.Period = "month"
+			saveRecord("testapp1", "Message 2", jan.Add(time.Minute))
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), jan.Add(time.Hour), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+		})
+
+		It("should find existing shards after restart", func() {
+			saveRecord("testapp1", "Message 1", jan)
+
+			closeShards()
+			initShards()
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), jan.Add(time.Hour), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1"}))
+		})
+	})
+
+	Describe("open shards", func() {
+		loadAll := func() []string {
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), mar.Add(time.Hour), 1)
+			Expect(err).NotTo(HaveOccurred())
+			return logRecordMessages(logRecords)
+		}
+
+		BeforeEach(func() {
+			saveRecord("testapp1", "Message 1", jan)
+			saveRecord("testapp1", "Message 2", feb)
+			saveRecord("testapp1", "Message 3", mar)
+		})
+
+		It("should close least recently used shards above maxOpen", func() {
+			config.Database.Shards.MaxOpen = 2
+
+			Expect(loadAll()).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+			Expect(openShardsN).To(Equal(2))
+
+			for _, s := range shards {
+				Expect(s.db != nil).To(Equal(s.start.Month() != time.January))
+			}
+		})
+
+		It("should close idle shards", func() {
+			closeIdleShards(time.Now())
+
+			Expect(openShardsN).To(BeZero())
+			Expect(loadAll()).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+		})
+
+		It("should not close used shards", func() {
+			config.Database.Shards.MaxOpen = 1
+
+			source := appDBs("testapp1", feb, feb)[1]
+			_, err := source.acquire()
+			Expect(err).NotTo(HaveOccurred())
+
+			closeIdleShards(time.Now().Add(time.Hour))
+			Expect(source.shard.db).NotTo(BeNil())
+
+			saveRecord("testapp1", "Message 4", jan)
+			Expect(source.shard.db).NotTo(BeNil())
+
+			source.release()
+			closeIdleShards(time.Now().Add(time.Hour))
+			Expect(source.shard.db).To(BeNil())
+			Expect(openShardsN).To(BeZero())
+		})
+	})
+
+	Describe("maxSkew", func() {
+		BeforeEach(func() {
+			config.Database.Shards.MaxSkew = 30
+		})
+
+		It("should not create shards for records far from now", func() {
+			logRecord := LogRecord{Message: "Message 1", Level: 1, CreatedAt: jan}
+
+			Expect(saveLogRecord("testapp1", &logRecord)).To(Equal(errCreatedAtTooFar))
+			Expect(listShards()).To(BeEmpty())
+
+			saveRecord("testapp1", "Message 2", time.Now().AddDate(0, 0, -29))
+			Expect(listShards()).To(HaveLen(1))
+		})
+
+		It("should reject records far from now on input", func() {
+			logRecord := LogRecord{Message: "Message 1", Level: 1, CreatedAt: time.Now().AddDate(0, 0, 31)}
+
+			Expect(checkInputRecord("testapp1", &logRecord)).To(Equal(errCreatedAtTooFar))
+		})
+
+		It("should reject records far from now on /put", func() {
+			gin.SetMode(gin.TestMode)
+			router = setupRouter()
+
+			Expect(sendRequest("POST", "/testapp1/put", "message=Message&level=1&created_at=2015-01-15T10:00:00.000%2B00:00")).To(Succeed())
+
+			Expect(response.Code).To(Equal(422))
+			Expect(response.Body.String()).To(ContainSubstring("Created at is too far from now"))
+			Expect(listShards()).To(BeEmpty())
+		})
+	})
+
+	It("should load trace records from all shards", func() {
+		saveRecord("testapp1", "Message 1", jan)
+		saveRecord("testapp1", "Message 2", feb)
+
+		logRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+	})
+
+	It("should search records across applications and shards", func() {
+		saveRecord("testapp1", "Message 1", jan)
+		saveRecord("testapp2", "Message 2", jan.Add(time.Minute))
+		saveRecord("testapp1", "Message 3", feb)
+
+		logRecords, err := searchLogRecords([]string{"testapp*"}, 0, []string{}, jan.Add(-time.Hour), feb.Add(time.Hour), 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecords).To(HaveLen(3))
+		Expect(logRecords[0].Message).To(Equal("Message 1"))
+		Expect(logRecords[1].Message).To(Equal("Message 2"))
+		Expect(logRecords[1].Application).To(Equal("testapp2"))
+		Expect(logRecords[2].Message).To(Equal("Message 3"))
+	})
+
+	It("should sum stats of all shards", func() {
+		saveRecord("testapp1", "Message 1", jan)
+		saveRecord("testapp1", "Message 2", feb)
+
+		stats, err := appStats("testapp1")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.(bolt.BucketStats).BucketN).To(BeNumerically(">=", 4))
+	})
+
+	It("should keep shards data on compaction", func() {
+		saveRecord("testapp1", "Message 1", jan)
+		saveRecord("testapp1", "Message 2", feb)
+
+		_, _, err := compactDB()
+		Expect(err).NotTo(HaveOccurred())
+
+		logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), feb.Add(time.Hour), 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+	})
+
+	It("should back up shards into tar archive", func() {
+		saveRecord("testapp1", "Message 1", jan)
+
+		var buf bytes.Buffer
+		Expect(writeBackup(&buf, shardedBackup())).To(Succeed())
+
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			names = append(names, header.Name)
+		}
+
+		Expect(names).To(Equal([]string{"logbook.db", "shards/testapp1/2015-01.db"}))
+	})
+
+	Describe("dropShards", func() {
+		BeforeEach(func() {
+			saveRecord("testapp1", "Message 1", jan)
+			saveRecord("testapp1", "Message 2", feb)
+			saveRecord("testapp2", "Message 3", jan)
+		})
+
+		It("should remove shards preceding the time", func() {
+			dropped, err := dropShards([]string{"testapp1"}, time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC), "")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(HaveLen(1))
+			Expect(dropped[0].Path).To(Equal(filepath.Join(dir, "shards", "testapp1", "2015-01.db")))
+			Expect(dropped[0].Path).NotTo(BeAnExistingFile())
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, jan.Add(-time.Hour), feb.Add(time.Hour), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2"}))
+
+			Expect(listShards()).To(HaveLen(2))
+		})
+
+		It("should move shards to archive dir", func() {
+			archiveDir := filepath.Join(dir, "archive")
+
+			_, err := dropShards([]string{"*"}, time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC), archiveDir)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(archiveDir, "testapp1", "2015-01.db")).To(BeAnExistingFile())
+			Expect(filepath.Join(archiveDir, "testapp2", "2015-01.db")).To(BeAnExistingFile())
+			Expect(listShards()).To(HaveLen(1))
+		})
+	})
+
+	Describe("/shards", func() {
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			router = setupRouter()
+
+			saveRecord("testapp1", "Message 1", jan)
+			saveRecord("testapp1", "Message 2", feb)
+		})
+
+		It("should list shards", func() {
+			Expect(sendRequest("GET", "/shards")).To(Succeed())
+			Expect(response.Code).To(Equal(200))
+
+			parsedRes := []ShardInfo{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &parsedRes)).To(Succeed())
+			Expect(parsedRes).To(HaveLen(2))
+			Expect(parsedRes[0].Application).To(Equal("testapp1"))
+			Expect(parsedRes[0].Period).To(Equal("month"))
+			Expect(parsedRes[0].Start).To(BeTemporally("==", time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(parsedRes[0].Size).To(BeNumerically(">", 0))
+		})
+
+		It("should drop shards", func() {
+			Expect(sendRequest("DELETE", "/shards?before=2015-02-01&applications=test*")).To(Succeed())
+			Expect(response.Code).To(Equal(200))
+
+			parsedRes := []ShardInfo{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &parsedRes)).To(Succeed())
+			Expect(parsedRes).To(HaveLen(1))
+		})
+
+		It("should validate before param", func() {
+			Expect(sendRequest("DELETE", "/shards?before=2015-02-011")).To(Succeed())
+			Expect(response.Code).To(Equal(422))
+		})
+	})
+})
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForShutdownSignal blocks until SIGINT or SIGTERM is received. Config is
+// reloaded on every SIGHUP received meanwhile.
+func waitForShutdownSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		reloadConfig()
+	}
+
+	signal.Stop(signals)
+}
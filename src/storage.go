@@ -1,179 +1,251 @@
 package main
 
 import (
-	"bytes"
 	"errors"
-	"strconv"
+	"path"
+	"sync"
 	"time"
+)
+
+// Storage keeps log records. Implementations should be safe for concurrent
+// use.
+type Storage interface {
+	Open() error
+	// Close is called after all pending writes are finished
+	Close() error
+	// Ready returns an error if records can't be saved
+	Ready() error
+
+	// Save saves records of any applications. CreatedAt of records is always
+	// set.
+	Save(records []ApplicationLogRecord) error
+	// Load returns the page of records of the application created within the
+	// time range in chronological order. Only records with level not lower
+	// than lvl and having all the tags are returned.
+	Load(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (LogRecords, error)
+	// LoadTrace works like Load but returns records of the trace
+	LoadTrace(application string, traceID string, lvl int, tags []string, page int) (LogRecords, error)
+	// Search works like Load but returns records of every application that
+	// matches any of the patterns
+	Search(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (SearchLogRecords, error)
+	// Stats returns storage-specific stats of the application. It returns
+	// errUnknownApplication if there are no records of the application.
+	Stats(application string) (interface{}, error)
+	// Delete removes records of the application created before the time and
+	// returns their number
+	Delete(application string, before time.Time) (int, error)
+}
 
-	"github.com/boltdb/bolt"
-	"gopkg.in/mgo.v2/bson"
+// Storage drivers selectable by database.driver
+var storageDrivers = map[string]func() Storage{
+	"bolt":   func() Storage { return boltStorage{} },
+	"memory": func() Storage { return newMemoryStorage() },
+	"leveldb": func() Storage {
+		return newLevelDBStorage(currentConfig().Database.LevelDB.Path)
+	},
+}
+
+var (
+	storage       Storage
+	pendingWrites sync.WaitGroup
 )
 
-var db *bolt.DB
+var (
+	errDBNotOpen          = errors.New("Database isn't open")
+	errUnknownApplication = errors.New("Unknown application")
+)
 
 type LogRecord struct {
 	Message   string    `json:"message"`
 	Level     int       `json:"level"`
 	Tags      []string  `json:"tags"`
 	CreatedAt time.Time `json:"created_at"`
+	TraceID   string    `json:"trace_id,omitempty" bson:"trace_id,omitempty"`
+	SpanID    string    `json:"span_id,omitempty" bson:"span_id,omitempty"`
 }
 
 type LogRecords []LogRecord
 
+// SearchLogRecord is a log record found by cross-application search
+type SearchLogRecord struct {
+	Application string `json:"application"`
+	LogRecord
+}
+
+type SearchLogRecords []SearchLogRecord
+
+// ApplicationLogRecord is a log record along with the application it belongs
+// to
+type ApplicationLogRecord struct {
+	Application string
+	LogRecord   *LogRecord
+}
+
 func initDB() {
-	var err error
+	driver := currentConfig().Database.Driver
+	if driver == "" {
+		driver = "bolt"
+	}
+
+	newStorage, ok := storageDrivers[driver]
+	if !ok {
+		checkErr(errors.New("Unknown driver "+driver), "Can't open database")
+	}
 
-	db, err = bolt.Open(absPathToFile(config.Database.Path), 0600, nil)
-	checkErr(err, "bolt.Open failed")
+	storage = newStorage()
+	checkErr(storage.Open(), "Can't open database")
+
+	checkErr(startJournal(), "Can't open journal")
 }
 
+// closeDB waits for the writes in flight to be committed and closes DB
 func closeDB() {
-	db.Close()
+	pendingWrites.Wait()
+
+	stopJournal()
+
+	storage.Close()
 }
 
-func recordKey(createdAt time.Time, suffix string) []byte {
-	buf := bytes.NewBufferString(
-		createdAt.UTC().Format("2006-02-01T15:04:05.000"),
-	)
-	buf.WriteString("_")
-	buf.WriteString(suffix)
-	return buf.Bytes()
+// checkDBWritable makes sure DB is open and writable
+func checkDBWritable() error {
+	if storage == nil {
+		return errDBNotOpen
+	}
+
+	return storage.Ready()
 }
 
-func tagKey(tag string) []byte {
-	buf := bytes.NewBufferString("tag_")
-	buf.WriteString(tag)
-	return buf.Bytes()
+func saveLogRecord(application string, logRecord *LogRecord) error {
+	return saveLogRecords([]ApplicationLogRecord{{application, logRecord}})
 }
 
-func saveLogRecord(application string, logRecord *LogRecord) (err error) {
-	if logRecord.CreatedAt.IsZero() {
-		logRecord.CreatedAt = time.Now()
+// saveLogRecords saves log records of any applications in a single
+// transaction. When the journal is enabled, records are only appended to it
+// and saved to storage later.
+func saveLogRecords(records []ApplicationLogRecord) (err error) {
+	pendingWrites.Add(1)
+	defer pendingWrites.Done()
+
+	for _, record := range records {
+		if record.LogRecord.CreatedAt.IsZero() {
+			record.LogRecord.CreatedAt = time.Now()
+		}
 	}
 
-	data, err := bson.Marshal(&logRecord)
-	if err != nil {
-		return
+	if journal != nil {
+		err = journal.append(records)
+	} else {
+		err = storeLogRecords(records)
 	}
 
-	err = db.Batch(func(tx *bolt.Tx) (err error) {
-		appBucket, err := tx.CreateBucketIfNotExists([]byte(application))
-		if err != nil {
-			return
+	if err == nil {
+		for _, record := range records {
+			observeIngestedRecord(record.Application, record.LogRecord.Level)
 		}
+	}
 
-		id, _ := appBucket.NextSequence()
-		key := recordKey(logRecord.CreatedAt, strconv.Itoa(int(id)))
+	return
+}
 
-		recordBucket, err := appBucket.CreateBucket(key)
-		if err != nil {
-			return
-		}
+// storeLogRecords saves records to storage
+func storeLogRecords(records []ApplicationLogRecord) error {
+	batchStart := time.Now()
 
-		if err = recordBucket.Put([]byte("level"), []byte{byte(logRecord.Level)}); err != nil {
-			return
-		}
+	err := storage.Save(records)
 
-		for _, tag := range logRecord.Tags {
-			if err = recordBucket.Put(tagKey(tag), []byte{1}); err != nil {
-				return
-			}
-		}
+	observeBatch(batchStart)
 
-		if err = recordBucket.Put([]byte("record"), data); err != nil {
-			return
-		}
+	return err
+}
 
-		return
-	})
+func loadLogRecords(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (LogRecords, error) {
+	return storage.Load(application, lvl, tags, startTime, endTime, page)
+}
 
-	return
+func loadTraceLogRecords(application string, traceID string, lvl int, tags []string, page int) (LogRecords, error) {
+	return storage.LoadTrace(application, traceID, lvl, tags, page)
 }
 
-func loadLogRecords(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (logRecords LogRecords, err error) {
-	keyStart := recordKey(startTime, "")
-	keyEnd := recordKey(endTime, "_")
+func searchLogRecords(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (SearchLogRecords, error) {
+	return storage.Search(patterns, lvl, tags, startTime, endTime, page)
+}
 
-	offset := (page - 1) * config.Pagination.PerPage
+func appStats(application string) (interface{}, error) {
+	return storage.Stats(application)
+}
 
-	rawRecords := make([][]byte, config.Pagination.PerPage)
-	fetched := 0
+func deleteLogRecords(application string, before time.Time) (int, error) {
+	return storage.Delete(application, before)
+}
 
-	err = db.View(func(tx *bolt.Tx) (err error) {
-		appBucket := tx.Bucket([]byte(application))
-		if appBucket == nil {
-			return
-		}
+// recordTime truncates the time to milliseconds, the precision of Bolt keys.
+// All storages compare creation time with this precision.
+func recordTime(t time.Time) time.Time {
+	return t.Truncate(time.Millisecond)
+}
 
-		cursor := appBucket.Cursor()
+// inTimeRange returns a filter function for the time range
+func inTimeRange(startTime time.Time, endTime time.Time) func(*LogRecord) bool {
+	startTime, endTime = recordTime(startTime), recordTime(endTime)
 
-		for key, _ := cursor.Seek(keyStart); key != nil && bytes.Compare(key, keyEnd) <= 0; key, _ = cursor.Next() {
-			recordBucket := appBucket.Bucket(key)
-			if recordBucket == nil {
-				// just for sure
-				continue
-			}
+	return func(logRecord *LogRecord) bool {
+		createdAt := recordTime(logRecord.CreatedAt)
+		return !createdAt.Before(startTime) && !createdAt.After(endTime)
+	}
+}
 
-			if lvl > 0 {
-				recordLvl := recordBucket.Get([]byte("level"))
-				if recordLvl == nil || recordLvl[0] < byte(lvl) {
-					continue
-				}
-			}
+// pageBounds returns bounds of the page in the list of n records
+func pageBounds(n int, page int) (start, end int) {
+	perPage := currentConfig().Pagination.PerPage
 
-			tagMissed := false
-			for _, tag := range tags {
-				if recordBucket.Get(tagKey(tag)) == nil {
-					tagMissed = true
-					break
-				}
-			}
-			if tagMissed {
-				continue
-			}
+	start = (page - 1) * perPage
+	if start > n {
+		start = n
+	}
 
-			if offset > 0 {
-				offset--
-				continue
-			}
+	end = start + perPage
+	if end > n {
+		end = n
+	}
 
-			record := recordBucket.Get([]byte("record"))
-			if record == nil {
-				continue
-			}
+	return
+}
 
-			rawRecords[fetched] = make([]byte, len(record))
-			copy(rawRecords[fetched], record)
+// matchLogRecord reports whether the record has level not lower than lvl and
+// all the tags
+func matchLogRecord(logRecord *LogRecord, lvl int, tags []string) bool {
+	if logRecord.Level < lvl {
+		return false
+	}
+
+	for _, tag := range tags {
+		found := false
 
-			fetched++
-			if fetched == config.Pagination.PerPage {
+		for _, recordTag := range logRecord.Tags {
+			if recordTag == tag {
+				found = true
 				break
 			}
 		}
 
-		return
-	})
-
-	logRecords = make(LogRecords, fetched)
-	for i := 0; i < fetched; i++ {
-		if err = bson.Unmarshal(rawRecords[i], &logRecords[i]); err != nil {
-			return
+		if !found {
+			return false
 		}
 	}
 
-	return
+	return true
 }
 
-func appStats(application string) (stats bolt.BucketStats, err error) {
-	err = db.View(func(tx *bolt.Tx) (err error) {
-		appBucket := tx.Bucket([]byte(application))
-		if appBucket == nil {
-			err = errors.New("Unknown application")
-		} else {
-			stats = appBucket.Stats()
+// matchApplication reports whether the application matches any of the
+// patterns. Patterns have path.Match syntax.
+func matchApplication(patterns []string, application string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, application)
+		if err != nil || matched {
+			return matched, err
 		}
-		return
-	})
-	return
+	}
+
+	return false, nil
 }
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// traceIndexBucket is a bucket inside of application bucket that maps trace
+// IDs to record keys. Its name can't clash with record keys since they start
+// with a digit.
+var traceIndexBucket = []byte("_trace_index")
+
+const recordKeyTimeFormat = "2006-01-02T15:04:05.000"
+
+var (
+	db *bolt.DB
+
+	// dbLock guards db from being swapped while it's in use
+	dbLock sync.RWMutex
+	// writesLock pauses writes while DB is being compacted
+	writesLock sync.RWMutex
+)
+
+var errDBLocked = errors.New("Database is locked, is the server running?")
+
+// boltStorage keeps records in the Bolt DB at database.path and its shards
+type boltStorage struct{}
+
+func (boltStorage) Open() (err error) {
+	db, err = bolt.Open(absPathToFile(currentConfig().Database.Path), 0600, nil)
+	if err != nil {
+		return
+	}
+
+	if err = openRecordKeys(db); err != nil {
+		return
+	}
+
+	initShards()
+	initCompression()
+
+	return
+}
+
+func (boltStorage) Close() error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	closeShards()
+
+	return db.Close()
+}
+
+// Ready runs an empty write transaction to make sure DB is open and writable
+func (boltStorage) Ready() error {
+	return updateDB(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// openDBReadOnly opens DB at the path for reading. It fails when DB is locked
+// by a running server.
+func openDBReadOnly(path string) (err error) {
+	db, err = openBoltReadOnly(path)
+	return
+}
+
+// openBoltReadOnly opens Bolt file at the path for reading
+func openBoltReadOnly(path string) (*bolt.DB, error) {
+	boltDB, err := bolt.Open(absPathToFile(path), 0600, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  time.Second,
+	})
+
+	if err == bolt.ErrTimeout {
+		err = errDBLocked
+	}
+
+	return boltDB, err
+}
+
+// viewDB runs read-only transaction. All DB reads should go through it.
+func viewDB(fn func(*bolt.Tx) error) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return errDBNotOpen
+	}
+
+	return db.View(fn)
+}
+
+// updateDB runs read-write transaction. It waits while writes are paused.
+func updateDB(fn func(*bolt.Tx) error) error {
+	writesLock.RLock()
+	defer writesLock.RUnlock()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return errDBNotOpen
+	}
+
+	return db.Update(fn)
+}
+
+func recordKey(createdAt time.Time, suffix string) []byte {
+	buf := bytes.NewBufferString(
+		createdAt.UTC().Format(recordKeyTimeFormat),
+	)
+	buf.WriteString("_")
+	buf.WriteString(suffix)
+	return buf.Bytes()
+}
+
+// recordKeyTime parses creation time of the record from its key
+func recordKeyTime(key []byte) (time.Time, error) {
+	if len(key) < len(recordKeyTimeFormat) {
+		return time.Time{}, errors.New("Invalid record key")
+	}
+
+	return time.Parse(recordKeyTimeFormat, string(key[:len(recordKeyTimeFormat)]))
+}
+
+func tagKey(tag string) []byte {
+	buf := bytes.NewBufferString("tag_")
+	buf.WriteString(tag)
+	return buf.Bytes()
+}
+
+func traceIndexKey(traceID string, recordKey []byte) []byte {
+	buf := bytes.NewBufferString(traceID)
+	buf.WriteByte(0)
+	buf.Write(recordKey)
+	return buf.Bytes()
+}
+
+// Save compresses records according to database.compression and saves them
+func (boltStorage) Save(records []ApplicationLogRecord) (err error) {
+	data := make([][]byte, len(records))
+	dicts := make([]*recordDictionary, len(records))
+
+	for i, record := range records {
+		if data[i], err = bson.Marshal(record.LogRecord); err != nil {
+			return
+		}
+
+		data[i], dicts[i] = compressor.compress(data[i])
+	}
+
+	return batchLogRecords(records, data, dicts)
+}
+
+// batchLogRecords puts records into DBs they belong to. Records of every DB
+// are put in a single db.Batch transaction along with dictionaries they are
+// compressed with.
+func batchLogRecords(records []ApplicationLogRecord, data [][]byte, dicts []*recordDictionary) error {
+	writesLock.RLock()
+	defer writesLock.RUnlock()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return errDBNotOpen
+	}
+
+	var targets []*bolt.DB
+	indexes := make(map[*bolt.DB][]int)
+
+	for i, record := range records {
+		target, s, err := writeDB(record.Application, record.LogRecord.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			defer releaseShard(s)
+		}
+
+		if _, ok := indexes[target]; !ok {
+			targets = append(targets, target)
+		}
+		indexes[target] = append(indexes[target], i)
+	}
+
+	for _, target := range targets {
+		err := target.Batch(func(tx *bolt.Tx) (err error) {
+			for _, i := range indexes[target] {
+				if dicts[i] != nil {
+					if err = putDictionary(tx, dicts[i]); err != nil {
+						return
+					}
+				}
+
+				if err = putLogRecord(tx, records[i].Application, records[i].LogRecord, data[i]); err != nil {
+					return
+				}
+			}
+
+			return
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func putLogRecord(tx *bolt.Tx, application string, logRecord *LogRecord, data []byte) (err error) {
+	appBucket, err := tx.CreateBucketIfNotExists([]byte(application))
+	if err != nil {
+		return
+	}
+
+	id, _ := appBucket.NextSequence()
+	key := recordKey(logRecord.CreatedAt, strconv.Itoa(int(id)))
+
+	recordBucket, err := appBucket.CreateBucket(key)
+	if err != nil {
+		return
+	}
+
+	if err = recordBucket.Put([]byte("level"), []byte{byte(logRecord.Level)}); err != nil {
+		return
+	}
+
+	for _, tag := range logRecord.Tags {
+		if err = recordBucket.Put(tagKey(tag), []byte{1}); err != nil {
+			return
+		}
+	}
+
+	if err = recordBucket.Put([]byte("record"), data); err != nil {
+		return
+	}
+
+	if len(logRecord.TraceID) > 0 {
+		traceBucket, err := appBucket.CreateBucketIfNotExists(traceIndexBucket)
+		if err != nil {
+			return err
+		}
+
+		err = traceBucket.Put(traceIndexKey(logRecord.TraceID, key), []byte{})
+	}
+
+	return
+}
+
+// recordsPage collects raw records of the requested page
+type recordsPage struct {
+	offset       int
+	perPage      int
+	rawRecords   [][]byte
+	applications []string
+	err          error
+}
+
+func newRecordsPage(page int) *recordsPage {
+	perPage := currentConfig().Pagination.PerPage
+
+	return &recordsPage{
+		offset:     (page - 1) * perPage,
+		perPage:    perPage,
+		rawRecords: make([][]byte, 0, perPage),
+	}
+}
+
+// add adds the record if it matches level and tags and returns true when the
+// page is full or the record can't be read
+func (p *recordsPage) add(recordBucket *bolt.Bucket, lvl int, tags []string) bool {
+	if lvl > 0 {
+		recordLvl := recordBucket.Get([]byte("level"))
+		if recordLvl == nil || recordLvl[0] < byte(lvl) {
+			return false
+		}
+	}
+
+	for _, tag := range tags {
+		if recordBucket.Get(tagKey(tag)) == nil {
+			return false
+		}
+	}
+
+	if p.offset > 0 {
+		p.offset--
+		return false
+	}
+
+	rawRecord, err := recordValue(recordBucket)
+	if err != nil {
+		p.err = err
+		return true
+	}
+
+	if rawRecord == nil {
+		return false
+	}
+
+	p.rawRecords = append(p.rawRecords, rawRecord)
+
+	return len(p.rawRecords) == p.perPage
+}
+
+// addFromApplication works like add but also remembers the application of
+// the added record
+func (p *recordsPage) addFromApplication(application string, recordBucket *bolt.Bucket, lvl int, tags []string) bool {
+	fetched := len(p.rawRecords)
+	full := p.add(recordBucket, lvl, tags)
+
+	if len(p.rawRecords) > fetched {
+		p.applications = append(p.applications, application)
+	}
+
+	return full
+}
+
+func (p *recordsPage) full() bool {
+	return len(p.rawRecords) == p.perPage
+}
+
+func (p *recordsPage) logRecords() (logRecords LogRecords, err error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	logRecords = make(LogRecords, len(p.rawRecords))
+	for i, rawRecord := range p.rawRecords {
+		if err = bson.Unmarshal(rawRecord, &logRecords[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Load merges records of DBs with archived records when the time range
+// reaches into the archive
+func (boltStorage) Load(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (LogRecords, error) {
+	archived, err := loadArchivedLogRecords(application, lvl, tags, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(archived) == 0 {
+		return loadBoltLogRecords(application, lvl, tags, startTime, endTime, newRecordsPage(page))
+	}
+
+	// records saved after archiving may precede archived ones, so all the
+	// pages up to the requested one are merged
+	perPage := currentConfig().Pagination.PerPage
+
+	logRecords, err := loadBoltLogRecords(application, lvl, tags, startTime, endTime, &recordsPage{perPage: page * perPage})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := mergeLogRecords(archived, logRecords)
+	start, end := pageBounds(len(merged), page)
+
+	return merged[start:end], nil
+}
+
+// loadBoltLogRecords collects records of DBs of the application created
+// within the time range into the page
+func loadBoltLogRecords(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, recordsPage *recordsPage) (logRecords LogRecords, err error) {
+	err = viewAppDBs(application, startTime, endTime, func(tx *bolt.Tx, source dbSource) (done bool, err error) {
+		appBucket := tx.Bucket([]byte(application))
+		if appBucket == nil {
+			return
+		}
+
+		keyStart, keyEnd := source.keyRange(startTime, endTime)
+
+		cursor := appBucket.Cursor()
+
+		for key, _ := cursor.Seek(keyStart); key != nil && bytes.Compare(key, keyEnd) <= 0; key, _ = cursor.Next() {
+			recordBucket := appBucket.Bucket(key)
+			if recordBucket == nil {
+				// just for sure
+				continue
+			}
+
+			if recordsPage.add(recordBucket, lvl, tags) {
+				return true, nil
+			}
+		}
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	return recordsPage.logRecords()
+}
+
+// LoadTrace loads log records of the trace using trace index. Archived
+// records aren't loaded since the archive has no trace index.
+func (boltStorage) LoadTrace(application string, traceID string, lvl int, tags []string, page int) (logRecords LogRecords, err error) {
+	prefix := traceIndexKey(traceID, nil)
+
+	recordsPage := newRecordsPage(page)
+
+	err = viewAppDBs(application, time.Time{}, time.Time{}, func(tx *bolt.Tx, _ dbSource) (done bool, err error) {
+		appBucket := tx.Bucket([]byte(application))
+		if appBucket == nil {
+			return
+		}
+
+		traceBucket := appBucket.Bucket(traceIndexBucket)
+		if traceBucket == nil {
+			return
+		}
+
+		cursor := traceBucket.Cursor()
+
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			recordBucket := appBucket.Bucket(key[len(prefix):])
+			if recordBucket == nil {
+				continue
+			}
+
+			if recordsPage.add(recordBucket, lvl, tags) {
+				return true, nil
+			}
+		}
+
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	return recordsPage.logRecords()
+}
+
+// listApplications returns names of applications of the DB that match any of
+// the patterns
+func listApplications(tx *bolt.Tx, patterns []string) (applications []string, err error) {
+	err = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if isServiceBucket(name) {
+			return nil
+		}
+
+		matched, err := matchApplication(patterns, string(name))
+		if matched {
+			applications = append(applications, string(name))
+		}
+		return err
+	})
+
+	return
+}
+
+// matchApplications returns names of applications of the main DB and shards
+// that match any of the patterns. It should be called with dbLock held.
+func matchApplications(patterns []string) (applications []string, err error) {
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		applications, err = listApplications(tx, patterns)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	for _, application := range shardApplications() {
+		matched, err := matchApplication(patterns, application)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			applications = append(applications, application)
+		}
+	}
+
+	sort.Strings(applications)
+
+	// remove duplicates keeping the order
+	uniq := applications[:0]
+	for _, application := range applications {
+		if len(uniq) == 0 || uniq[len(uniq)-1] != application {
+			uniq = append(uniq, application)
+		}
+	}
+
+	return uniq, nil
+}
+
+type searchCursor struct {
+	application string
+	start       time.Time // start of the shard period
+	bucket      *bolt.Bucket
+	cursor      *bolt.Cursor
+	key         []byte
+	keyEnd      []byte
+}
+
+// before reports whether the cursor points to an earlier record than other
+func (c *searchCursor) before(other *searchCursor) bool {
+	if !c.start.Equal(other.start) {
+		return c.start.Before(other.start)
+	}
+
+	return bytes.Compare(c.key, other.key) < 0
+}
+
+// Search works like Load but scans every application that matches the
+// patterns and merges results in time order
+func (boltStorage) Search(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (SearchLogRecords, error) {
+	archived, err := searchArchivedLogRecords(patterns, lvl, tags, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(archived) == 0 {
+		return searchBoltLogRecords(patterns, lvl, tags, startTime, endTime, newRecordsPage(page))
+	}
+
+	// see Load
+	perPage := currentConfig().Pagination.PerPage
+
+	logRecords, err := searchBoltLogRecords(patterns, lvl, tags, startTime, endTime, &recordsPage{perPage: page * perPage})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := mergeSearchLogRecords(archived, logRecords)
+	start, end := pageBounds(len(merged), page)
+
+	return merged[start:end], nil
+}
+
+// searchBoltLogRecords collects records of DBs of the applications that match
+// the patterns into the page
+func searchBoltLogRecords(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, recordsPage *recordsPage) (logRecords SearchLogRecords, err error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return nil, errDBNotOpen
+	}
+
+	applications, err := matchApplications(patterns)
+	if err != nil {
+		return
+	}
+
+	var acquired []dbSource
+
+	txs := make(map[*bolt.DB]*bolt.Tx)
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+		for _, source := range acquired {
+			source.release()
+		}
+	}()
+
+	var cursors []*searchCursor
+
+	for _, application := range applications {
+		for _, source := range appDBs(application, startTime, endTime) {
+			boltDB, err := source.acquire()
+			if err != nil {
+				return nil, err
+			}
+			acquired = append(acquired, source)
+
+			tx, ok := txs[boltDB]
+			if !ok {
+				if tx, err = boltDB.Begin(false); err != nil {
+					return nil, err
+				}
+				txs[boltDB] = tx
+			}
+
+			appBucket := tx.Bucket([]byte(application))
+			if appBucket == nil {
+				continue
+			}
+
+			keyStart, keyEnd := source.keyRange(startTime, endTime)
+
+			cursor := appBucket.Cursor()
+			key, _ := cursor.Seek(keyStart)
+
+			cursors = append(cursors, &searchCursor{application, source.start, appBucket, cursor, key, keyEnd})
+		}
+	}
+
+	for {
+		// cursor pointing to the earliest record
+		var next *searchCursor
+
+		for _, c := range cursors {
+			if c.key != nil && bytes.Compare(c.key, c.keyEnd) <= 0 && (next == nil || c.before(next)) {
+				next = c
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		if recordBucket := next.bucket.Bucket(next.key); recordBucket != nil {
+			if recordsPage.addFromApplication(next.application, recordBucket, lvl, tags) {
+				break
+			}
+		}
+
+		next.key, _ = next.cursor.Next()
+	}
+
+	found, err := recordsPage.logRecords()
+	if err != nil {
+		return
+	}
+
+	logRecords = make(SearchLogRecords, len(found))
+	for i, logRecord := range found {
+		logRecords[i] = SearchLogRecord{recordsPage.applications[i], logRecord}
+	}
+
+	return
+}
+
+// Stats returns bolt.BucketStats summed across DBs of the application
+func (boltStorage) Stats(application string) (interface{}, error) {
+	var stats bolt.BucketStats
+	found := false
+
+	err := viewAppDBs(application, time.Time{}, time.Time{}, func(tx *bolt.Tx, _ dbSource) (done bool, err error) {
+		if appBucket := tx.Bucket([]byte(application)); appBucket != nil {
+			found = true
+			stats.Add(appBucket.Stats())
+		}
+		return
+	})
+
+	if err == nil && !found {
+		err = errUnknownApplication
+	}
+
+	return stats, err
+}
+
+// Delete removes records of the application created before the time along
+// with their trace index entries
+func (boltStorage) Delete(application string, before time.Time) (deleted int, err error) {
+	writesLock.RLock()
+	defer writesLock.RUnlock()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if db == nil {
+		return 0, errDBNotOpen
+	}
+
+	for _, source := range appDBs(application, time.Time{}, before) {
+		n, err := deleteSourceRecords(source, application, before)
+		deleted += n
+
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return
+}
+
+func deleteSourceRecords(source dbSource, application string, before time.Time) (deleted int, err error) {
+	boltDB, err := source.acquire()
+	if err != nil {
+		return
+	}
+	defer source.release()
+
+	err = boltDB.Update(func(tx *bolt.Tx) (err error) {
+		deleted, err = deleteRecordBuckets(tx, application, before)
+		return
+	})
+
+	return
+}
+
+func deleteRecordBuckets(tx *bolt.Tx, application string, before time.Time) (deleted int, err error) {
+	appBucket := tx.Bucket([]byte(application))
+	if appBucket == nil {
+		return
+	}
+
+	var keys [][]byte
+
+	// keys of records created at the time itself are greater than keyEnd
+	keyEnd := recordKey(before, "")
+
+	err = forEachRecordBucket(appBucket, nil, keyEnd, func(key []byte, _ *bolt.Bucket) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	if err = deleteRecordKeys(appBucket, keys); err != nil {
+		return
+	}
+
+	return len(keys), nil
+}
+
+// deleteRecordKeys removes record buckets of the application bucket along
+// with their trace index entries
+func deleteRecordKeys(appBucket *bolt.Bucket, keys [][]byte) (err error) {
+	for _, key := range keys {
+		if err = appBucket.DeleteBucket(key); err != nil {
+			return
+		}
+	}
+
+	traceBucket := appBucket.Bucket(traceIndexBucket)
+	if traceBucket == nil {
+		return
+	}
+
+	var indexKeys [][]byte
+
+	err = traceBucket.ForEach(func(key, _ []byte) error {
+		if i := bytes.IndexByte(key, 0); i >= 0 && appBucket.Bucket(key[i+1:]) == nil {
+			indexKeys = append(indexKeys, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, key := range indexKeys {
+		if err = traceBucket.Delete(key); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LevelDB key layout. Application names are length-prefixed, so keys of one
+// application never share a prefix with keys of another one.
+//
+//	a<application>                                   application registry
+//	r<len><application><time><seq>                   BSON of the record
+//	t<len><application><len><trace ID><time><seq>    trace index
+//	s                                                reserved sequence
+//
+// <time> is big-endian Unix seconds with flipped sign bit followed by
+// big-endian nanoseconds within the second, so records of the application are
+// sorted chronologically for any year. <seq> is a big-endian uint64 that makes
+// keys of records created at the same time unique.
+const (
+	levelDBAppKind    = 'a'
+	levelDBRecordKind = 'r'
+	levelDBTraceKind  = 't'
+
+	// length of <time><seq> suffix of record keys
+	levelDBRecordIDLen = 20
+
+	// number of sequence values reserved at once
+	levelDBSeqBlock = 10000
+
+	// number of records deleted in a single batch
+	levelDBDeleteBatchSize = 1000
+)
+
+var levelDBSeqKey = []byte("s")
+
+var errLevelDBNotEmpty = errors.New("Destination database already contains records")
+
+// levelDBStorage keeps records in LevelDB. LSM tree appends writes to the
+// journal and memtable, so it handles write-heavy workloads better than Bolt.
+type levelDBStorage struct {
+	path string
+	db   *leveldb.DB
+
+	seqLock     sync.Mutex
+	seq         uint64
+	seqReserved uint64
+}
+
+// LevelDBStats describes records of the application kept in LevelDB
+type LevelDBStats struct {
+	RecordN int
+	TraceN  int
+	// approximate size of the application data on disk
+	Size int64
+}
+
+func newLevelDBStorage(path string) *levelDBStorage {
+	return &levelDBStorage{path: path}
+}
+
+func (s *levelDBStorage) Open() (err error) {
+	conf := currentConfig().Database.LevelDB
+
+	s.db, err = leveldb.OpenFile(absPathToFile(s.path), &opt.Options{
+		WriteBuffer: conf.WriteBuffer * opt.MiB,
+	})
+	if err != nil {
+		return
+	}
+
+	data, err := s.db.Get(levelDBSeqKey, nil)
+
+	switch err {
+	case nil:
+		s.seqReserved = binary.BigEndian.Uint64(data)
+		s.seq = s.seqReserved
+	case leveldb.ErrNotFound:
+		err = nil
+	default:
+		s.db.Close()
+	}
+
+	return
+}
+
+func (s *levelDBStorage) Close() error {
+	return s.db.Close()
+}
+
+// Ready writes an empty batch that fails when DB is closed
+func (s *levelDBStorage) Ready() error {
+	return s.db.Write(new(leveldb.Batch), nil)
+}
+
+func levelDBAppKey(application string) []byte {
+	return append([]byte{levelDBAppKind}, application...)
+}
+
+// levelDBPrefix returns the prefix of record or trace index keys of the
+// application
+func levelDBPrefix(kind byte, application string) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(application))
+	buf[0] = kind
+	n := binary.PutUvarint(buf[1:], uint64(len(application)))
+	return append(buf[:1+n], application...)
+}
+
+// levelDBTime encodes seconds and nanoseconds separately, since UnixNano
+// overflows outside of years 1678-2262
+func levelDBTime(t time.Time) []byte {
+	buf := binary.BigEndian.AppendUint64(nil, uint64(t.Unix())^(1<<63))
+	return binary.BigEndian.AppendUint32(buf, uint32(t.Nanosecond()))
+}
+
+func levelDBRecordKey(application string, createdAt time.Time, seq uint64) []byte {
+	key := append(levelDBPrefix(levelDBRecordKind, application), levelDBTime(createdAt)...)
+	return binary.BigEndian.AppendUint64(key, seq)
+}
+
+// levelDBTracePrefix returns the prefix of trace index keys of the trace
+func levelDBTracePrefix(application string, traceID string) []byte {
+	prefix := levelDBPrefix(levelDBTraceKind, application)
+	prefix = binary.AppendUvarint(prefix, uint64(len(traceID)))
+	return append(prefix, traceID...)
+}
+
+// levelDBRecordID returns <time><seq> suffix of the record or trace index key
+func levelDBRecordID(key []byte) []byte {
+	return key[len(key)-levelDBRecordIDLen:]
+}
+
+// levelDBRecordRange returns range of keys of the application records
+// created within the time range with millisecond precision
+func levelDBRecordRange(application string, startTime time.Time, endTime time.Time) *util.Range {
+	return &util.Range{
+		Start: levelDBRecordKey(application, recordTime(startTime), 0),
+		Limit: levelDBRecordKey(application, recordTime(endTime).Add(time.Millisecond), 0),
+	}
+}
+
+// reserveSeq returns the first of n sequence values. Values are reserved by
+// blocks, so the reserved value is saved once per levelDBSeqBlock records.
+func (s *levelDBStorage) reserveSeq(n int) (first uint64, err error) {
+	s.seqLock.Lock()
+	defer s.seqLock.Unlock()
+
+	if s.seq+uint64(n) > s.seqReserved {
+		reserved := s.seq + uint64(n) + levelDBSeqBlock
+
+		data := binary.BigEndian.AppendUint64(nil, reserved)
+		if err = s.db.Put(levelDBSeqKey, data, &opt.WriteOptions{Sync: true}); err != nil {
+			return
+		}
+
+		s.seqReserved = reserved
+	}
+
+	first = s.seq + 1
+	s.seq += uint64(n)
+
+	return
+}
+
+func (s *levelDBStorage) Save(records []ApplicationLogRecord) error {
+	first, err := s.reserveSeq(len(records))
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	applications := make(map[string]bool)
+
+	for i, record := range records {
+		data, err := bson.Marshal(record.LogRecord)
+		if err != nil {
+			return err
+		}
+
+		if !applications[record.Application] {
+			applications[record.Application] = true
+			batch.Put(levelDBAppKey(record.Application), nil)
+		}
+
+		key := levelDBRecordKey(record.Application, record.LogRecord.CreatedAt, first+uint64(i))
+		batch.Put(key, data)
+
+		if len(record.LogRecord.TraceID) > 0 {
+			traceKey := append(levelDBTracePrefix(record.Application, record.LogRecord.TraceID), levelDBRecordID(key)...)
+			batch.Put(traceKey, nil)
+		}
+	}
+
+	return s.db.Write(batch, &opt.WriteOptions{
+		Sync: !currentConfig().Database.LevelDB.NoSync,
+	})
+}
+
+// levelDBPage collects decoded records of the requested page
+type levelDBPage struct {
+	offset       int
+	perPage      int
+	logRecords   LogRecords
+	applications []string
+}
+
+func newLevelDBPage(page int) *levelDBPage {
+	perPage := currentConfig().Pagination.PerPage
+
+	return &levelDBPage{
+		offset:     (page - 1) * perPage,
+		perPage:    perPage,
+		logRecords: make(LogRecords, 0, perPage),
+	}
+}
+
+// add adds the record if it matches level and tags and returns true when the
+// page is full
+func (p *levelDBPage) add(application string, data []byte, lvl int, tags []string) (bool, error) {
+	var logRecord LogRecord
+
+	if err := bson.Unmarshal(data, &logRecord); err != nil {
+		return false, err
+	}
+
+	if !matchLogRecord(&logRecord, lvl, tags) {
+		return false, nil
+	}
+
+	if p.offset > 0 {
+		p.offset--
+		return false, nil
+	}
+
+	p.logRecords = append(p.logRecords, logRecord)
+	p.applications = append(p.applications, application)
+
+	return len(p.logRecords) == p.perPage, nil
+}
+
+func (s *levelDBStorage) Load(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (LogRecords, error) {
+	recordsPage := newLevelDBPage(page)
+
+	iter := s.db.NewIterator(levelDBRecordRange(application, startTime, endTime), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		full, err := recordsPage.add(application, iter.Value(), lvl, tags)
+		if err != nil {
+			return nil, err
+		}
+
+		if full {
+			break
+		}
+	}
+
+	return recordsPage.logRecords, iter.Error()
+}
+
+// LoadTrace loads log records of the trace using trace index
+func (s *levelDBStorage) LoadTrace(application string, traceID string, lvl int, tags []string, page int) (LogRecords, error) {
+	recordsPage := newLevelDBPage(page)
+
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	recordPrefix := levelDBPrefix(levelDBRecordKind, application)
+
+	iter := snapshot.NewIterator(util.BytesPrefix(levelDBTracePrefix(application, traceID)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		data, err := snapshot.Get(append(recordPrefix, levelDBRecordID(iter.Key())...), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		full, err := recordsPage.add(application, data, lvl, tags)
+		if err != nil {
+			return nil, err
+		}
+
+		if full {
+			break
+		}
+	}
+
+	return recordsPage.logRecords, iter.Error()
+}
+
+// listApplications returns names of applications that match any of the
+// patterns in alphabetical order
+func (s *levelDBStorage) listApplications(reader leveldb.Reader, patterns []string) (applications []string, err error) {
+	iter := reader.NewIterator(util.BytesPrefix([]byte{levelDBAppKind}), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		application := string(iter.Key()[1:])
+
+		matched, err := matchApplication(patterns, application)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			applications = append(applications, application)
+		}
+	}
+
+	return applications, iter.Error()
+}
+
+// levelDBCursor iterates over records of the application
+type levelDBCursor struct {
+	application string
+	iter        iterator.Iterator
+	valid       bool
+}
+
+// Search works like Load but scans every application that matches the
+// patterns and merges results in time order
+func (s *levelDBStorage) Search(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (logRecords SearchLogRecords, err error) {
+	recordsPage := newLevelDBPage(page)
+
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return
+	}
+	defer snapshot.Release()
+
+	applications, err := s.listApplications(snapshot, patterns)
+	if err != nil {
+		return
+	}
+
+	cursors := make([]*levelDBCursor, len(applications))
+	for i, application := range applications {
+		cursors[i] = &levelDBCursor{
+			application: application,
+			iter:        snapshot.NewIterator(levelDBRecordRange(application, startTime, endTime), nil),
+		}
+		defer cursors[i].iter.Release()
+
+		cursors[i].valid = cursors[i].iter.Next()
+	}
+
+	for {
+		// cursor pointing to the earliest record
+		var next *levelDBCursor
+
+		for _, c := range cursors {
+			if c.valid && (next == nil || bytes.Compare(levelDBRecordID(c.iter.Key()), levelDBRecordID(next.iter.Key())) < 0) {
+				next = c
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		full, err := recordsPage.add(next.application, next.iter.Value(), lvl, tags)
+		if err != nil {
+			return nil, err
+		}
+
+		if full {
+			break
+		}
+
+		next.valid = next.iter.Next()
+	}
+
+	for _, c := range cursors {
+		if err = c.iter.Error(); err != nil {
+			return
+		}
+	}
+
+	logRecords = make(SearchLogRecords, len(recordsPage.logRecords))
+	for i, logRecord := range recordsPage.logRecords {
+		logRecords[i] = SearchLogRecord{recordsPage.applications[i], logRecord}
+	}
+
+	return
+}
+
+func (s *levelDBStorage) Stats(application string) (interface{}, error) {
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	if ok, err := snapshot.Has(levelDBAppKey(application), nil); err != nil || !ok {
+		if err == nil {
+			err = errUnknownApplication
+		}
+		return nil, err
+	}
+
+	var stats LevelDBStats
+
+	recordRange := util.BytesPrefix(levelDBPrefix(levelDBRecordKind, application))
+	traceRange := util.BytesPrefix(levelDBPrefix(levelDBTraceKind, application))
+
+	for _, r := range []struct {
+		keys  *util.Range
+		count *int
+	}{{recordRange, &stats.RecordN}, {traceRange, &stats.TraceN}} {
+		iter := snapshot.NewIterator(r.keys, nil)
+		for iter.Next() {
+			*r.count++
+		}
+		iter.Release()
+
+		if err = iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	sizes, err := s.db.SizeOf([]util.Range{*recordRange, *traceRange})
+	if err != nil {
+		return nil, err
+	}
+	stats.Size = sizes.Sum()
+
+	return stats, nil
+}
+
+// Delete removes records of the application created before the time along
+// with their trace index entries
+func (s *levelDBStorage) Delete(application string, before time.Time) (deleted int, err error) {
+	prefix := levelDBPrefix(levelDBRecordKind, application)
+
+	iter := s.db.NewIterator(&util.Range{
+		Start: prefix,
+		Limit: levelDBRecordKey(application, before, 0),
+	}, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	batched := 0
+
+	flush := func() error {
+		if err := s.db.Write(batch, nil); err != nil {
+			return err
+		}
+
+		deleted += batched
+		batched = 0
+		batch.Reset()
+
+		return nil
+	}
+
+	for iter.Next() {
+		var logRecord LogRecord
+
+		if bson.Unmarshal(iter.Value(), &logRecord) == nil && len(logRecord.TraceID) > 0 {
+			traceKey := append(levelDBTracePrefix(application, logRecord.TraceID), levelDBRecordID(iter.Key())...)
+			batch.Delete(traceKey)
+		}
+
+		batch.Delete(append([]byte{}, iter.Key()...))
+		batched++
+
+		if batched >= levelDBDeleteBatchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = iter.Error(); err != nil {
+		return
+	}
+
+	err = flush()
+
+	return
+}
+
+// empty reports whether DB contains no records
+func (s *levelDBStorage) empty() (bool, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{levelDBRecordKind}), nil)
+	defer iter.Release()
+
+	return !iter.First(), iter.Error()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LevelDB storage", func() {
+	var (
+		dir            string
+		levelDB        *levelDBStorage
+		restoreStorage func()
+	)
+
+	start := time.Date(2015, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-leveldb")
+		Expect(err).NotTo(HaveOccurred())
+
+		config.Database.LevelDB.WriteBuffer = 4
+
+		levelDB = newLevelDBStorage(filepath.Join(dir, "logbook.leveldb"))
+		Expect(levelDB.Open()).To(Succeed())
+		restoreStorage = swapStorage(levelDB)
+	})
+
+	AfterEach(func() {
+		levelDB.Close()
+		restoreStorage()
+		config.Database.LevelDB.WriteBuffer = 0
+		os.RemoveAll(dir)
+	})
+
+	Context("with records", func() {
+		BeforeEach(func() {
+			saveTestLogRecord("testapp1", "Message 2", 3, start.Add(2*time.Second), "tag1")
+			saveTestLogRecord("testapp1", "Message 1", 1, start.Add(time.Second))
+			saveTestLogRecord("testapp2", "Message 3", 3, start.Add(3*time.Second))
+			saveTestLogRecord("testapp1", "Message 4", 5, start.Add(4*time.Second), "tag1", "tag2")
+			saveTestLogRecord("testapp", "Message 5", 5, start.Add(4*time.Second))
+		})
+
+		It("should load log records in time order", func() {
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(3*time.Second), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+		})
+
+		It("should include records created within the last millisecond of the range", func() {
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Second+time.Microsecond), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1"}))
+		})
+
+		It("should filter log records by level and tags", func() {
+			logRecords, err := loadLogRecords("testapp1", 2, []string{"tag1"}, start, start.Add(time.Minute), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2", "Message 4"}))
+		})
+
+		It("should paginate results", func() {
+			config.Pagination.PerPage = 2
+			defer func() { config.Pagination.PerPage = 100 }()
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 2)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 4"}))
+		})
+
+		It("should load log records of the trace", func() {
+			logRecords, err := loadTraceLogRecords("testapp1", "trace1", 3, []string{}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2", "Message 4"}))
+		})
+
+		It("should search log records across applications", func() {
+			logRecords, err := searchLogRecords([]string{"testapp?"}, 3, []string{}, start, start.Add(time.Minute), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(HaveLen(3))
+			Expect(logRecords[0].Message).To(Equal("Message 2"))
+			Expect(logRecords[1].Message).To(Equal("Message 3"))
+			Expect(logRecords[1].Application).To(Equal("testapp2"))
+			Expect(logRecords[2].Message).To(Equal("Message 4"))
+		})
+
+		It("should return stats of the application", func() {
+			stats, err := appStats("testapp1")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats.(LevelDBStats).RecordN).To(Equal(3))
+			Expect(stats.(LevelDBStats).TraceN).To(Equal(3))
+
+			_, err = appStats("testapp3")
+			Expect(err).To(Equal(errUnknownApplication))
+		})
+
+		It("should delete log records created before the time", func() {
+			deleted, err := deleteLogRecords("testapp1", start.Add(3*time.Second))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(Equal(2))
+
+			logRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 4"}))
+
+			stats, err := appStats("testapp1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats.(LevelDBStats).TraceN).To(Equal(1))
+		})
+
+		It("should keep records and sequence after reopening", func() {
+			Expect(levelDB.Close()).To(Succeed())
+
+			levelDB = newLevelDBStorage(levelDB.path)
+			Expect(levelDB.Open()).To(Succeed())
+			storage = levelDB
+
+			// the same time as an existing record
+			saveTestLogRecord("testapp1", "Message 6", 1, start.Add(time.Second))
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Second), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 6"}))
+		})
+	})
+
+	Context("with records out of UnixNano range", func() {
+		ancient := time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC)
+		distant := time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			saveTestLogRecord("testapp1", "Message 2", 1, start)
+			saveTestLogRecord("testapp1", "Message 3", 1, distant)
+			saveTestLogRecord("testapp1", "Message 1", 1, ancient)
+		})
+
+		It("should load log records in time order", func() {
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, ancient.AddDate(-1, 0, 0), distant.AddDate(1, 0, 0), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+		})
+
+		It("should load log records of the time range", func() {
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, distant, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2", "Message 3"}))
+		})
+
+		It("should delete only log records created before the time", func() {
+			deleted, err := deleteLogRecords("testapp1", ancient)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(BeZero())
+
+			deleted, err = deleteLogRecords("testapp1", ancient.AddDate(1, 0, 0))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(Equal(1))
+		})
+	})
+
+	It("should fail when closed", func() {
+		Expect(levelDB.Close()).To(Succeed())
+
+		Expect(checkDBWritable()).To(HaveOccurred())
+	})
+
+	Describe("migration", func() {
+		var boltPath string
+
+		BeforeEach(func() {
+			boltPath = filepath.Join(dir, "source.db")
+
+			src, err := bolt.Open(boltPath, 0600, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(src.Update(func(tx *bolt.Tx) error {
+				for i, message := range []string{"Message 1", "Message 2", "Message 3"} {
+					logRecord := &LogRecord{Message: message, Level: 1, Tags: []string{}, CreatedAt: start.Add(time.Duration(i) * time.Second)}
+
+					data, err := bson.Marshal(logRecord)
+					Expect(err).NotTo(HaveOccurred())
+
+					if err := putLogRecord(tx, "testapp1", logRecord, data); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})).To(Succeed())
+
+			Expect(src.Close()).To(Succeed())
+		})
+
+		It("should copy records of the Bolt file", func() {
+			var out bytes.Buffer
+
+			Expect(runMigration([]string{boltPath}, levelDB, &out)).To(Succeed())
+			Expect(out.String()).To(Equal("Migrated " + boltPath + ": 3 records, 0 skipped\n"))
+
+			logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2", "Message 3"}))
+		})
+
+		It("should migrate by batches", func() {
+			migrated, skipped, err := migrateBoltFile(boltPath, levelDB, 2)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrated).To(Equal(3))
+			Expect(skipped).To(BeZero())
+		})
+
+		It("should refuse to migrate into non-empty storage", func() {
+			saveTestLogRecord("testapp1", "Message", 1, start)
+
+			Expect(runMigration([]string{boltPath}, levelDB, ioutil.Discard)).To(Equal(errLevelDBNotEmpty))
+		})
+	})
+})
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps records in memory. Records are lost on shutdown, so
+// it's meant for tests and ephemeral deployments.
+type memoryStorage struct {
+	lock sync.RWMutex
+	// records of every application in chronological order
+	apps map[string][]LogRecord
+	open bool
+}
+
+// MemoryStats describes records of the application kept in memory
+type MemoryStats struct {
+	RecordN int
+	TraceN  int
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{apps: make(map[string][]LogRecord)}
+}
+
+func (s *memoryStorage) Open() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.open = true
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.open = false
+	s.apps = make(map[string][]LogRecord)
+	return nil
+}
+
+func (s *memoryStorage) Ready() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.open {
+		return errDBNotOpen
+	}
+	return nil
+}
+
+// copyLogRecord returns a copy of the record that doesn't share tags with
+// the original
+func copyLogRecord(logRecord LogRecord) LogRecord {
+	logRecord.Tags = append([]string{}, logRecord.Tags...)
+	return logRecord
+}
+
+func (s *memoryStorage) Save(records []ApplicationLogRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.open {
+		return errDBNotOpen
+	}
+
+	for _, record := range records {
+		logRecord := copyLogRecord(*record.LogRecord)
+		appRecords := s.apps[record.Application]
+
+		// insert after records created at the same time
+		i := sort.Search(len(appRecords), func(i int) bool {
+			return appRecords[i].CreatedAt.After(logRecord.CreatedAt)
+		})
+
+		appRecords = append(appRecords, LogRecord{})
+		copy(appRecords[i+1:], appRecords[i:])
+		appRecords[i] = logRecord
+
+		s.apps[record.Application] = appRecords
+	}
+
+	return nil
+}
+
+// filterLogRecords returns records of the application that match the filter
+// function, level and tags
+func (s *memoryStorage) filterLogRecords(application string, lvl int, tags []string, filter func(*LogRecord) bool) (found []LogRecord) {
+	for i := range s.apps[application] {
+		logRecord := &s.apps[application][i]
+
+		if filter(logRecord) && matchLogRecord(logRecord, lvl, tags) {
+			found = append(found, *logRecord)
+		}
+	}
+
+	return
+}
+
+func pageLogRecords(found []LogRecord, page int) LogRecords {
+	start, end := pageBounds(len(found), page)
+
+	logRecords := make(LogRecords, 0, end-start)
+	for _, logRecord := range found[start:end] {
+		logRecords = append(logRecords, copyLogRecord(logRecord))
+	}
+
+	return logRecords
+}
+
+func (s *memoryStorage) Load(application string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (LogRecords, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found := s.filterLogRecords(application, lvl, tags, inTimeRange(startTime, endTime))
+
+	return pageLogRecords(found, page), nil
+}
+
+func (s *memoryStorage) LoadTrace(application string, traceID string, lvl int, tags []string, page int) (LogRecords, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found := s.filterLogRecords(application, lvl, tags, func(logRecord *LogRecord) bool {
+		return logRecord.TraceID == traceID
+	})
+
+	return pageLogRecords(found, page), nil
+}
+
+func (s *memoryStorage) Search(patterns []string, lvl int, tags []string, startTime time.Time, endTime time.Time, page int) (SearchLogRecords, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var applications []string
+
+	for application := range s.apps {
+		matched, err := matchApplication(patterns, application)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			applications = append(applications, application)
+		}
+	}
+
+	sort.Strings(applications)
+
+	var found SearchLogRecords
+
+	for _, application := range applications {
+		for _, logRecord := range s.filterLogRecords(application, lvl, tags, inTimeRange(startTime, endTime)) {
+			found = append(found, SearchLogRecord{application, logRecord})
+		}
+	}
+
+	// records created at the same time stay ordered by application
+	sort.SliceStable(found, func(i, j int) bool {
+		return recordTime(found[i].CreatedAt).Before(recordTime(found[j].CreatedAt))
+	})
+
+	start, end := pageBounds(len(found), page)
+
+	logRecords := make(SearchLogRecords, 0, end-start)
+	for _, logRecord := range found[start:end] {
+		logRecord.LogRecord = copyLogRecord(logRecord.LogRecord)
+		logRecords = append(logRecords, logRecord)
+	}
+
+	return logRecords, nil
+}
+
+func (s *memoryStorage) Stats(application string) (interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	appRecords, ok := s.apps[application]
+	if !ok {
+		return nil, errUnknownApplication
+	}
+
+	stats := MemoryStats{RecordN: len(appRecords)}
+
+	for _, logRecord := range appRecords {
+		if logRecord.TraceID != "" {
+			stats.TraceN++
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *memoryStorage) Delete(application string, before time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.open {
+		return 0, errDBNotOpen
+	}
+
+	appRecords := s.apps[application]
+
+	// records are sorted, so the deleted ones are in the head
+	n := sort.Search(len(appRecords), func(i int) bool {
+		return !appRecords[i].CreatedAt.Before(before)
+	})
+
+	if n > 0 {
+		s.apps[application] = append([]LogRecord{}, appRecords[n:]...)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory storage", func() {
+	var restoreStorage func()
+
+	start := time.Date(2015, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		restoreStorage = swapStorage(newMemoryStorage())
+		Expect(storage.Open()).To(Succeed())
+
+		saveTestLogRecord("testapp1", "Message 2", 3, start.Add(2*time.Second), "tag1")
+		saveTestLogRecord("testapp1", "Message 1", 1, start.Add(time.Second))
+		saveTestLogRecord("testapp2", "Message 3", 3, start.Add(3*time.Second))
+		saveTestLogRecord("testapp1", "Message 4", 5, start.Add(4*time.Second), "tag1", "tag2")
+	})
+
+	AfterEach(func() {
+		Expect(storage.Close()).To(Succeed())
+		restoreStorage()
+	})
+
+	It("should load log records in time order", func() {
+		logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(3*time.Second), 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 1", "Message 2"}))
+	})
+
+	It("should filter log records by level and tags", func() {
+		logRecords, err := loadLogRecords("testapp1", 2, []string{"tag1"}, start, start.Add(time.Minute), 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2", "Message 4"}))
+	})
+
+	It("should paginate results", func() {
+		config.Pagination.PerPage = 2
+		defer func() { config.Pagination.PerPage = 100 }()
+
+		logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 2)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 4"}))
+
+		logRecords, err = loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 3)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecords).To(BeEmpty())
+	})
+
+	It("should not share records with callers", func() {
+		logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		logRecords[1].Tags[0] = "changed"
+
+		logRecords, err = loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecords[1].Tags).To(Equal([]string{"tag1"}))
+	})
+
+	It("should load log records of the trace", func() {
+		logRecords, err := loadTraceLogRecords("testapp1", "trace1", 3, []string{}, 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 2", "Message 4"}))
+	})
+
+	It("should search log records across applications", func() {
+		logRecords, err := searchLogRecords([]string{"testapp*"}, 3, []string{}, start, start.Add(time.Minute), 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecords).To(HaveLen(3))
+		Expect(logRecords[0].Message).To(Equal("Message 2"))
+		Expect(logRecords[1].Message).To(Equal("Message 3"))
+		Expect(logRecords[1].Application).To(Equal("testapp2"))
+		Expect(logRecords[2].Message).To(Equal("Message 4"))
+	})
+
+	It("should return stats of the application", func() {
+		stats, err := appStats("testapp1")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats).To(Equal(MemoryStats{RecordN: 3, TraceN: 3}))
+
+		_, err = appStats("testapp3")
+		Expect(err).To(Equal(errUnknownApplication))
+	})
+
+	It("should delete log records created before the time", func() {
+		deleted, err := deleteLogRecords("testapp1", start.Add(3*time.Second))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(Equal(2))
+
+		logRecords, err := loadLogRecords("testapp1", 0, []string{}, start, start.Add(time.Minute), 1)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logRecordMessages(logRecords)).To(Equal([]string{"Message 4"}))
+	})
+
+	It("should fail when closed", func() {
+		Expect(storage.Close()).To(Succeed())
+
+		Expect(checkDBWritable()).To(Equal(errDBNotOpen))
+		Expect(saveLogRecord("testapp1", &LogRecord{Message: "Message"})).To(Equal(errDBNotOpen))
+	})
+})
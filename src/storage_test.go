@@ -203,4 +203,197 @@ var _ = Describe("Models", func() {
 			})
 		})
 	})
+
+	Describe("searchLogRecords", func() {
+		generateLogRecord := func(application, message string, level int, tags ...string) (logRecord LogRecord) {
+			logRecord = LogRecord{
+				Message: message,
+				Level:   level,
+				Tags:    tags,
+			}
+			Expect(
+				saveLogRecord(application, &logRecord),
+			).To(Succeed())
+
+			time.Sleep(time.Millisecond)
+
+			return
+		}
+
+		var startTime, endTime time.Time
+
+		BeforeEach(func() {
+			startTime = time.Now().Add(-time.Hour)
+			endTime = time.Now().Add(time.Hour)
+		})
+
+		It("should merge log records of listed applications in time order", func() {
+			generateLogRecord("testapp1", "Message 1", 1)
+			generateLogRecord("testapp2", "Message 2", 1)
+			generateLogRecord("testapp3", "Message 3", 1)
+			generateLogRecord("testapp1", "Message 4", 1)
+
+			loadedLogRecords, err := searchLogRecords([]string{"testapp1", "testapp2"}, 0, []string{},
+				startTime, endTime, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(3))
+
+			Expect(loadedLogRecords[0].Application).To(Equal("testapp1"))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message 1"))
+			Expect(loadedLogRecords[1].Application).To(Equal("testapp2"))
+			Expect(loadedLogRecords[1].Message).To(Equal("Message 2"))
+			Expect(loadedLogRecords[2].Application).To(Equal("testapp1"))
+			Expect(loadedLogRecords[2].Message).To(Equal("Message 4"))
+		})
+
+		It("should match applications by glob", func() {
+			generateLogRecord("web-front", "Message 1", 1)
+			generateLogRecord("worker", "Message 2", 1)
+			generateLogRecord("web-api", "Message 3", 1)
+
+			loadedLogRecords, err := searchLogRecords([]string{"web-*"}, 0, []string{},
+				startTime, endTime, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(2))
+			Expect(loadedLogRecords[0].Application).To(Equal("web-front"))
+			Expect(loadedLogRecords[1].Application).To(Equal("web-api"))
+		})
+
+		It("should filter log records by level and tags", func() {
+			generateLogRecord("testapp1", "Message 1", 1, "tag1")
+			generateLogRecord("testapp2", "Message 2", 3)
+			generateLogRecord("testapp2", "Message 3", 3, "tag1")
+
+			loadedLogRecords, err := searchLogRecords([]string{"*"}, 2, []string{"tag1"},
+				startTime, endTime, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(1))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message 3"))
+		})
+
+		It("should paginate merged results", func() {
+			for i := 0; i < 110; i++ {
+				generateLogRecord(fmt.Sprintf("testapp%v", i%2), fmt.Sprintf("Message%v", i), 1)
+			}
+
+			loadedLogRecords, err := searchLogRecords([]string{"testapp*"}, 0, []string{},
+				startTime, endTime, 2)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(10))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message100"))
+			Expect(loadedLogRecords[0].Application).To(Equal("testapp0"))
+			Expect(loadedLogRecords[9].Message).To(Equal("Message109"))
+		})
+	})
+
+	Describe("loadTraceLogRecords", func() {
+		generateLogRecord := func(application, message, traceID string, level int, tags ...string) (logRecord LogRecord) {
+			logRecord = LogRecord{
+				Message: message,
+				Level:   level,
+				Tags:    tags,
+				TraceID: traceID,
+				SpanID:  "span",
+			}
+			Expect(
+				saveLogRecord(application, &logRecord),
+			).To(Succeed())
+
+			time.Sleep(time.Millisecond)
+
+			return
+		}
+
+		It("should return log records of the trace", func() {
+			generateLogRecord("testapp1", "Message 1", "trace1", 1)
+			generateLogRecord("testapp1", "Message 2", "trace2", 1)
+			generateLogRecord("testapp1", "Message 3", "trace1", 3, "tag1")
+			generateLogRecord("testapp1", "Message 4", "", 3)
+			generateLogRecord("testapp2", "Message 5", "trace1", 3)
+
+			loadedLogRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(2))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message 1"))
+			Expect(loadedLogRecords[0].TraceID).To(Equal("trace1"))
+			Expect(loadedLogRecords[0].SpanID).To(Equal("span"))
+			Expect(loadedLogRecords[1].Message).To(Equal("Message 3"))
+		})
+
+		It("should not match trace ID by prefix", func() {
+			generateLogRecord("testapp1", "Message 1", "trace1", 1)
+			generateLogRecord("testapp1", "Message 2", "trace10", 1)
+
+			loadedLogRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(1))
+		})
+
+		It("should filter log records by level and tags", func() {
+			generateLogRecord("testapp1", "Message 1", "trace1", 1, "tag1")
+			generateLogRecord("testapp1", "Message 2", "trace1", 3)
+			generateLogRecord("testapp1", "Message 3", "trace1", 3, "tag1")
+
+			loadedLogRecords, err := loadTraceLogRecords("testapp1", "trace1", 2, []string{"tag1"}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(1))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message 3"))
+		})
+
+		It("should not include trace index into time range queries", func() {
+			generateLogRecord("testapp1", "Message 1", "trace1", 1)
+
+			loadedLogRecords, err := loadLogRecords("testapp1", 0, []string{},
+				time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(1))
+		})
+	})
+
+	Describe("deleteLogRecords", func() {
+		BeforeEach(func() {
+			for i, createdAt := range []time.Time{
+				time.Date(2015, 1, 20, 10, 0, 0, 0, time.UTC),
+				time.Date(2015, 2, 5, 10, 0, 0, 0, time.UTC),
+				time.Date(2015, 2, 20, 10, 0, 0, 0, time.UTC),
+			} {
+				logRecord := LogRecord{Message: fmt.Sprintf("Message %v", i), Level: 1, CreatedAt: createdAt, TraceID: "trace1"}
+				Expect(saveLogRecord("testapp1", &logRecord)).To(Succeed())
+			}
+		})
+
+		It("should delete log records created before the time", func() {
+			deleted, err := deleteLogRecords("testapp1", time.Date(2015, 2, 10, 0, 0, 0, 0, time.UTC))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(Equal(2))
+
+			loadedLogRecords, err := loadTraceLogRecords("testapp1", "trace1", 0, []string{}, 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loadedLogRecords).To(HaveLen(1))
+			Expect(loadedLogRecords[0].Message).To(Equal("Message 2"))
+
+			db.View(func(tx *bolt.Tx) (err error) {
+				traceBucket := tx.Bucket([]byte("testapp1")).Bucket(traceIndexBucket)
+				Expect(traceBucket.Stats().KeyN).To(Equal(1))
+				return
+			})
+		})
+
+		It("should ignore unknown applications", func() {
+			deleted, err := deleteLogRecords("testapp2", time.Now())
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(BeZero())
+		})
+	})
 })
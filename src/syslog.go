@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const syslogInputName = "Syslog"
+
+const rfc3164TimeFormat = "Jan _2 15:04:05"
+
+// syslogLevels maps syslog severity (0 - emergency ... 7 - debug) onto log
+// record level
+var syslogLevels = [...]int{5, 5, 5, 4, 3, 2, 1, 0}
+
+func startSyslogInputs() {
+	if len(config.Syslog.UDP) > 0 {
+		serveUDP(syslogInputName, config.Syslog.UDP, func(data []byte) {
+			handleSyslogMessage(data)
+		})
+	}
+
+	if len(config.Syslog.TCP) > 0 {
+		serveTCP(syslogInputName, config.Syslog.TCP, func(conn net.Conn) {
+			readSyslogFrames(conn, handleSyslogMessage)
+		})
+	}
+}
+
+func handleSyslogMessage(data []byte) {
+	application, logRecord, err := parseSyslogMessage(data)
+	if err != nil {
+		logInputError(syslogInputName, err)
+		return
+	}
+
+	if application == "" {
+		application = currentConfig().Syslog.Application
+	}
+
+	saveInputRecord(syslogInputName, application, &logRecord)
+}
+
+// readSyslogFrames splits TCP stream into messages. Both octet counting and
+// non-transparent (newline) framing from RFC 6587 are supported.
+func readSyslogFrames(r io.Reader, handle func([]byte)) {
+	reader := bufio.NewReader(r)
+
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var frame []byte
+
+		if first[0] >= '1' && first[0] <= '9' {
+			lenStr, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+
+			length, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+			if err != nil || length > maxDatagramSize {
+				logInputError(syslogInputName, errors.New("Invalid frame length"))
+				return
+			}
+
+			frame = make([]byte, length)
+			if _, err = io.ReadFull(reader, frame); err != nil {
+				return
+			}
+		} else {
+			frame, err = reader.ReadBytes('\n')
+			if err != nil && len(frame) == 0 {
+				return
+			}
+		}
+
+		if frame = bytes.TrimRight(frame, "\r\n\x00"); len(frame) > 0 {
+			handle(frame)
+		}
+	}
+}
+
+// parseSyslogMessage parses RFC 5424 or RFC 3164 message. APP-NAME (or TAG)
+// is returned as application, structured data params become tags.
+func parseSyslogMessage(data []byte) (application string, logRecord LogRecord, err error) {
+	msg := string(data)
+
+	if !strings.HasPrefix(msg, "<") {
+		err = errors.New("Message should start with priority")
+		return
+	}
+
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		err = errors.New("Invalid priority")
+		return
+	}
+
+	// PRI is 1-3 digits, Atoi alone would accept signs
+	if strings.TrimLeft(msg[1:end], "0123456789") != "" {
+		err = errors.New("Invalid priority")
+		return
+	}
+
+	priority, err := strconv.Atoi(msg[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		err = errors.New("Invalid priority")
+		return
+	}
+
+	logRecord.Level = syslogLevels[priority%8]
+	logRecord.Tags = []string{}
+
+	msg = msg[end+1:]
+
+	if strings.HasPrefix(msg, "1 ") {
+		application, err = parseRFC5424(msg[2:], &logRecord)
+	} else {
+		application = parseRFC3164(msg, &logRecord)
+	}
+
+	return
+}
+
+func parseRFC5424(msg string, logRecord *LogRecord) (application string, err error) {
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := strings.SplitN(msg, " ", 6)
+	if len(header) < 6 {
+		err = errors.New("Invalid RFC 5424 header")
+		return
+	}
+
+	if header[0] != "-" {
+		if logRecord.CreatedAt, err = time.Parse(time.RFC3339Nano, header[0]); err != nil {
+			err = errors.New("Invalid RFC 5424 timestamp")
+			return
+		}
+		logRecord.CreatedAt = logRecord.CreatedAt.Local()
+	}
+
+	if header[2] != "-" {
+		application = header[2]
+	}
+
+	rest := header[5]
+
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		if logRecord.Tags, rest, err = parseStructuredData(rest); err != nil {
+			return
+		}
+	}
+
+	logRecord.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xEF\xBB\xBF")
+
+	return
+}
+
+// parseStructuredData parses SD elements and returns their params as
+// "name=value" tags along with the rest of the message
+func parseStructuredData(sd string) (tags []string, rest string, err error) {
+	tags = []string{}
+
+	for strings.HasPrefix(sd, "[") {
+		i := 1
+
+		// skip SD-ID
+		for i < len(sd) && sd[i] != ' ' && sd[i] != ']' {
+			i++
+		}
+
+		for i < len(sd) && sd[i] == ' ' {
+			i++
+
+			eq := strings.Index(sd[i:], "=\"")
+			if eq < 0 {
+				err = errors.New("Invalid structured data")
+				return
+			}
+
+			name := sd[i : i+eq]
+			i += eq + 2
+
+			var value bytes.Buffer
+
+			for ; i < len(sd) && sd[i] != '"'; i++ {
+				if sd[i] == '\\' && i+1 < len(sd) && strings.IndexByte("\"\\]", sd[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(sd[i])
+			}
+
+			if i >= len(sd) {
+				err = errors.New("Invalid structured data")
+				return
+			}
+
+			tags = append(tags, name+"="+value.String())
+			i++
+		}
+
+		if i >= len(sd) || sd[i] != ']' {
+			err = errors.New("Invalid structured data")
+			return
+		}
+
+		sd = sd[i+1:]
+	}
+
+	rest = sd
+
+	return
+}
+
+func parseRFC3164(msg string, logRecord *LogRecord) (application string) {
+	if len(msg) >= len(rfc3164TimeFormat) {
+		if t, err := time.ParseInLocation(rfc3164TimeFormat, msg[:len(rfc3164TimeFormat)], time.Local); err == nil {
+			now := time.Now()
+			logRecord.CreatedAt = t.AddDate(now.Year(), 0, 0)
+
+			// message from the last year received right after New Year
+			if logRecord.CreatedAt.After(now.Add(24 * time.Hour)) {
+				logRecord.CreatedAt = logRecord.CreatedAt.AddDate(-1, 0, 0)
+			}
+
+			// skip timestamp and hostname
+			msg = strings.TrimPrefix(msg[len(rfc3164TimeFormat):], " ")
+			if sp := strings.IndexByte(msg, ' '); sp >= 0 {
+				msg = msg[sp+1:]
+			}
+		}
+	}
+
+	// TAG is alphanumeric and is terminated by "[pid]:" or ":"
+	tagEnd := strings.IndexFunc(msg, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' || r == '/')
+	})
+
+	if tagEnd > 0 && (msg[tagEnd] == ':' || msg[tagEnd] == '[') {
+		application = msg[:tagEnd]
+		msg = msg[tagEnd:]
+
+		if colon := strings.IndexByte(msg, ':'); colon >= 0 {
+			msg = msg[colon+1:]
+		}
+	}
+
+	logRecord.Message = strings.TrimPrefix(msg, " ")
+
+	return
+}
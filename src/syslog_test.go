@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Syslog", func() {
+	Describe("parseSyslogMessage", func() {
+		Context("with RFC 5424 message", func() {
+			It("should parse header, structured data and message", func() {
+				application, logRecord, err := parseSyslogMessage([]byte(
+					`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication"][meta seq="1"] An application event`,
+				))
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(application).To(Equal("evntslog"))
+				Expect(logRecord.Level).To(Equal(2))
+				Expect(logRecord.Message).To(Equal("An application event"))
+				Expect(logRecord.Tags).To(Equal([]string{"iut=3", `eventSource=App"lication`, "seq=1"}))
+				Expect(logRecord.CreatedAt.Equal(
+					time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				)).To(BeTrue())
+			})
+
+			It("should accept nil values", func() {
+				application, logRecord, err := parseSyslogMessage([]byte(
+					"<11>1 - - - - - - \xEF\xBB\xBFSomething failed",
+				))
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(application).To(BeEmpty())
+				Expect(logRecord.Level).To(Equal(4))
+				Expect(logRecord.Message).To(Equal("Something failed"))
+				Expect(logRecord.Tags).To(BeEmpty())
+				Expect(logRecord.CreatedAt.IsZero()).To(BeTrue())
+			})
+
+			It("should fail on invalid structured data", func() {
+				_, _, err := parseSyslogMessage([]byte(
+					`<165>1 - host app - - [id param="value] Message`,
+				))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("with RFC 3164 message", func() {
+			It("should parse timestamp, tag and message", func() {
+				application, logRecord, err := parseSyslogMessage([]byte(
+					"<34>Oct  1 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8",
+				))
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(application).To(Equal("su"))
+				Expect(logRecord.Level).To(Equal(5))
+				Expect(logRecord.Message).To(Equal("'su root' failed for lonvick on /dev/pts/8"))
+				Expect(logRecord.CreatedAt.Month()).To(Equal(time.October))
+				Expect(logRecord.CreatedAt.Day()).To(Equal(1))
+				Expect(logRecord.CreatedAt.Hour()).To(Equal(22))
+			})
+
+			It("should accept message without tag", func() {
+				application, logRecord, err := parseSyslogMessage([]byte(
+					"<14>Just a message",
+				))
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(application).To(BeEmpty())
+				Expect(logRecord.Level).To(Equal(1))
+				Expect(logRecord.Message).To(Equal("Just a message"))
+			})
+		})
+
+		It("should fail on message without priority", func() {
+			_, _, err := parseSyslogMessage([]byte("Just a message"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail on invalid priority", func() {
+			for _, msg := range []string{"<200>", "<-1>", "<+5>", "<>", "<1a>", "<1"} {
+				_, _, err := parseSyslogMessage([]byte(msg + "Just a message"))
+				Expect(err).To(HaveOccurred(), msg)
+			}
+		})
+	})
+
+	Describe("readSyslogFrames", func() {
+		It("should split octet counted and newline delimited frames", func() {
+			var frames []string
+
+			readSyslogFrames(
+				strings.NewReader("<14>first\n11 <14>second\n<14>third"),
+				func(frame []byte) {
+					frames = append(frames, string(frame))
+				},
+			)
+
+			Expect(frames).To(Equal([]string{"<14>first", "<14>second", "<14>third"}))
+		})
+	})
+
+	Describe("handleSyslogMessage", func() {
+		It("should save log record to the application bucket", func() {
+			handleSyslogMessage([]byte(`<11>1 - host syslogapp - - [meta seq="1"] Something failed`))
+
+			logRecords, err := loadLogRecords("syslogapp", 0, []string{"seq=1"},
+				time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(HaveLen(1))
+			Expect(logRecords[0].Message).To(Equal("Something failed"))
+			Expect(logRecords[0].Level).To(Equal(4))
+		})
+
+		It("should use default application when message has no APP-NAME", func() {
+			config.Syslog.Application = "syslog"
+			defer func() { config.Syslog.Application = "" }()
+
+			handleSyslogMessage([]byte("<14>Just a message"))
+
+			logRecords, err := loadLogRecords("syslog", 0, []string{},
+				time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 1)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logRecords).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	tcpInputName = "TCP"
+
+	tcpMaxLineSize  = 1024 * 1024
+	tcpMaxBatchSize = 1000
+)
+
+var errTCPLineTooLong = errors.New("Line is too long")
+
+type tcpAuth struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// jsonRecord is a log record received as JSON by TCP input and batch action
+type jsonRecord struct {
+	Application string   `json:"application"`
+	Message     string   `json:"message"`
+	Level       *int     `json:"level"`
+	Tags        []string `json:"tags"`
+	CreatedAt   string   `json:"created_at"`
+	TraceID     string   `json:"trace_id"`
+	SpanID      string   `json:"span_id"`
+}
+
+type tcpResponse struct {
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+func startTCPInput() {
+	if len(config.TCP.Address) == 0 {
+		return
+	}
+
+	if config.TCP.TLS {
+		serveTLS(tcpInputName, config.TCP.Address, func(conn net.Conn) {
+			handleTCPTLSConnection(conn.(*tls.Conn))
+		})
+	} else {
+		serveTCP(tcpInputName, config.TCP.Address, func(conn net.Conn) {
+			handleTCPConnection(conn, nil)
+		})
+	}
+}
+
+// handleTCPTLSConnection works like handleTCPConnection but when mutual TLS is
+// enabled, only records of the applications mapped to the client certificate
+// are accepted
+func handleTCPTLSConnection(conn *tls.Conn) {
+	if !mutualTLSEnabled() {
+		handleTCPConnection(conn, nil)
+		return
+	}
+
+	commonName, err := tlsClientCommonName(conn)
+	if err != nil {
+		logInputError(tcpInputName, err)
+		return
+	}
+
+	handleTCPConnection(conn, func(application string) bool {
+		return clientAllowedToWrite(commonName, application)
+	})
+}
+
+// handleTCPConnection reads credentials from the first line and then log
+// records, one JSON object per line. Records that are already received are
+// saved in a single batch every time the connection has no more buffered
+// data, so a busy client gets big batches. If allowedToWrite is defined,
+// records of applications it doesn't allow are rejected.
+func handleTCPConnection(conn io.ReadWriter, allowedToWrite func(application string) bool) {
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	encoder := json.NewEncoder(conn)
+
+	line, err := readTCPLine(reader)
+	if err != nil && len(line) == 0 {
+		return
+	}
+
+	if err = checkTCPAuth(line); err != nil {
+		encoder.Encode(tcpResponse{Error: err.Error(), Line: 1})
+		return
+	}
+
+	encoder.Encode(tcpResponse{Status: "ok"})
+
+	var (
+		batch   []ApplicationLogRecord
+		lineNum = 1
+	)
+
+	for {
+		line, err = readTCPLine(reader)
+		lineNum++
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			record, parseErr := parseTCPRecord(line)
+
+			switch {
+			case parseErr != nil:
+				encoder.Encode(tcpResponse{Error: parseErr.Error(), Line: lineNum})
+			case allowedToWrite != nil && !allowedToWrite(record.Application):
+				encoder.Encode(tcpResponse{Error: "Client certificate isn't allowed to write to " + record.Application, Line: lineNum})
+			default:
+				batch = append(batch, record)
+			}
+		}
+
+		if len(batch) > 0 && (err != nil || len(batch) >= tcpMaxBatchSize || reader.Buffered() == 0) {
+			if saveErr := saveLogRecords(batch); saveErr != nil {
+				logInputError(tcpInputName, saveErr)
+				encoder.Encode(tcpResponse{Error: saveErr.Error()})
+			}
+			batch = nil
+		}
+
+		if err == errTCPLineTooLong {
+			encoder.Encode(tcpResponse{Error: err.Error(), Line: lineNum})
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readTCPLine(reader *bufio.Reader) (line []byte, err error) {
+	for {
+		var chunk []byte
+
+		chunk, err = reader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > tcpMaxLineSize {
+			return nil, errTCPLineTooLong
+		}
+
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+func checkTCPAuth(line []byte) error {
+	var auth tcpAuth
+
+	if err := json.Unmarshal(line, &auth); err != nil {
+		return errors.New("First line should contain credentials")
+	}
+
+	credentials := currentConfig().Auth
+
+	if subtle.ConstantTimeCompare([]byte(auth.User), []byte(credentials.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(auth.Password), []byte(credentials.Password)) != 1 {
+		return errors.New("Invalid credentials")
+	}
+
+	return nil
+}
+
+func parseTCPRecord(line []byte) (record ApplicationLogRecord, err error) {
+	var raw jsonRecord
+
+	if err = json.Unmarshal(line, &raw); err != nil {
+		err = errors.New("Invalid JSON")
+		return
+	}
+
+	return raw.logRecord()
+}
+
+// logRecord checks the received record and converts it to a log record
+func (raw jsonRecord) logRecord() (record ApplicationLogRecord, err error) {
+	if raw.Level == nil {
+		err = errors.New("Level should be a number between 0 and 5")
+		return
+	}
+
+	if err = checkTraceParams(raw.TraceID, raw.SpanID); err != nil {
+		return
+	}
+
+	logRecord := &LogRecord{
+		Message: raw.Message,
+		Level:   *raw.Level,
+		Tags:    uniqStrings(raw.Tags),
+		TraceID: raw.TraceID,
+		SpanID:  raw.SpanID,
+	}
+
+	if logRecord.Tags == nil {
+		logRecord.Tags = []string{}
+	}
+
+	if len(raw.CreatedAt) > 0 {
+		if logRecord.CreatedAt, err = parseTime(raw.CreatedAt); err != nil {
+			if logRecord.CreatedAt, err = time.Parse(time.RFC3339Nano, raw.CreatedAt); err != nil {
+				err = errors.New("Created at has invalid format")
+				return
+			}
+		}
+	}
+
+	if err = checkInputRecord(raw.Application, logRecord); err != nil {
+		return
+	}
+
+	record = ApplicationLogRecord{raw.Application, logRecord}
+
+	return
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TCP input", func() {
+	var (
+		client net.Conn
+		reader *bufio.Reader
+		done   chan struct{}
+	)
+
+	BeforeEach(func() {
+		var server net.Conn
+		client, server = net.Pipe()
+		reader = bufio.NewReader(client)
+		done = make(chan struct{})
+
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			handleTCPConnection(server, nil)
+			server.Close()
+		}()
+	})
+
+	AfterEach(func() {
+		client.Close()
+		Eventually(done).Should(BeClosed())
+	})
+
+	send := func(line string) {
+		_, err := client.Write([]byte(line + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	receive := func() (response tcpResponse) {
+		line, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(json.Unmarshal(line, &response)).To(Succeed())
+		return
+	}
+
+	loadTCPRecords := func() LogRecords {
+		logRecords, err := loadLogRecords("tcpapp", 0, []string{},
+			time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	Context("with valid credentials", func() {
+		BeforeEach(func() {
+			send(`{"user":"test","password":"test"}`)
+			Expect(receive().Status).To(Equal("ok"))
+		})
+
+		It("should save log records", func() {
+			send(`{"application":"tcpapp","message":"Message one","level":1,"tags":["tag1","tag2"]}`)
+			send(`{"application":"tcpapp","message":"Message two","level":3}`)
+
+			Eventually(loadTCPRecords).Should(HaveLen(2))
+
+			logRecords := loadTCPRecords()
+			Expect(logRecords[0].Message).To(Equal("Message one"))
+			Expect(logRecords[0].Level).To(Equal(1))
+			Expect(logRecords[0].Tags).To(ConsistOf("tag1", "tag2"))
+			Expect(logRecords[1].Message).To(Equal("Message two"))
+		})
+
+		It("should respond with error to invalid record", func() {
+			send(`{"application":"tcpapp","message":"Message one"}`)
+
+			response := receive()
+			Expect(response.Error).NotTo(BeEmpty())
+			Expect(response.Line).To(Equal(2))
+		})
+
+		It("should respond with error to invalid JSON", func() {
+			send(`{"application":`)
+
+			response := receive()
+			Expect(response.Error).To(Equal("Invalid JSON"))
+			Expect(response.Line).To(Equal(2))
+		})
+	})
+
+	Context("with invalid credentials", func() {
+		It("should respond with error and close connection", func() {
+			send(`{"user":"test","password":"wrong"}`)
+
+			Expect(receive().Error).To(Equal("Invalid credentials"))
+			Eventually(done).Should(BeClosed())
+		})
+	})
+})
+
+var _ = Describe("TCP input over mutual TLS", func() {
+	var (
+		dir  string
+		ca   *testCA
+		done chan struct{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logbook-tcp-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca = newTestCA()
+
+		config.Server.TLS.Cert = "cert.pem"
+		config.Server.TLS.ClientCA = filepath.Join(dir, "ca.pem")
+		config.Server.TLS.Clients = map[string][]string{"writer": {"tcpapp"}}
+
+		ca.writePEM(config.Server.TLS.ClientCA)
+	})
+
+	AfterEach(func() {
+		config.Server.TLS.Cert = ""
+		config.Server.TLS.ClientCA = ""
+		config.Server.TLS.Clients = nil
+
+		if done != nil {
+			Eventually(done).Should(BeClosed())
+		}
+		os.RemoveAll(dir)
+	})
+
+	// connect starts handling of a TLS connection and returns its client side
+	connect := func(clientCerts ...tls.Certificate) *tls.Conn {
+		tlsConfig, err := prepareTLSConfig()
+		Expect(err).NotTo(HaveOccurred())
+		tlsConfig.Certificates = []tls.Certificate{ca.issue("logbook")}
+
+		// pipe isn't used since both sides may write at once on handshake
+		// failure
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		Expect(err).NotTo(HaveOccurred())
+
+		done = make(chan struct{})
+
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			defer listener.Close()
+
+			conn, err := listener.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			handleTCPTLSConnection(conn.(*tls.Conn))
+		}()
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+
+		return tls.Client(client, &tls.Config{
+			ServerName:   "logbook",
+			RootCAs:      roots,
+			Certificates: clientCerts,
+		})
+	}
+
+	loadRecords := func(application string) LogRecords {
+		logRecords, err := loadLogRecords(application, 0, []string{},
+			time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 1)
+		Expect(err).NotTo(HaveOccurred())
+		return logRecords
+	}
+
+	It("should reject records of applications not mapped to client certificate", func() {
+		conn := connect(ca.issue("writer"))
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+
+		receive := func() (response tcpResponse) {
+			line, err := reader.ReadBytes('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(line, &response)).To(Succeed())
+			return
+		}
+
+		_, err := conn.Write([]byte(`{"user":"test","password":"test"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(receive().Status).To(Equal("ok"))
+
+		_, err = conn.Write([]byte(
+			`{"application":"otherapp","message":"Forbidden message","level":1}` + "\n" +
+				`{"application":"tcpapp","message":"Allowed message","level":1}` + "\n",
+		))
+		Expect(err).NotTo(HaveOccurred())
+
+		response := receive()
+		Expect(response.Error).To(Equal("Client certificate isn't allowed to write to otherapp"))
+		Expect(response.Line).To(Equal(2))
+
+		Eventually(func() []string { return logRecordMessages(loadRecords("tcpapp")) }).Should(Equal([]string{"Allowed message"}))
+		Expect(loadRecords("otherapp")).To(BeEmpty())
+	})
+
+	It("should reject connections without client certificate", func() {
+		conn := connect()
+		defer conn.Close()
+
+		_, err := conn.Write([]byte(`{"user":"test","password":"test"}` + "\n"))
+		if err == nil {
+			_, err = bufio.NewReader(conn).ReadBytes('\n')
+		}
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/gin-gonic/gin"
+)
+
+const anyApplication = "*"
+
+func tlsEnabled() bool {
+	return len(config.Server.TLS.Cert) > 0
+}
+
+func mutualTLSEnabled() bool {
+	return tlsEnabled() && len(config.Server.TLS.ClientCA) > 0
+}
+
+// prepareTLSConfig prepares TLS config for listeners. Client certificates
+// are required and verified when client CA is configured.
+func prepareTLSConfig() (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if !mutualTLSEnabled() {
+		return
+	}
+
+	caData, err := ioutil.ReadFile(absPathToFile(config.Server.TLS.ClientCA))
+	if err != nil {
+		return
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		err = errors.New("Client CA file doesn't contain any PEM certificates")
+		return
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return
+}
+
+// prepareHTTPTLSConfig works like prepareTLSConfig but client certificate is
+// only verified if given. HTTP server requires it with requireClientCert, so
+// health checks can be done without it.
+func prepareHTTPTLSConfig() (tlsConfig *tls.Config, err error) {
+	if tlsConfig, err = prepareTLSConfig(); err != nil {
+		return
+	}
+
+	if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return
+}
+
+// clientAllowedToWrite reports whether the client certificate with the given
+// common name is mapped to the application in config.
+func clientAllowedToWrite(commonName, application string) bool {
+	for _, app := range currentConfig().Server.TLS.Clients[commonName] {
+		if app == application || app == anyApplication {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tlsClientCommonName completes the handshake and returns the common name of
+// the client certificate. It's empty if the client has no certificate.
+func tlsClientCommonName(conn *tls.Conn) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+
+	peerCertificates := conn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return "", nil
+	}
+
+	return peerCertificates[0].Subject.CommonName, nil
+}
+
+func requireClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			c.JSON(403, ErrorResponse{"Client certificate required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func clientCertAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		commonName := c.Request.TLS.PeerCertificates[0].Subject.CommonName
+
+		if !clientAllowedToWrite(commonName, c.Param("application")) {
+			c.JSON(403, ErrorResponse{"Client certificate isn't allowed to write to this application"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
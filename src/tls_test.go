@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Logbook test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &testCA{cert, key}
+}
+
+// writePEM writes the CA certificate to the file in PEM format
+func (ca *testCA) writePEM(path string) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+}
+
+// issue returns a certificate with the common name usable by both servers
+// and clients
+func (ca *testCA) issue(commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		commonName string
+		response   *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+
+		config.Server.TLS.Cert = "cert.pem"
+		config.Server.TLS.Key = "key.pem"
+		config.Server.TLS.ClientCA = "ca.pem"
+		config.Server.TLS.Clients = map[string][]string{
+			"writer": []string{"apptest"},
+			"admin":  []string{"*"},
+		}
+
+		commonName = "writer"
+	})
+
+	AfterEach(func() {
+		config.Server.TLS.Cert = ""
+		config.Server.TLS.Key = ""
+		config.Server.TLS.ClientCA = ""
+		config.Server.TLS.Clients = nil
+	})
+
+	sendTLSRequest := func(method, path, body string, withCert bool) {
+		req, err := http.NewRequest(method, "https://logbook.test"+path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+
+		req.SetBasicAuth(config.Auth.User, config.Auth.Password)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		if withCert {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{
+					{Subject: pkix.Name{CommonName: commonName}},
+				},
+			}
+		}
+
+		response = httptest.NewRecorder()
+		setupRouter().ServeHTTP(response, req)
+	}
+
+	sendPut := func(application string, withCert bool) {
+		sendTLSRequest("POST", "/"+application+"/put", "message=Lorem%20ipsum&level=1", withCert)
+	}
+
+	Describe("prepareTLSConfig", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "logbook-tls")
+			Expect(err).NotTo(HaveOccurred())
+
+			config.Server.TLS.ClientCA = filepath.Join(dir, "ca.pem")
+			newTestCA().writePEM(config.Server.TLS.ClientCA)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should require client certificate", func() {
+			tlsConfig, err := prepareTLSConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tlsConfig.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+			Expect(tlsConfig.ClientCAs).NotTo(BeNil())
+		})
+
+		It("should only verify given client certificate for HTTP server", func() {
+			tlsConfig, err := prepareHTTPTLSConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tlsConfig.ClientAuth).To(Equal(tls.VerifyClientCertIfGiven))
+			Expect(tlsConfig.ClientCAs).NotTo(BeNil())
+		})
+
+		Context("when client CA isn't configured", func() {
+			BeforeEach(func() {
+				config.Server.TLS.ClientCA = ""
+			})
+
+			It("should not request client certificate", func() {
+				tlsConfig, err := prepareTLSConfig()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(tlsConfig.ClientAuth).To(Equal(tls.NoClientCert))
+			})
+		})
+	})
+
+	Describe("clientCertAuth", func() {
+		It("should allow writes to mapped application", func() {
+			sendPut("apptest", true)
+			Expect(response.Code).To(Equal(200))
+		})
+
+		It("should forbid writes to not mapped application", func() {
+			sendPut("otherapp", true)
+			Expect(response.Code).To(Equal(403))
+		})
+
+		It("should allow deleting records of mapped application", func() {
+			sendTLSRequest("DELETE", "/apptest?before=2015-01-01", "", true)
+			Expect(response.Code).To(Equal(200))
+		})
+
+		It("should forbid deleting records of not mapped application", func() {
+			sendTLSRequest("DELETE", "/otherapp?before=2015-01-01", "", true)
+			Expect(response.Code).To(Equal(403))
+		})
+
+		It("should forbid writes without client certificate", func() {
+			sendPut("apptest", false)
+			Expect(response.Code).To(Equal(403))
+		})
+
+		Context("when client is mapped to any application", func() {
+			BeforeEach(func() {
+				commonName = "admin"
+			})
+
+			It("should allow writes to any application", func() {
+				sendPut("otherapp", true)
+				Expect(response.Code).To(Equal(200))
+			})
+		})
+
+		It("should not require client certificate for health checks", func() {
+			req, _ := http.NewRequest("GET", "https://logbook.test/healthz", nil)
+			response = httptest.NewRecorder()
+			setupRouter().ServeHTTP(response, req)
+			Expect(response.Code).To(Equal(200))
+		})
+
+		Context("when client CA isn't configured", func() {
+			BeforeEach(func() {
+				config.Server.TLS.ClientCA = ""
+			})
+
+			It("should not check client certificate", func() {
+				sendPut("otherapp", false)
+				Expect(response.Code).To(Equal(200))
+			})
+		})
+	})
+})
@@ -86,15 +86,13 @@ func uniqStrings(arr []string) []string {
 	}
 
 	m := make(map[string]struct{})
-	for _, el := range arr {
-		m[el] = struct{}{}
-	}
+	newArr := make([]string, 0, len(arr))
 
-	newArr := make([]string, len(m))
-	i := 0
-	for el := range m {
-		newArr[i] = el
-		i++
+	for _, el := range arr {
+		if _, ok := m[el]; !ok {
+			m[el] = struct{}{}
+			newArr = append(newArr, el)
+		}
 	}
 
 	return newArr
@@ -115,5 +115,10 @@ var _ = Describe("Utils", func() {
 			Expect(uniqStrings(input)).To(HaveLen(len(input)))
 			Expect(uniqStrings(input)).To(ConsistOf(input))
 		})
+
+		It("should keep order of the first occurrences", func() {
+			input := []string{"fff3", "fff", "fff3", "fff2", "fff"}
+			Expect(uniqStrings(input)).To(Equal([]string{"fff3", "fff", "fff2"}))
+		})
 	})
 })